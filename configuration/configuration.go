@@ -4,12 +4,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/netip"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/arednch/phonebook/data"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -25,18 +29,68 @@ const (
 	// This guarantees that numbers with the minimal length are not assumed to be
 	// local numbers even if they have a country prefix.
 	LocalPhoneNumberMin = LocalPhoneNumberMax - CountryPfxDigits + 1
+
+	// Minimal interval in which phones are probed via SIP OPTIONS (when enabled).
+	MinimalSIPProbeSeconds = 30
+
+	// Bounds for SIP registration expiry in seconds.
+	DefaultSIPMinExpires = 60
+	DefaultSIPMaxExpires = 60 * 60
+
+	// Number of workers handling SIP messages and messages per second
+	// accepted from a single source.
+	DefaultSIPWorkers   = 8
+	DefaultSIPRateLimit = 20
+
+	// File names of the SIP registrations snapshot, message queue, call
+	// forwarding rules and call detail records (stored next to the cache).
+	RegistrationsFile = "phonebook_registrations.json"
+	MessagesFile      = "phonebook_messages.json"
+	ForwardingFile    = "phonebook_forwarding.json"
+	CDRFile           = "phonebook_cdr.jsonl"
+
+	// File names of the self-signed LDAP certificate and key generated when
+	// none are configured (stored next to the cache).
+	LDAPCertFile = "phonebook_ldap.crt"
+	LDAPKeyFile  = "phonebook_ldap.key"
+
+	// SIP server modes (how calls are handed over to their destination).
+	SIPModeRedirect = "redirect" // answer with a redirect (default)
+	SIPModeProxy    = "proxy"    // forward the call and stay in the dialog
+
+	// Sources of routing data (tried in order until one provides routes).
+	RouteSourceSysInfo = "sysinfo"
+	RouteSourceOLSR    = "olsr"
+	RouteSourceBabel   = "babel"
+
+	DefaultOLSRFile   = "/tmp/run/hosts_olsr"
+	DefaultBabelHosts = "/var/run/arednlink/hosts"
+
+	// Base DN announced by the LDAP server when none is configured.
+	DefaultLDAPBaseDN = "ou=phonebook,dc=local,dc=mesh"
+
+	// SIP authentication (which requests need to be authenticated).
+	SIPAuthNone     = "none"
+	SIPAuthRegister = "register"
+	SIPAuthAll      = "all"
 )
 
 type Config struct {
 	// Generally applicable.
-	Sources         []string `json:"sources"`
-	SysInfoURL      string   `json:"sysinfo_url"`
-	Server          bool     `json:"server,omitempty"`
-	LDAPServer      bool     `json:"ldap_server"`
-	SIPServer       bool     `json:"sip_server"`
-	WebServer       bool     `json:"web_server"`
-	IncludeRoutable bool     `json:"include_routable"`
-	CountryPrefix   string   `json:"country_prefix"`
+	Sources      []string `json:"sources"`
+	SysInfoURL   string   `json:"sysinfo_url"`
+	RouteSources []string `json:"route_sources"`
+	OLSRFile     string   `json:"olsr_file"`
+	BabelHosts   string   `json:"babel_hosts"`
+	// Per destination link metrics: OLSR routes (jsoninfo) and/or babeld socket.
+	RouteMetricsURL string `json:"route_metrics_url"`
+	BabelSocket     string `json:"babel_socket"`
+	Server          bool   `json:"server,omitempty"`
+	LDAPServer      bool   `json:"ldap_server"`
+	SIPServer       bool   `json:"sip_server"`
+	WebServer       bool   `json:"web_server"`
+	IncludeRoutable bool   `json:"include_routable"`
+	CountryPrefix   string `json:"country_prefix"`
 
 	Debug                       bool `json:"debug"`
 	AllowRuntimeConfigChanges   bool `json:"allow_runtime_config_changes"`
@@ -63,8 +117,48 @@ type Config struct {
 	LDAPPort int    `json:"ldap_port"`
 	LDAPUser string `json:"ldap_user"`
 	LDAPPwd  string `json:"ldap_pwd"`
+	// Additional accounts (with hashed passwords and restrictions) and whether
+	// anonymous binds may read the directory (active entries without IPs only,
+	// see GetLDAPAnonymous for the default).
+	LDAPAccounts  []*data.LDAPAccount `json:"ldap_accounts"`
+	LDAPAnonymous *bool               `json:"ldap_anonymous,omitempty"`
+	// TLS: port for LDAPS (0 disables it), whether StartTLS is offered on
+	// the LDAP port and the certificate (self-signed when not set).
+	LDAPSPort    int    `json:"ldaps_port"`
+	LDAPStartTLS bool   `json:"ldap_starttls"`
+	LDAPCert     string `json:"ldap_cert"`
+	LDAPKey      string `json:"ldap_key"`
+	// Entries are placed below the base DN (below any base DN searched when empty).
+	LDAPBaseDN string `json:"ldap_base_dn"`
 	// Only relevant when SIP server is on.
-	SIPPort int `json:"sip_port"`
+	SIPPort       int      `json:"sip_port"`
+	SIPMode       string   `json:"sip_mode"`
+	SIPTransports []string `json:"sip_transports"`
+	SIPMinExpires int      `json:"sip_min_expires"`
+	SIPMaxExpires int      `json:"sip_max_expires"`
+	SIPAuth       string   `json:"sip_auth"`
+	SIPCredsFile  string   `json:"sip_credentials"`
+	// Probe phones with a route via SIP OPTIONS (0 disables probing).
+	SIPProbeSeconds int           `json:"sip_probe_seconds"`
+	SIPProbe        time.Duration `json:"-"`
+	// Hunt groups reaching several phones, defined inline and/or in a CSV file.
+	SIPGroups     []*data.HuntGroup `json:"sip_groups"`
+	SIPGroupsFile string            `json:"sip_groups_file"`
+	// Flood protection: workers handling messages, messages per second
+	// accepted per source and which sources (IPs or CIDRs) may use the server.
+	SIPWorkers   int      `json:"sip_workers"`
+	SIPRateLimit int      `json:"sip_rate_limit"`
+	SIPAllow     []string `json:"sip_allow"`
+	SIPDeny      []string `json:"sip_deny"`
+	// Record calls and messages (call detail records).
+	SIPCDR bool `json:"sip_cdr"`
+	// Normalization of dialed numbers before routing calls.
+	SIPDialPlan *data.DialPlan `json:"sip_dialplan,omitempty"`
+	// Federation: other phonebook servers (hosts or URLs) exchanging their
+	// registrations, whether to discover them via sysinfo and the shared key.
+	SIPPeers         []string `json:"sip_peers"`
+	SIPPeerDiscovery bool     `json:"sip_peer_discovery"`
+	SIPFederationKey string   `json:"sip_federation_key"`
 }
 
 func (c *Config) IsValid() error {
@@ -73,11 +167,101 @@ func (c *Config) IsValid() error {
 		return err
 	}
 
+	// Route Sources
+	if err := ValidateRouteSources(c.RouteSources); err != nil {
+		return err
+	}
+
+	// Route Metrics
+	if c.RouteMetricsURL != "" {
+		if err := ValidateURL(c.RouteMetricsURL); err != nil {
+			return fmt.Errorf("route metrics URL is invalid: %s", err)
+		}
+	}
+
 	// Country Prefix
 	if err := ValidateCountryPrefix(c.CountryPrefix); err != nil {
 		return err
 	}
 
+	// LDAP Base DN
+	if err := ValidateLDAPBaseDN(c.LDAPBaseDN); err != nil {
+		return err
+	}
+
+	// LDAP TLS
+	if (c.LDAPCert == "") != (c.LDAPKey == "") {
+		return errors.New("LDAP certificate and key need to be set together")
+	}
+	if c.LDAPSPort < 0 || c.LDAPSPort > 65535 {
+		return fmt.Errorf("LDAPS port is invalid: %d", c.LDAPSPort)
+	}
+	if c.LDAPSPort > 0 && c.LDAPSPort == c.LDAPPort {
+		return fmt.Errorf("LDAPS port must differ from the LDAP port: %d", c.LDAPSPort)
+	}
+
+	// LDAP Accounts
+	if err := ValidateLDAPAccounts(c.LDAPAccounts); err != nil {
+		return err
+	}
+
+	// SIP Mode
+	if err := ValidateSIPMode(c.SIPMode); err != nil {
+		return err
+	}
+
+	// SIP Transports
+	if err := ValidateSIPTransports(c.SIPTransports); err != nil {
+		return err
+	}
+
+	// SIP Expiry
+	if c.SIPMinExpires < 0 || c.SIPMaxExpires < 0 {
+		return fmt.Errorf("SIP min/max expires must not be negative: %d/%d", c.SIPMinExpires, c.SIPMaxExpires)
+	}
+	if c.GetSIPMinExpires() > c.GetSIPMaxExpires() {
+		return fmt.Errorf("SIP min expires must not be larger than max expires: %d > %d", c.GetSIPMinExpires(), c.GetSIPMaxExpires())
+	}
+
+	// SIP Auth
+	if err := ValidateSIPAuth(c.SIPAuth, c.SIPCredsFile); err != nil {
+		return err
+	}
+
+	// SIP Probing
+	if c.SIPProbe < 0 || (c.SIPProbe > 0 && c.SIPProbe.Seconds() < MinimalSIPProbeSeconds) {
+		return fmt.Errorf("sip probe config/flag needs to be 0 (disabled) or at least %d seconds: %d", MinimalSIPProbeSeconds, int(c.SIPProbe.Seconds()))
+	}
+
+	// SIP Flood Protection
+	if c.SIPWorkers < 0 || c.SIPRateLimit < 0 {
+		return fmt.Errorf("SIP workers/rate limit must not be negative: %d/%d", c.SIPWorkers, c.SIPRateLimit)
+	}
+	if _, err := ParseSIPACL(c.SIPAllow); err != nil {
+		return fmt.Errorf("invalid SIP allow list: %s", err)
+	}
+	if _, err := ParseSIPACL(c.SIPDeny); err != nil {
+		return fmt.Errorf("invalid SIP deny list: %s", err)
+	}
+
+	// SIP Hunt Groups
+	if err := ValidateSIPGroups(c.SIPGroups); err != nil {
+		return err
+	}
+
+	// SIP Dial Plan
+	if err := ValidateSIPDialPlan(c.SIPDialPlan); err != nil {
+		return err
+	}
+
+	// SIP Federation
+	if c.IsSIPFederated() && c.SIPFederationKey == "" {
+		return errors.New("SIP federation key needs to be set when using SIP peers or peer discovery")
+	}
+	if c.SIPPeerDiscovery && c.SysInfoURL == "" {
+		return errors.New("sysinfo URL needs to be set for SIP peer discovery")
+	}
+
 	// Check server and non-server specific configs/flags.
 	if c.Server {
 		// Validation only relevant for server.
@@ -102,15 +286,173 @@ func (c *Config) IsValid() error {
 	return nil
 }
 
+// IsSIPProxy returns true when the SIP server should forward calls instead of redirecting them.
+func (c *Config) IsSIPProxy() bool {
+	return strings.ToLower(c.SIPMode) == SIPModeProxy
+}
+
+// IsSIPFederated returns true when registrations are polled from other phonebook servers.
+func (c *Config) IsSIPFederated() bool {
+	if c.SIPPeerDiscovery {
+		return true
+	}
+	for _, p := range c.SIPPeers {
+		if strings.TrimSpace(p) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSIPTransports returns the transports to run the SIP server on (UDP if none are set).
+func (c *Config) GetSIPTransports() []string {
+	if len(c.SIPTransports) == 0 {
+		return []string{"udp"}
+	}
+	return c.SIPTransports
+}
+
+// GetRouteSources returns the sources of routing data in the order they're tried.
+func (c *Config) GetRouteSources() []string {
+	var srcs []string
+	for _, s := range c.RouteSources {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+			srcs = append(srcs, s)
+		}
+	}
+	if len(srcs) == 0 {
+		return []string{RouteSourceSysInfo, RouteSourceOLSR, RouteSourceBabel}
+	}
+	return srcs
+}
+
+// GetOLSRFile returns the path of the OLSR hosts file.
+func (c *Config) GetOLSRFile() string {
+	if c.OLSRFile == "" {
+		return DefaultOLSRFile
+	}
+	return c.OLSRFile
+}
+
+// GetBabelHosts returns the path of the hosts file (or folder) used with Babel.
+func (c *Config) GetBabelHosts() string {
+	if c.BabelHosts == "" {
+		return DefaultBabelHosts
+	}
+	return c.BabelHosts
+}
+
+// GetLDAPAnonymous returns whether anonymous binds are allowed. Unless set,
+// they are when no accounts are configured so phones without credentials
+// keep working.
+func (c *Config) GetLDAPAnonymous() bool {
+	if c.LDAPAnonymous == nil {
+		return len(c.LDAPAccounts) == 0
+	}
+	return *c.LDAPAnonymous
+}
+
+// GetLDAPBaseDN returns the base DN of the LDAP directory.
+func (c *Config) GetLDAPBaseDN() string {
+	if c.LDAPBaseDN == "" {
+		return DefaultLDAPBaseDN
+	}
+	return c.LDAPBaseDN
+}
+
+// IsLDAPTLS returns whether the LDAP server offers TLS (LDAPS and/or StartTLS).
+func (c *Config) IsLDAPTLS() bool {
+	return c.LDAPSPort > 0 || c.LDAPStartTLS
+}
+
+// GetLDAPCertPaths returns the certificate and key of the LDAP server and
+// whether they are self-signed ones to be generated when missing. The paths
+// are empty if neither is configured and there's no cache path.
+func (c *Config) GetLDAPCertPaths() (string, string, bool) {
+	if c.LDAPCert != "" {
+		return c.LDAPCert, c.LDAPKey, false
+	}
+	if c.Cache == "" {
+		return "", "", true
+	}
+	dir := filepath.Dir(c.Cache)
+	return filepath.Join(dir, LDAPCertFile), filepath.Join(dir, LDAPKeyFile), true
+}
+
+// GetRegistrationsPath returns where SIP registrations are persisted. Empty if there's no cache path.
+func (c *Config) GetRegistrationsPath() string {
+	if c.Cache == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(c.Cache), RegistrationsFile)
+}
+
+// GetMessagesPath returns where queued SIP messages are persisted. Empty if there's no cache path.
+func (c *Config) GetMessagesPath() string {
+	if c.Cache == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(c.Cache), MessagesFile)
+}
+
+// GetForwardingPath returns where call forwarding rules are persisted. Empty if there's no cache path.
+func (c *Config) GetForwardingPath() string {
+	if c.Cache == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(c.Cache), ForwardingFile)
+}
+
+// GetCDRPath returns where call detail records are written to. Empty if
+// recording is disabled or there's no cache path.
+func (c *Config) GetCDRPath() string {
+	if !c.SIPServer || !c.SIPCDR || c.Cache == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(c.Cache), CDRFile)
+}
+
+// GetSIPMinExpires returns the minimal registration expiry in seconds accepted by the SIP server.
+func (c *Config) GetSIPMinExpires() int {
+	if c.SIPMinExpires == 0 {
+		return DefaultSIPMinExpires
+	}
+	return c.SIPMinExpires
+}
+
+// GetSIPMaxExpires returns the maximal registration expiry in seconds granted by the SIP server.
+func (c *Config) GetSIPMaxExpires() int {
+	if c.SIPMaxExpires == 0 {
+		return DefaultSIPMaxExpires
+	}
+	return c.SIPMaxExpires
+}
+
+// GetSIPWorkers returns the number of workers handling SIP messages.
+func (c *Config) GetSIPWorkers() int {
+	if c.SIPWorkers == 0 {
+		return DefaultSIPWorkers
+	}
+	return c.SIPWorkers
+}
+
+// GetSIPRateLimit returns the messages per second accepted from a single source.
+func (c *Config) GetSIPRateLimit() int {
+	if c.SIPRateLimit == 0 {
+		return DefaultSIPRateLimit
+	}
+	return c.SIPRateLimit
+}
+
 func (c *Config) IsLocalNumber(pn string) bool {
-	return len(pn) > LocalPhoneNumberMax
+	return len(pn) <= LocalPhoneNumberMax
 }
 
 func (c *Config) GetLocalNumber(pn string) string {
-	if c.IsLocalNumber(pn) {
+	if c.IsLocalNumber(pn) || c.CountryPrefix == "" || !strings.HasPrefix(pn, c.CountryPrefix) {
 		return pn
 	}
-	return pn[3:]
+	return pn[len(c.CountryPrefix):]
 }
 
 func (c *Config) GetGlobalNumber(pn string) string {
@@ -151,7 +493,17 @@ func ReadFromJSON(path string) (*Config, error) {
 func ConvertToJSON(conf Config, censorSensitive bool) ([]byte, error) {
 	if censorSensitive {
 		conf.LDAPPwd = "***"
+		accounts := make([]*data.LDAPAccount, 0, len(conf.LDAPAccounts))
+		for _, a := range conf.LDAPAccounts {
+			censored := *a
+			censored.Password = "***"
+			accounts = append(accounts, &censored)
+		}
+		conf.LDAPAccounts = accounts
 		conf.WebPwd = "***"
+		if conf.SIPFederationKey != "" {
+			conf.SIPFederationKey = "***"
+		}
 	}
 	data, err := json.MarshalIndent(&conf, "", "  ")
 	if err != nil {
@@ -184,6 +536,150 @@ func ValidateCountryPrefix(pfx string) error {
 	return nil
 }
 
+func ValidateRouteSources(srcs []string) error {
+	for _, s := range srcs {
+		switch strings.ToLower(strings.TrimSpace(s)) {
+		case "", RouteSourceSysInfo, RouteSourceOLSR, RouteSourceBabel:
+		default:
+			return fmt.Errorf("route source must be one of %q, %q or %q: %q", RouteSourceSysInfo, RouteSourceOLSR, RouteSourceBabel, s)
+		}
+	}
+	return nil
+}
+
+func ValidateLDAPBaseDN(dn string) error {
+	if dn == "" {
+		return nil
+	}
+	for _, rdn := range strings.Split(dn, ",") {
+		if attr, value, ok := strings.Cut(rdn, "="); !ok || strings.TrimSpace(attr) == "" || strings.TrimSpace(value) == "" {
+			return fmt.Errorf("LDAP base DN must consist of attribute=value pairs (e.g. %q): %q", DefaultLDAPBaseDN, dn)
+		}
+	}
+	return nil
+}
+
+func ValidateLDAPAccounts(accounts []*data.LDAPAccount) error {
+	seen := make(map[string]bool)
+	for _, a := range accounts {
+		if strings.TrimSpace(a.User) == "" {
+			return errors.New("LDAP accounts need a user")
+		}
+		if seen[a.User] {
+			return fmt.Errorf("LDAP account %s is defined more than once", a.User)
+		}
+		seen[a.User] = true
+		if err := data.ValidateLDAPPasswordHash(a.Password); err != nil {
+			return fmt.Errorf("LDAP account %s: %s", a.User, err)
+		}
+	}
+	return nil
+}
+
+func ValidateSIPMode(mode string) error {
+	switch strings.ToLower(mode) {
+	case "", SIPModeRedirect, SIPModeProxy:
+		return nil
+	default:
+		return fmt.Errorf("SIP mode must be one of %q or %q: %s", SIPModeRedirect, SIPModeProxy, mode)
+	}
+}
+
+func ValidateSIPAuth(auth, credentials string) error {
+	switch strings.ToLower(auth) {
+	case "", SIPAuthNone:
+		return nil
+	case SIPAuthRegister, SIPAuthAll:
+		if credentials == "" {
+			return fmt.Errorf("SIP credentials need to be set when SIP auth is %q", auth)
+		}
+		return nil
+	default:
+		return fmt.Errorf("SIP auth must be one of %q, %q or %q: %s", SIPAuthNone, SIPAuthRegister, SIPAuthAll, auth)
+	}
+}
+
+func ValidateSIPTransports(transports []string) error {
+	for _, t := range transports {
+		switch strings.ToLower(strings.TrimSpace(t)) {
+		case "udp", "tcp":
+		default:
+			return fmt.Errorf("SIP transport must be \"udp\" or \"tcp\": %q", t)
+		}
+	}
+	return nil
+}
+
+// ParseSIPACL parses a list of IPs and CIDRs (empty entries are ignored).
+func ParseSIPACL(acl []string) ([]netip.Prefix, error) {
+	var pfxs []netip.Prefix
+	for _, a := range acl {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if !strings.Contains(a, "/") {
+			ip, err := netip.ParseAddr(a)
+			if err != nil {
+				return nil, fmt.Errorf("not an IP or CIDR: %q", a)
+			}
+			pfxs = append(pfxs, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		pfx, err := netip.ParsePrefix(a)
+		if err != nil {
+			return nil, fmt.Errorf("not an IP or CIDR: %q", a)
+		}
+		pfxs = append(pfxs, pfx.Masked())
+	}
+	return pfxs, nil
+}
+
+func ValidateSIPGroups(groups []*data.HuntGroup) error {
+	for _, g := range groups {
+		if strings.TrimSpace(g.Number) == "" {
+			return errors.New("SIP hunt groups need a number")
+		}
+		if len(g.Members) == 0 {
+			return fmt.Errorf("SIP hunt group %s needs at least one member", g.Number)
+		}
+		for _, m := range g.Members {
+			if strings.TrimSpace(m.Number) == "" {
+				return fmt.Errorf("members of SIP hunt group %s need a number", g.Number)
+			}
+			if m.Priority < 0 || m.Priority > 1 {
+				return fmt.Errorf("priority of member %s in SIP hunt group %s must be between 0 and 1: %v", m.Number, g.Number, m.Priority)
+			}
+		}
+	}
+	return nil
+}
+
+func ValidateSIPDialPlan(dp *data.DialPlan) error {
+	if dp == nil {
+		return nil
+	}
+	for code, number := range dp.ShortCodes {
+		if code == "" || number == "" {
+			return fmt.Errorf("SIP dial plan short codes need a code and number: %q -> %q", code, number)
+		}
+	}
+	for _, p := range dp.Prefixes {
+		if p.Prefix == "" && p.Replace == "" {
+			return errors.New("SIP dial plan prefixes need a prefix or replacement")
+		}
+		if p.Length < 0 {
+			return fmt.Errorf("SIP dial plan prefix length must not be negative: %d", p.Length)
+		}
+	}
+	for _, r := range dp.Rewrites {
+		if _, err := regexp.Compile(r.Match); err != nil {
+			return fmt.Errorf("SIP dial plan rewrite is not a valid regular expression %q: %s", r.Match, err)
+		}
+	}
+	return nil
+}
+
 func ValidateSources(srcs []string) error {
 	if len(srcs) == 0 {
 		return errors.New("at least one source needs to be set")
@@ -22,6 +22,13 @@ func (i item[V]) isExpired() bool {
 	return time.Now().After(i.expiry)
 }
 
+// CacheEntry is an exported copy of a cache item, e.g. to persist it.
+type CacheEntry[K comparable, V any] struct {
+	Key    K         `json:"key"`
+	Value  V         `json:"value"`
+	Expiry time.Time `json:"expiry"`
+}
+
 // TTLCache is a generic cache implementation with support for time-to-live (TTL) expiration.
 type TTLCache[K comparable, V any] struct {
 	items map[K]item[V] // The map storing cache items.
@@ -83,6 +90,22 @@ func (c *TTLCache[K, V]) Set(key K, value V, ttl time.Duration) {
 	}
 }
 
+// GetOrSet retrieves the value associated with the given key or adds the one
+// returned by newValue when there's none (returning false). Either way, the
+// item expires after the time-to-live (TTL) from now.
+func (c *TTLCache[K, V]) GetOrSet(key K, newValue func() V, ttl time.Duration) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i, found := c.items[key]
+	if !found || i.isExpired() {
+		i.value, found = newValue(), false
+	}
+	i.expiry = time.Now().Add(ttl)
+	c.items[key] = i
+	return i.value, found
+}
+
 // Get retrieves the value associated with the given key from the cache.
 func (c *TTLCache[K, V]) Get(key K) (V, bool) {
 	c.mu.Lock()
@@ -100,6 +123,23 @@ func (c *TTLCache[K, V]) Get(key K) (V, bool) {
 	return item.value, true
 }
 
+// GetWithExpiry retrieves the value and its expiration time for the given key.
+func (c *TTLCache[K, V]) GetWithExpiry(key K) (V, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, found := c.items[key]
+	if !found {
+		return item.value, time.Time{}, false
+	}
+
+	if item.isExpired() {
+		delete(c.items, key)
+		return item.value, time.Time{}, false
+	}
+	return item.value, item.expiry, true
+}
+
 // Remove removes the item with the specified key from the cache.
 func (c *TTLCache[K, V]) Remove(key K) {
 	c.mu.Lock()
@@ -123,3 +163,48 @@ func (c *TTLCache[K, V]) Pop(key K) (V, bool) {
 	}
 	return item.value, true
 }
+
+// Snapshot returns all items which haven't expired yet.
+func (c *TTLCache[K, V]) Snapshot() []CacheEntry[K, V] {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var entries []CacheEntry[K, V]
+	for k, item := range c.items {
+		if item.isExpired() {
+			continue
+		}
+		entries = append(entries, CacheEntry[K, V]{
+			Key:    k,
+			Value:  item.value,
+			Expiry: item.expiry,
+		})
+	}
+	return entries
+}
+
+// Restore adds the entries (e.g. from a snapshot) to the cache while keeping
+// their original expiration time. Expired entries are dropped, as are entries
+// for keys already present with a later expiration (e.g. set meanwhile).
+// Returns the number of entries restored.
+func (c *TTLCache[K, V]) Restore(entries []CacheEntry[K, V]) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int
+	for _, e := range entries {
+		i := item[V]{
+			value:  e.Value,
+			expiry: e.Expiry,
+		}
+		if i.isExpired() {
+			continue
+		}
+		if cur, ok := c.items[e.Key]; ok && !cur.isExpired() && !cur.expiry.Before(i.expiry) {
+			continue
+		}
+		c.items[e.Key] = i
+		n++
+	}
+	return n
+}
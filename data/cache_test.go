@@ -0,0 +1,53 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestore(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name     string
+		current  string // value set before restoring (empty for none)
+		ttl      time.Duration
+		restored time.Time
+		want     string
+	}{
+		{
+			name:     "new key",
+			restored: now.Add(time.Minute),
+			want:     "restored",
+		},
+		{
+			name:     "expired entry",
+			restored: now.Add(-time.Minute),
+			want:     "",
+		},
+		{
+			name:     "current entry expires later",
+			current:  "current",
+			ttl:      time.Hour,
+			restored: now.Add(time.Minute),
+			want:     "current",
+		},
+		{
+			name:     "restored entry expires later",
+			current:  "current",
+			ttl:      time.Minute,
+			restored: now.Add(time.Hour),
+			want:     "restored",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewTTL[string, string]()
+			if tc.current != "" {
+				c.Set("key", tc.current, tc.ttl)
+			}
+			c.Restore([]CacheEntry[string, string]{{Key: "key", Value: "restored", Expiry: tc.restored}})
+			if got, _ := c.Get("key"); got != tc.want {
+				t.Errorf("Get() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
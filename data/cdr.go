@@ -0,0 +1,136 @@
+package data
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serializes access to the records files, which are written by the SIP server
+// and read by the web server (e.g. while being rotated).
+var cdrMu sync.RWMutex
+
+// CDR is a call detail record of a call (INVITE) or message handled by the SIP server.
+type CDR struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	CallID      string    `json:"call_id,omitempty"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Destination string    `json:"destination,omitempty"` // where the call/message was sent to
+	StatusCode  int       `json:"status_code"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// CSVHeader returns the column names matching CSVRecord.
+func (c *CDR) CSVHeader() []string {
+	return []string{"time", "method", "call_id", "from", "to", "destination", "status_code", "reason"}
+}
+
+func (c *CDR) CSVRecord() []string {
+	return []string{
+		c.Time.Format(time.RFC3339),
+		c.Method,
+		c.CallID,
+		c.From,
+		c.To,
+		c.Destination,
+		strconv.Itoa(c.StatusCode),
+		c.Reason,
+	}
+}
+
+// CDRFilter selects call detail records. Empty fields match everything.
+type CDRFilter struct {
+	Method string
+	From   string // substring
+	To     string // substring
+	Status int
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f *CDRFilter) Matches(c *CDR) bool {
+	if f.Method != "" && !strings.EqualFold(f.Method, c.Method) {
+		return false
+	}
+	if f.From != "" && !strings.Contains(strings.ToLower(c.From), strings.ToLower(f.From)) {
+		return false
+	}
+	if f.To != "" && !strings.Contains(strings.ToLower(c.To), strings.ToLower(f.To)) {
+		return false
+	}
+	if f.Status != 0 && f.Status != c.StatusCode {
+		return false
+	}
+	if !f.Since.IsZero() && c.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !c.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// AppendCDR writes the record as a JSON line to the file. Once the file
+// exceeds maxSize, it's rotated (previous file gets a ".1" suffix).
+func AppendCDR(path string, c *CDR, maxSize int64) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	cdrMu.Lock()
+	defer cdrMu.Unlock()
+	if fi, err := os.Stat(path); err == nil && fi.Size()+int64(len(b)) > maxSize {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadCDRs returns the records of the file and its rotated predecessor (oldest first).
+// Lines which can't be parsed (e.g. truncated ones) are skipped.
+func ReadCDRs(path string) ([]*CDR, error) {
+	cdrMu.RLock()
+	defer cdrMu.RUnlock()
+
+	var cdrs []*CDR
+	for _, p := range []string{path + ".1", path} {
+		f, err := os.Open(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			c := &CDR{}
+			if err := json.Unmarshal(scanner.Bytes(), c); err != nil {
+				continue
+			}
+			cdrs = append(cdrs, c)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cdrs, nil
+}
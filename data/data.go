@@ -16,7 +16,7 @@ const (
 type ByName []*Entry
 
 func (e ByName) sortKeyForEntry(entry *Entry) string {
-	if entry.Route != nil {
+	if entry.IsActive() {
 		// Mark active entries so they appear first.
 		return fmt.Sprintf("*%s %s %s", entry.LastName, entry.FirstName, entry.Callsign)
 	}
@@ -52,7 +52,25 @@ type Entry struct {
 	PhoneNumber string
 
 	// Metadata
-	Route *RouteEntry // if present, the participant seems to be active
+	Route        *RouteEntry   // if present, the participant seems to be active
+	Reachability *Reachability // if present, the phone was probed via SIP OPTIONS
+}
+
+// Reachability is the result of probing a phone via SIP OPTIONS.
+type Reachability struct {
+	Responding bool
+	Latency    time.Duration
+	UserAgent  string
+	Checked    time.Time
+}
+
+// IsActive returns true if the participant seems to be active. Phones which were
+// probed additionally need to have answered.
+func (e *Entry) IsActive() bool {
+	if e.Route == nil {
+		return false
+	}
+	return e.Reachability == nil || e.Reachability.Responding
 }
 
 func (e *Entry) DisplayName(pfx string) string {
@@ -0,0 +1,22 @@
+package data
+
+// DialPlan normalizes dialed numbers before they are looked up.
+type DialPlan struct {
+	// Short codes mapping to full numbers (e.g. "1" to "800030").
+	ShortCodes map[string]string `json:"short_codes,omitempty"`
+	// Prefixes replaced (or stripped) at the start of dialed numbers.
+	Prefixes []*DialPlanPrefix `json:"prefixes,omitempty"`
+	// Regular expression rewrites, applied in order.
+	Rewrites []*DialPlanRewrite `json:"rewrites,omitempty"`
+}
+
+type DialPlanPrefix struct {
+	Prefix  string `json:"prefix"`           // empty to add the replacement to all numbers (see length)
+	Replace string `json:"replace"`          // empty to strip the prefix
+	Length  int    `json:"length,omitempty"` // only applies to numbers of this length (0 for any)
+}
+
+type DialPlanRewrite struct {
+	Match   string `json:"match"`   // regular expression
+	Replace string `json:"replace"` // replacement, may reference groups (e.g. $1)
+}
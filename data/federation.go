@@ -0,0 +1,85 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Web endpoint where phonebook servers export their local registrations to peers.
+	FederationPath = "/registrations"
+
+	// Header carrying the signature of the registrations returned to a peer.
+	FederationSignatureHeader = "X-Phonebook-Signature"
+	// Signed requests older (or further ahead) than this are refused.
+	FederationMaxSkew = 5 * time.Minute
+
+	federationAuthScheme = "PhonebookHMAC"
+)
+
+// FederatedRegistrations are the phones registered locally with a phonebook server,
+// exported to other phonebook servers on the mesh.
+type FederatedRegistrations struct {
+	SIPPort       int                      `json:"sip_port"`
+	Registrations []*FederatedRegistration `json:"registrations"`
+}
+
+type FederatedRegistration struct {
+	Number  string    `json:"number"`
+	UA      string    `json:"ua,omitempty"`
+	Expires time.Time `json:"expires"`
+
+	// Where the phone is registered (set when received from a peer).
+	Home    string `json:"-"`
+	SIPPort int    `json:"-"`
+}
+
+// FederationAuthorization signs a request for registrations with the shared
+// key, so peers can verify it without the key being sent over the mesh.
+func FederationAuthorization(key, nonce string, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return fmt.Sprintf("%s ts=%s, nonce=%s, sig=%s", federationAuthScheme, ts, nonce, federationMAC(key, "request", ts, nonce))
+}
+
+// CheckFederationAuthorization verifies a signed request for registrations and
+// returns its nonce, which the response is signed with.
+func CheckFederationAuthorization(key, auth string, now time.Time) (string, error) {
+	params, ok := strings.CutPrefix(auth, federationAuthScheme+" ")
+	if !ok {
+		return "", errors.New("not signed")
+	}
+	values := make(map[string]string)
+	for _, p := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		values[k] = v
+	}
+	ts, err := strconv.ParseInt(values["ts"], 10, 64)
+	if err != nil || values["nonce"] == "" {
+		return "", errors.New("invalid signature parameters")
+	}
+	if skew := now.Sub(time.Unix(ts, 0)); skew > FederationMaxSkew || skew < -FederationMaxSkew {
+		return "", fmt.Errorf("signature time is off by %s", skew.Round(time.Second))
+	}
+	if !hmac.Equal([]byte(values["sig"]), []byte(federationMAC(key, "request", values["ts"], values["nonce"]))) {
+		return "", errors.New("invalid signature")
+	}
+	return values["nonce"], nil
+}
+
+// FederationSignature signs the registrations returned for a request (nonce),
+// so peers only accept registrations from servers knowing the shared key.
+func FederationSignature(key, nonce string, body []byte) string {
+	return federationMAC(key, "response", nonce, string(body))
+}
+
+func federationMAC(key string, parts ...string) string {
+	m := hmac.New(sha256.New, []byte(key))
+	m.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(m.Sum(nil))
+}
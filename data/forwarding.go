@@ -0,0 +1,130 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// Conditions under which calls are forwarded.
+	ForwardAlways      = "always"      // every call
+	ForwardUnreachable = "unreachable" // phone is neither registered nor active
+	ForwardBusy        = "busy"        // phone answers busy (only in proxy mode)
+
+	timeOfDayLayout = "15:04"
+)
+
+var ForwardConditions = []string{
+	ForwardAlways,
+	ForwardUnreachable,
+	ForwardBusy,
+}
+
+// Forwarding holds the call forwarding rules of all phone numbers.
+type Forwarding struct {
+	Mu    *sync.RWMutex     `json:"-"`
+	Rules []*ForwardingRule `json:"rules"`
+}
+
+type ForwardingRule struct {
+	ID        string `json:"id"`
+	Number    string `json:"number"`    // phone number whose calls are forwarded
+	Condition string `json:"condition"` // see ForwardConditions
+	Target    string `json:"target"`    // phone number calls are forwarded to
+	// Optional time of day (HH:MM, local time) during which the rule applies.
+	// The range may span midnight (e.g. 22:00 - 06:00).
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+func (r *ForwardingRule) Validate() error {
+	if r.Number == "" || r.Target == "" {
+		return errors.New("number and target need to be set")
+	}
+	if r.Number == r.Target {
+		return errors.New("number can't be forwarded to itself")
+	}
+	if !slices.Contains(ForwardConditions, r.Condition) {
+		return fmt.Errorf("condition must be one of %v: %q", ForwardConditions, r.Condition)
+	}
+	if (r.Start == "") != (r.End == "") {
+		return errors.New("both start and end (or neither) need to be set")
+	}
+	for _, t := range []string{r.Start, r.End} {
+		if t == "" {
+			continue
+		}
+		if _, err := time.Parse(timeOfDayLayout, t); err != nil {
+			return fmt.Errorf("time of day must be in HH:MM format: %q", t)
+		}
+	}
+	return nil
+}
+
+// IsTimed returns true if the rule only applies during a time of day.
+func (r *ForwardingRule) IsTimed() bool {
+	return r.Start != "" && r.End != ""
+}
+
+// ActiveAt checks whether the rule applies at the given time.
+func (r *ForwardingRule) ActiveAt(t time.Time) bool {
+	if !r.IsTimed() {
+		return true
+	}
+	start, err := time.Parse(timeOfDayLayout, r.Start)
+	if err != nil {
+		return false
+	}
+	end, err := time.Parse(timeOfDayLayout, r.End)
+	if err != nil {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+	from := start.Hour()*60 + start.Minute()
+	to := end.Hour()*60 + end.Minute()
+	if from <= to {
+		return now >= from && now < to
+	}
+	return now >= from || now < to // spanning midnight
+}
+
+// Find returns the first rule for the number and condition which applies at the given time.
+func (f *Forwarding) Find(number, condition string, t time.Time) *ForwardingRule {
+	f.Mu.RLock()
+	defer f.Mu.RUnlock()
+	for _, r := range f.Rules {
+		if r.Number == number && r.Condition == condition && r.ActiveAt(t) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Load reads the rules from disk.
+func (f *Forwarding) Load(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+	return json.Unmarshal(b, f)
+}
+
+// SaveLocked writes the rules to disk. Needs to be called while holding the lock.
+func (f *Forwarding) SaveLocked(path string) error {
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
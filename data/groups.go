@@ -0,0 +1,21 @@
+package data
+
+// HuntGroup is a group extension which reaches several phones.
+type HuntGroup struct {
+	Number  string             `json:"number"`
+	Name    string             `json:"name,omitempty"`
+	Members []*HuntGroupMember `json:"members"`
+}
+
+type HuntGroupMember struct {
+	Number string `json:"number"`
+	// Priority (q-value) between 0 and 1, higher is tried first. Defaults to 1.
+	Priority float64 `json:"priority,omitempty"`
+}
+
+func (m *HuntGroupMember) Q() float64 {
+	if m.Priority == 0 {
+		return 1
+	}
+	return m.Priority
+}
@@ -0,0 +1,90 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+const (
+	// Scheme used when hashing LDAP passwords.
+	DefaultLDAPPasswordScheme = "{SSHA512}"
+
+	ldapSaltLength = 16
+)
+
+// Salted SHA-2 (and SHA-1 for slappasswd compatibility) password schemes as
+// used by OpenLDAP: base64(hash(password + salt) + salt).
+var ldapPasswordSchemes = map[string]func() hash.Hash{
+	"{SSHA}":    sha1.New,
+	"{SSHA256}": sha256.New,
+	"{SSHA512}": sha512.New,
+}
+
+// LDAPAccount is an account which can bind to the LDAP server.
+type LDAPAccount struct {
+	User string `json:"user"`
+	// Hashed password, e.g. "{SSHA512}..." (see -ldap_hash_password).
+	Password string `json:"password"`
+	// Restrictions of what the account sees.
+	ActiveOnly bool `json:"active_only,omitempty"`
+	HideIPs    bool `json:"hide_ips,omitempty"`
+}
+
+// CheckPassword verifies the password against the hashed one of the account.
+func (a *LDAPAccount) CheckPassword(pw string) bool {
+	digest, salt, newHash, err := splitLDAPPasswordHash(a.Password)
+	if err != nil {
+		return false
+	}
+	h := newHash()
+	h.Write([]byte(pw))
+	h.Write(salt)
+	return subtle.ConstantTimeCompare(h.Sum(nil), digest) == 1
+}
+
+// HashLDAPPassword hashes a password with a random salt for use in LDAP accounts.
+func HashLDAPPassword(pw string) (string, error) {
+	salt := make([]byte, ldapSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("unable to generate salt: %s", err)
+	}
+	h := ldapPasswordSchemes[DefaultLDAPPasswordScheme]()
+	h.Write([]byte(pw))
+	h.Write(salt)
+	return DefaultLDAPPasswordScheme + base64.StdEncoding.EncodeToString(append(h.Sum(nil), salt...)), nil
+}
+
+// ValidateLDAPPasswordHash checks whether the hashed password is in a supported scheme.
+func ValidateLDAPPasswordHash(hashed string) error {
+	_, _, _, err := splitLDAPPasswordHash(hashed)
+	return err
+}
+
+func splitLDAPPasswordHash(hashed string) ([]byte, []byte, func() hash.Hash, error) {
+	end := strings.IndexByte(hashed, '}')
+	if !strings.HasPrefix(hashed, "{") || end < 0 {
+		return nil, nil, nil, fmt.Errorf("password needs to be hashed (e.g. %s...)", DefaultLDAPPasswordScheme)
+	}
+	scheme := strings.ToUpper(hashed[:end+1])
+	newHash, ok := ldapPasswordSchemes[scheme]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("unsupported password scheme: %s", scheme)
+	}
+	raw, err := base64.StdEncoding.DecodeString(hashed[end+1:])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid password hash: %s", err)
+	}
+	size := newHash().Size()
+	if len(raw) <= size {
+		return nil, nil, nil, errors.New("invalid password hash: no salt")
+	}
+	return raw[:size], raw[size:], newHash, nil
+}
@@ -0,0 +1,43 @@
+package data
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	MessagePending   = "pending"
+	MessageDelivered = "delivered"
+	MessageFailed    = "failed"  // recipient refused the message
+	MessageExpired   = "expired" // recipient wasn't reachable in time
+)
+
+// Messages holds SIP messages waiting to be delivered and a history of the
+// ones which were already handled.
+type Messages struct {
+	Mu *sync.RWMutex `json:"-"`
+
+	Pending []*Message `json:"pending"`
+	History []*Message `json:"history"`
+}
+
+type Message struct {
+	ID          string    `json:"id"`
+	CallID      string    `json:"call_id,omitempty"` // when received via SIP
+	From        string    `json:"from"`              // phone number
+	FromName    string    `json:"from_name,omitempty"`
+	FromHost    string    `json:"from_host"`
+	To          string    `json:"to"`                // phone number
+	ToHost      string    `json:"to_host,omitempty"` // when received via SIP
+	ContentType string    `json:"content_type"`
+	Body        string    `json:"body"`
+	Status      string    `json:"status"`
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	Handled     time.Time `json:"handled,omitempty"` // when delivered, failed or expired
+	LastError   string    `json:"last_error,omitempty"`
+	// Whether the sender is told when the message can't be delivered
+	// (set for messages received via SIP, which are answered right away).
+	ReportFailure bool `json:"report_failure,omitempty"`
+}
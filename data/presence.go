@@ -0,0 +1,48 @@
+package data
+
+import "encoding/xml"
+
+const (
+	PresenceOpen   = "open"
+	PresenceClosed = "closed"
+)
+
+// PIDFPresence is a presence document sent for the "presence" event package.
+// https://datatracker.ietf.org/doc/html/rfc3863
+type PIDFPresence struct {
+	XMLName xml.Name     `xml:"urn:ietf:params:xml:ns:pidf presence"`
+	Entity  string       `xml:"entity,attr"`
+	Tuples  []*PIDFTuple `xml:"tuple"`
+}
+
+type PIDFTuple struct {
+	ID      string `xml:"id,attr"`
+	Basic   string `xml:"status>basic"` // open or closed
+	Contact string `xml:"contact,omitempty"`
+	Note    string `xml:"note,omitempty"`
+}
+
+const (
+	// States of a dialog (the ones used, see RFC 4235 for all).
+	DialogTrying     = "trying"
+	DialogEarly      = "early"
+	DialogConfirmed  = "confirmed"
+	DialogTerminated = "terminated"
+)
+
+// DialogInfo is a dialog state document sent for the "dialog" event package.
+// https://datatracker.ietf.org/doc/html/rfc4235
+type DialogInfo struct {
+	XMLName xml.Name            `xml:"urn:ietf:params:xml:ns:dialog-info dialog-info"`
+	Version int                 `xml:"version,attr"`
+	State   string              `xml:"state,attr"` // full or partial
+	Entity  string              `xml:"entity,attr"`
+	Dialogs []*DialogInfoDialog `xml:"dialog"`
+}
+
+type DialogInfoDialog struct {
+	ID        string `xml:"id,attr"`
+	CallID    string `xml:"call-id,attr,omitempty"`
+	Direction string `xml:"direction,attr,omitempty"` // initiator or recipient
+	State     string `xml:"state"`
+}
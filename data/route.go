@@ -1,12 +1,61 @@
 package data
 
 import (
+	"fmt"
 	"strings"
 )
 
+const (
+	// Quality of the route to a phone, derived from its link metrics.
+	QualityUnknown  = "" // no metrics available
+	QualityGood     = "good"
+	QualityDegraded = "degraded"
+	QualityPoor     = "poor"
+
+	// Average ETX per hop up to which a route is considered good or degraded (1 is a perfect link).
+	goodETXPerHop     = 1.5
+	degradedETXPerHop = 3
+)
+
 type RouteEntry struct {
 	IP       string
 	Hostname string
+
+	// Link metrics of the route (zero when unknown).
+	Hops int     // number of hops to the destination
+	ETX  float64 // expected transmission count, summed over all hops
+}
+
+// Quality rates the route based on its average ETX per hop. When the number
+// of hops is unknown (e.g. with Babel), the ETX of the whole route is rated.
+func (r *RouteEntry) Quality() string {
+	if r.ETX <= 0 {
+		return QualityUnknown
+	}
+	hops := max(r.Hops, 1)
+	switch etx := r.ETX / float64(hops); {
+	case etx <= goodETXPerHop:
+		return QualityGood
+	case etx <= degradedETXPerHop:
+		return QualityDegraded
+	default:
+		return QualityPoor
+	}
+}
+
+// RouteMetric is the route to a destination prefix (usually the LAN of a node)
+// as reported by OLSR (jsoninfo plugin, /routes) or Babel.
+type RouteMetric struct {
+	Destination string  `json:"destination"`
+	Genmask     int     `json:"genmask"`
+	Gateway     string  `json:"gateway"`
+	Hops        int     `json:"metric"` // zero when unknown (Babel)
+	ETX         float64 `json:"etx"`
+	Interface   string  `json:"networkInterface"`
+}
+
+type RouteMetrics struct {
+	Routes []*RouteMetric `json:"routes"`
 }
 
 func NewEntryFromRoute(o *RouteEntry) *Entry {
@@ -16,3 +65,18 @@ func NewEntryFromRoute(o *RouteEntry) *Entry {
 		Route:       o,
 	}
 }
+
+// ActiveMarkers returns the prefix and the label (e.g. " [poor]" for a
+// degraded or poor route) to mark the name of an active entry with. Both are
+// empty when active entries aren't indicated or the entry isn't active.
+func (e *Entry) ActiveMarkers(indicateActive bool, activePfx string) (string, string) {
+	if !indicateActive || !e.IsActive() {
+		return "", ""
+	}
+	switch q := e.Route.Quality(); q {
+	case QualityDegraded, QualityPoor:
+		return activePfx, fmt.Sprintf(" [%s]", q)
+	default:
+		return activePfx, ""
+	}
+}
@@ -1,12 +1,14 @@
 package data
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"math/rand"
+	"net"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -15,6 +17,9 @@ const (
 	DefaultSIPVersion  = "SIP/2.0"
 	DefaultMaxForwards = "30"
 
+	// https://datatracker.ietf.org/doc/html/rfc3261#section-8.1.1.7
+	BranchMagicCookie = "z9hG4bK"
+
 	SIPNewline = "\r\n"
 )
 
@@ -26,6 +31,45 @@ func GenerateFromTag() string {
 	return strconv.Itoa(rand.Int())
 }
 
+func GenerateBranch() string {
+	return fmt.Sprintf("%s%d", BranchMagicCookie, rand.Int())
+}
+
+// Compact forms of header names.
+// https://datatracker.ietf.org/doc/html/rfc3261#section-7.3.3
+// https://www.iana.org/assignments/sip-parameters/sip-parameters.xhtml#sip-parameters-2
+var compactHeaders = map[string]string{
+	"a": "Accept-Contact",
+	"b": "Referred-By",
+	"c": "Content-Type",
+	"d": "Request-Disposition",
+	"e": "Content-Encoding",
+	"f": "From",
+	"i": "Call-ID",
+	"j": "Reject-Contact",
+	"k": "Supported",
+	"l": "Content-Length",
+	"m": "Contact",
+	"o": "Event",
+	"r": "Refer-To",
+	"s": "Subject",
+	"t": "To",
+	"u": "Allow-Events",
+	"v": "Via",
+	"x": "Session-Expires",
+	"y": "Identity",
+}
+
+// headerKey returns the lower case full name of a header so that names can be
+// compared independent of their case and compact form.
+func headerKey(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if full, ok := compactHeaders[name]; ok {
+		return strings.ToLower(full)
+	}
+	return name
+}
+
 type SIPMessage struct {
 	SIPVersion string // Set to 2.0 version by default
 	Headers    []*SIPHeader
@@ -34,7 +78,7 @@ type SIPMessage struct {
 
 func (m *SIPMessage) From() *SIPAddress {
 	for _, hdr := range m.Headers {
-		if strings.ToLower(hdr.Name) != "from" {
+		if headerKey(hdr.Name) != "from" {
 			continue
 		}
 		return hdr.Address
@@ -44,7 +88,7 @@ func (m *SIPMessage) From() *SIPAddress {
 
 func (m *SIPMessage) To() *SIPAddress {
 	for _, hdr := range m.Headers {
-		if strings.ToLower(hdr.Name) != "to" {
+		if headerKey(hdr.Name) != "to" {
 			continue
 		}
 		return hdr.Address
@@ -54,7 +98,7 @@ func (m *SIPMessage) To() *SIPAddress {
 
 func (m *SIPMessage) Contact() *SIPAddress {
 	for _, hdr := range m.Headers {
-		if strings.ToLower(hdr.Name) != "contact" {
+		if headerKey(hdr.Name) != "contact" {
 			continue
 		}
 		return hdr.Address
@@ -69,11 +113,12 @@ func (m *SIPMessage) AddHeader(name, value string) {
 	})
 }
 
+// FindHeaders returns the headers with the given name (also in compact form).
 func (m *SIPMessage) FindHeaders(name string) []*SIPHeader {
 	var hdrs []*SIPHeader
-	name = strings.ToLower(name)
+	name = headerKey(name)
 	for _, hdr := range m.Headers {
-		if strings.ToLower(hdr.Name) == name {
+		if headerKey(hdr.Name) == name {
 			hdrs = append(hdrs, hdr)
 		}
 	}
@@ -82,9 +127,9 @@ func (m *SIPMessage) FindHeaders(name string) []*SIPHeader {
 
 func (m *SIPMessage) RemoveHeaders(name string) {
 	var hdrs []*SIPHeader
-	name = strings.ToLower(name)
+	name = headerKey(name)
 	for _, hdr := range m.Headers {
-		if strings.ToLower(hdr.Name) == name {
+		if headerKey(hdr.Name) == name {
 			continue
 		}
 		hdrs = append(hdrs, hdr)
@@ -92,11 +137,96 @@ func (m *SIPMessage) RemoveHeaders(name string) {
 	m.Headers = hdrs
 }
 
+// HeaderValues returns all values of the headers with the given name in order.
+// Comma separated values (e.g. multiple Via in one header) are split up.
+func (m *SIPMessage) HeaderValues(name string) []string {
+	var vals []string
+	for _, hdr := range m.FindHeaders(name) {
+		vals = append(vals, splitHeaderValues(hdr.Value)...)
+	}
+	return vals
+}
+
+// PopHeaderValue removes the first value of the headers with the given name
+// and returns it.
+func (m *SIPMessage) PopHeaderValue(name string) (string, bool) {
+	name = headerKey(name)
+	for i, hdr := range m.Headers {
+		if headerKey(hdr.Name) != name {
+			continue
+		}
+		vals := splitHeaderValues(hdr.Value)
+		if len(vals) <= 1 {
+			m.Headers = append(m.Headers[:i], m.Headers[i+1:]...)
+		} else {
+			hdr.Value = strings.Join(vals[1:], ", ")
+		}
+		if len(vals) == 0 {
+			return "", true
+		}
+		return vals[0], true
+	}
+	return "", false
+}
+
+// PushHeaderValue adds a value in front of all existing values of the headers
+// with the given name.
+func (m *SIPMessage) PushHeaderValue(name, value string) {
+	hdr := &SIPHeader{
+		Name:  name,
+		Value: value,
+	}
+	key := headerKey(name)
+	for i, h := range m.Headers {
+		if headerKey(h.Name) != key {
+			continue
+		}
+		m.Headers = append(m.Headers[:i], append([]*SIPHeader{hdr}, m.Headers[i:]...)...)
+		return
+	}
+	m.Headers = append([]*SIPHeader{hdr}, m.Headers...)
+}
+
+// SetTopVia replaces the topmost Via of the message.
+func (m *SIPMessage) SetTopVia(via *SIPVia) {
+	m.PopHeaderValue("Via")
+	m.PushHeaderValue("Via", via.String())
+}
+
+// TopVia returns the topmost Via of the message.
+func (m *SIPMessage) TopVia() *SIPVia {
+	vals := m.HeaderValues("Via")
+	if len(vals) == 0 {
+		return nil
+	}
+	via := &SIPVia{}
+	if err := via.Parse(vals[0]); err != nil {
+		return nil
+	}
+	return via
+}
+
+// CSeq returns the sequence number and method of the CSeq header.
+func (m *SIPMessage) CSeq() (int, string) {
+	for _, hdr := range m.FindHeaders("CSeq") {
+		parts := strings.Fields(hdr.Value)
+		if len(parts) != 2 {
+			continue
+		}
+		seq, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		return seq, strings.ToUpper(parts[1])
+	}
+	return 0, ""
+}
+
 func (m *SIPMessage) ContentLength(update bool) (int, error) {
 	len := len(m.Body)
 	for _, hdr := range m.FindHeaders("Content-Length") {
-		l, err := strconv.Atoi(hdr.Value)
-		if err != nil {
+		l, err := strconv.Atoi(strings.TrimSpace(hdr.Value))
+		if err != nil || l < 0 {
 			continue
 		}
 		if update && len != l {
@@ -107,14 +237,33 @@ func (m *SIPMessage) ContentLength(update bool) (int, error) {
 	return 0, errors.New("no content length found")
 }
 
+// NewSIPRequest creates a request outside of a dialog. The From address gets a
+// tag if it doesn't have one yet. The Via is only a placeholder and usually
+// replaced when sending the request (where the local address and port are known).
 func NewSIPRequest(method string, from, to *SIPAddress, seq int, hdrs []*SIPHeader, body []byte) *SIPRequest {
+	if from.Params["tag"] == "" {
+		from = from.Clone()
+		if from.Params == nil {
+			from.Params = make(map[string]string)
+		}
+		from.Params["tag"] = GenerateFromTag()
+	}
+	via := &SIPVia{
+		Transport: "UDP",
+		Host:      from.URI.Host,
+		Port:      from.URI.Port,
+		Params: map[string]string{
+			"branch": GenerateBranch(),
+			"rport":  "",
+		},
+	}
 	resp := &SIPRequest{
 		SIPMessage: SIPMessage{
 			SIPVersion: DefaultSIPVersion,
 			Headers: []*SIPHeader{
 				{
 					Name:  "Via",
-					Value: fmt.Sprintf("%s/UDP %s", DefaultSIPVersion, from.URI.Host),
+					Value: via.String(),
 				}, {
 					Name:    "From",
 					Value:   from.String(),
@@ -149,43 +298,37 @@ type SIPRequest struct {
 	URI    string
 }
 
-func (r *SIPRequest) Parse(data []byte) error {
-	var i int
-	scanner := bufio.NewScanner(bytes.NewReader(data))
-	for scanner.Scan() {
-		line := scanner.Text()
-		line = strings.TrimSpace(line)
-		i += 1
-
-		// Check if we reached the end of the header.
-		if line == "" {
-			break
-		}
+// RequestURI returns the parsed Request-URI of the start line.
+func (r *SIPRequest) RequestURI() *SIPURI {
+	return parseSIPURI(r.URI)
+}
 
-		// This should be the first line of the received request.
-		if i == 1 {
-			if err := r.parseSIPRequestStart(line); err != nil {
-				return fmt.Errorf("error parsing request start: %s", err)
-			}
-		} else {
-			if err := r.parseSIPHeader(line); err != nil {
-				return fmt.Errorf("error parsing request header: %s", err)
-			}
-		}
+func (r *SIPRequest) Clone() *SIPRequest {
+	c := &SIPRequest{
+		SIPMessage: SIPMessage{
+			SIPVersion: r.SIPVersion,
+		},
+		Method: r.Method,
+		URI:    r.URI,
 	}
-	// Check if we have a body and if not, return already
-	if len, _ := r.ContentLength(false); len == 0 {
-		if err := scanner.Err(); err != nil {
-			return fmt.Errorf("error parsing headers: %s", err)
-		}
-		return nil
+	for _, h := range r.Headers {
+		hdr := h.Clone()
+		c.Headers = append(c.Headers, &hdr)
 	}
+	if r.Body != nil {
+		c.Body = make([]byte, len(r.Body))
+		copy(c.Body, r.Body)
+	}
+	return c
+}
 
-	for scanner.Scan() {
-		r.Body = append(r.Body, scanner.Bytes()...)
+func (r *SIPRequest) Parse(data []byte) error {
+	start, err := r.parse(data)
+	if err != nil {
+		return err
 	}
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error parsing body: %s", err)
+	if err := r.parseSIPRequestStart(start); err != nil {
+		return fmt.Errorf("error parsing request start: %s", err)
 	}
 	return nil
 }
@@ -206,39 +349,23 @@ func (r *SIPRequest) Serialize(withBody bool) []byte {
 	buf := bytes.Buffer{}
 
 	// Status line
+	uri := r.URI
+	if uri == "" {
+		uri = r.To().URI.String()
+	}
 	buf.WriteString(r.Method)
 	buf.WriteString(" ")
-	buf.WriteString(r.To().URI.String())
+	buf.WriteString(uri)
 	buf.WriteString(" ")
 	buf.WriteString(r.SIPVersion)
 	buf.WriteString(SIPNewline)
 
-	// Headers
-	for _, hdr := range r.Headers {
-		buf.WriteString(hdr.serialize())
-		buf.WriteString(SIPNewline)
-	}
-	buf.WriteString("Content-Length: ")
-	buf.WriteString(strconv.Itoa(len(r.Body)))
-	buf.WriteString(SIPNewline)
-
-	if !withBody {
-		return buf.Bytes()
-	}
-
-	// Empty line
-	buf.WriteString(SIPNewline)
-
-	// Body
-	if r.Body != nil {
-		buf.Write(r.Body)
-	}
-
+	r.serialize(&buf, withBody)
 	return buf.Bytes()
 }
 
 func (r *SIPRequest) parseSIPRequestStart(line string) error {
-	parts := strings.Split(line, " ")
+	parts := strings.Fields(line)
 	if len(parts) != 3 {
 		return fmt.Errorf("SIP request start line should have 3 parts: %s", line)
 	}
@@ -250,15 +377,6 @@ func (r *SIPRequest) parseSIPRequestStart(line string) error {
 	return nil
 }
 
-func (r *SIPRequest) parseSIPHeader(line string) error {
-	hdr := &SIPHeader{}
-	if err := hdr.parse(line); err != nil {
-		return err
-	}
-	r.Headers = append(r.Headers, hdr)
-	return nil
-}
-
 func NewSIPResponseFromRequest(req *SIPRequest, statusCode int, statusMsg string) *SIPResponse {
 	resp := &SIPResponse{
 		SIPMessage: SIPMessage{
@@ -281,15 +399,11 @@ func NewSIPResponseFromRequest(req *SIPRequest, statusCode int, statusMsg string
 	return resp
 }
 
+// copyHeader copies all headers with the given name (e.g. several Via).
 func copyHeader(name string, req *SIPRequest, resp *SIPResponse) {
-	name = strings.ToLower(name)
-	for _, h := range req.Headers {
-		if name != strings.ToLower(h.Name) {
-			continue
-		}
+	for _, h := range req.FindHeaders(name) {
 		hdr := h.Clone()
 		resp.Headers = append(resp.Headers, &hdr)
-		break
 	}
 }
 
@@ -300,73 +414,36 @@ type SIPResponse struct {
 }
 
 func (r *SIPResponse) Parse(data []byte) error {
-	var i int
-	scanner := bufio.NewScanner(bytes.NewReader(data))
-	for scanner.Scan() {
-		line := scanner.Text()
-		line = strings.TrimSpace(line)
-		i += 1
-
-		// Check if we reached the end of the header.
-		if line == "" {
-			break
-		}
-
-		// This should be the first line of the received response.
-		if i == 1 {
-			if err := r.parseSIPResponseStatus(line); err != nil {
-				return fmt.Errorf("error parsing response status: %s", err)
-			}
-		} else {
-			if err := r.parseSIPHeader(line); err != nil {
-				return fmt.Errorf("error parsing request header: %s", err)
-			}
-		}
-	}
-	// Check if we have a body and if not, return already
-	if len, _ := r.ContentLength(false); len == 0 {
-		if err := scanner.Err(); err != nil {
-			return fmt.Errorf("error parsing headers: %s", err)
-		}
-		return nil
-	}
-
-	for scanner.Scan() {
-		r.Body = append(r.Body, scanner.Bytes()...)
+	start, err := r.parse(data)
+	if err != nil {
+		return err
 	}
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error parsing body: %s", err)
+	if err := r.parseSIPResponseStatus(start); err != nil {
+		return fmt.Errorf("error parsing response status: %s", err)
 	}
 	return nil
 }
 
 func (r *SIPResponse) parseSIPResponseStatus(line string) error {
-	parts := strings.Split(line, " ")
-	if len(parts) != 3 {
-		return fmt.Errorf("SIP request start line should have 3 parts: %s", line)
+	// The reason phrase may contain spaces itself (e.g. "Session Progress") or be empty.
+	version, rest, _ := strings.Cut(line, " ")
+	code, reason, _ := strings.Cut(strings.TrimLeft(rest, " "), " ")
+	if !strings.HasPrefix(strings.ToUpper(version), "SIP/") || code == "" {
+		return fmt.Errorf("SIP response status line should have a version and status code: %s", line)
 	}
 
-	sc, err := strconv.Atoi(parts[1])
-	if err != nil {
-		return fmt.Errorf("unable to convert response code: %s", err)
+	sc, err := strconv.Atoi(code)
+	if err != nil || sc < 100 || sc > 699 {
+		return fmt.Errorf("invalid response code: %s", code)
 	}
 
-	r.SIPVersion = strings.ToUpper(parts[0])
+	r.SIPVersion = strings.ToUpper(version)
 	r.StatusCode = sc
-	r.StatusMessage = parts[2]
+	r.StatusMessage = strings.TrimSpace(reason)
 
 	return nil
 }
 
-func (r *SIPResponse) parseSIPHeader(line string) error {
-	hdr := &SIPHeader{}
-	if err := hdr.parse(line); err != nil {
-		return err
-	}
-	r.Headers = append(r.Headers, hdr)
-	return nil
-}
-
 func (r *SIPResponse) Write(w io.Writer, dbg bool) (int, error) {
 	out := r.Serialize(true)
 	n, err := w.Write(out)
@@ -390,28 +467,149 @@ func (r *SIPResponse) Serialize(withBody bool) []byte {
 	buf.WriteString(r.StatusMessage)
 	buf.WriteString(SIPNewline)
 
-	// Headers
-	for _, hdr := range r.Headers {
+	r.serialize(&buf, withBody)
+	return buf.Bytes()
+}
+
+// parse reads the headers and body of a raw message and returns its start line.
+// Folded header lines are joined and the body is kept as is (e.g. binary content).
+// https://datatracker.ietf.org/doc/html/rfc3261#section-7
+func (m *SIPMessage) parse(data []byte) (string, error) {
+	// Line breaks in front of the start line are ignored.
+	// https://datatracker.ietf.org/doc/html/rfc3261#section-7.5
+	data = bytes.TrimLeft(data, SIPNewline)
+	head, body := splitHeadAndBody(data)
+
+	var start string
+	var lines []string
+	for i, line := range strings.Split(string(head), "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case i == 0:
+			start = strings.TrimSpace(line)
+		case line == "":
+		case line[0] == ' ' || line[0] == '\t':
+			// https://datatracker.ietf.org/doc/html/rfc3261#section-7.3.1
+			if len(lines) == 0 {
+				return "", errors.New("continuation line without header")
+			}
+			lines[len(lines)-1] += " " + strings.TrimSpace(line)
+		default:
+			lines = append(lines, line)
+		}
+	}
+	if start == "" {
+		return "", errors.New("empty message")
+	}
+	for _, line := range lines {
+		hdr := &SIPHeader{}
+		if err := hdr.parse(line); err != nil {
+			return "", fmt.Errorf("error parsing header: %s", err)
+		}
+		m.Headers = append(m.Headers, hdr)
+	}
+
+	// Without Content-Length (optional over UDP), the rest of the message is the body.
+	// https://datatracker.ietf.org/doc/html/rfc3261#section-18.3
+	l, err := m.ContentLength(false)
+	switch {
+	case err != nil:
+		l = len(body)
+	case l > len(body):
+		return "", fmt.Errorf("body shorter than Content-Length (%d < %d bytes)", len(body), l)
+	}
+	if l > 0 {
+		m.Body = append([]byte{}, body[:l]...)
+	}
+	return start, nil
+}
+
+// serialize writes the headers and (optionally) the body. Content-Length is
+// always set based on the body (added when missing).
+func (m *SIPMessage) serialize(buf *bytes.Buffer, withBody bool) {
+	length := false
+	for _, hdr := range m.Headers {
+		if headerKey(hdr.Name) == "content-length" {
+			if length {
+				continue
+			}
+			length = true
+			buf.WriteString(hdr.Name)
+			buf.WriteString(": ")
+			buf.WriteString(strconv.Itoa(len(m.Body)))
+			buf.WriteString(SIPNewline)
+			continue
+		}
 		buf.WriteString(hdr.serialize())
 		buf.WriteString(SIPNewline)
 	}
-	buf.WriteString("Content-Length: ")
-	buf.WriteString(strconv.Itoa(len(r.Body)))
-	buf.WriteString(SIPNewline)
+	if !length {
+		buf.WriteString("Content-Length: ")
+		buf.WriteString(strconv.Itoa(len(m.Body)))
+		buf.WriteString(SIPNewline)
+	}
 
 	if !withBody {
-		return buf.Bytes()
+		return
 	}
 
 	// Empty line
 	buf.WriteString(SIPNewline)
 
 	// Body
-	if r.Body != nil {
-		buf.Write(r.Body)
+	if m.Body != nil {
+		buf.Write(m.Body)
 	}
+}
 
-	return buf.Bytes()
+// splitHeadAndBody splits a raw message at the first empty line (lines may
+// end with CRLF or LF only). The returned body retains its original bytes.
+func splitHeadAndBody(data []byte) ([]byte, []byte) {
+	for i := 0; i < len(data); {
+		j := bytes.IndexByte(data[i:], '\n')
+		if j < 0 {
+			break
+		}
+		if line := data[i : i+j]; len(line) == 0 || (len(line) == 1 && line[0] == '\r') {
+			return data[:i], data[i+j+1:]
+		}
+		i += j + 1
+	}
+	return data, nil
+}
+
+// splitHeaderValues splits comma separated header values while respecting
+// quoted strings and URIs enclosed in "<" and ">".
+func splitHeaderValues(v string) []string {
+	var vals []string
+	var quoted, enclosed bool
+	var start int
+	for i, c := range v {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case '<':
+			if !quoted {
+				enclosed = true
+			}
+		case '>':
+			if !quoted {
+				enclosed = false
+			}
+		case ',':
+			if quoted || enclosed {
+				continue
+			}
+			if val := strings.TrimSpace(v[start:i]); val != "" {
+				vals = append(vals, val)
+			}
+			start = i + 1
+		}
+	}
+	if val := strings.TrimSpace(v[start:]); val != "" {
+		vals = append(vals, val)
+	}
+	return vals
 }
 
 type SIPHeader struct {
@@ -443,13 +641,21 @@ func (h *SIPHeader) parse(line string) error {
 
 	h.Name = strings.TrimSpace(line[:idx])
 	h.Value = strings.TrimSpace(line[idx+1:])
+	if h.Name == "" || strings.ContainsAny(h.Name, " \t") {
+		return fmt.Errorf("invalid header name: %q", h.Name)
+	}
 
-	switch strings.ToLower(h.Name) {
+	switch headerKey(h.Name) {
 	case "to", "from", "contact":
+		// Only the first of several contacts is parsed, see HeaderValues.
+		vals := splitHeaderValues(h.Value)
+		if len(vals) == 0 {
+			break
+		}
 		addr := &SIPAddress{
 			Params: make(map[string]string),
 		}
-		if err := addr.Parse(h.Value); err == nil {
+		if err := addr.Parse(vals[0]); err == nil {
 			h.Address = addr
 		}
 	}
@@ -461,6 +667,83 @@ func (h *SIPHeader) serialize() string {
 	return fmt.Sprintf("%s: %s", h.Name, h.Value)
 }
 
+// SIPVia represents a single Via value.
+// https://datatracker.ietf.org/doc/html/rfc3261#section-20.42
+type SIPVia struct {
+	Transport string // e.g. UDP or TCP
+	Host      string
+	Port      int // optional, can be empty
+	Params    map[string]string
+}
+
+func (v *SIPVia) Branch() string {
+	return v.Params["branch"]
+}
+
+// SetReceived records where a request was actually received from: the source IP
+// when it differs from the sent-by host (or rport is requested) and the source port
+// when rport is requested. Returns false if nothing had to be changed.
+// https://datatracker.ietf.org/doc/html/rfc3261#section-18.2.1
+// https://datatracker.ietf.org/doc/html/rfc3581#section-4
+func (v *SIPVia) SetReceived(ip string, port int) bool {
+	if v.Params == nil {
+		v.Params = make(map[string]string)
+	}
+	_, rport := v.Params["rport"]
+	if !rport && strings.Trim(v.Host, "[]") == ip {
+		return false
+	}
+	v.Params["received"] = ip
+	if rport {
+		v.Params["rport"] = strconv.Itoa(port)
+	}
+	return true
+}
+
+func (v *SIPVia) Parse(value string) error {
+	value = strings.TrimSpace(value)
+	sentBy := value
+	v.Params = make(map[string]string)
+	if idx := strings.Index(value, ";"); idx >= 0 {
+		sentBy = value[:idx]
+		v.Params = parseParameters(value[idx+1:])
+	}
+
+	parts := strings.Fields(sentBy)
+	if len(parts) != 2 {
+		return fmt.Errorf("Via should have a protocol and address: %s", value)
+	}
+	proto := strings.Split(parts[0], "/")
+	if len(proto) != 3 {
+		return fmt.Errorf("Via protocol should have 3 parts: %s", parts[0])
+	}
+	v.Transport = strings.ToUpper(proto[2])
+
+	host, port, err := net.SplitHostPort(parts[1])
+	if err != nil {
+		v.Host = strings.Trim(parts[1], "[]")
+		return nil
+	}
+	v.Host = host
+	v.Port, _ = strconv.Atoi(port)
+	return nil
+}
+
+func (v *SIPVia) String() string {
+	host := v.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if v.Port > 0 {
+		host = fmt.Sprintf("%s:%d", host, v.Port)
+	}
+	via := fmt.Sprintf("%s/%s %s", DefaultSIPVersion, v.Transport, host)
+	if len(v.Params) > 0 {
+		return via + ";" + paramsToString(v.Params)
+	}
+	return via
+}
+
 type SIPAddress struct {
 	DisplayName string
 	URI         *SIPURI
@@ -526,25 +809,12 @@ func parseSIPURI(l string) *SIPURI {
 	lp := strings.Split(l, ";")
 
 	uri := &SIPURI{}
-	parts := strings.Split(lp[0], "@")
-	if len(parts) > 1 {
-		user := strings.Split(parts[0], ":")
-		uri.User = user[0] // ignoring the possibility that there may be a password
-
-		host := strings.Split(parts[1], ":")
-		uri.Host = host[0]
-		if len(host) > 1 {
-			p, _ := strconv.Atoi(host[1])
-			uri.Port = p
-		}
-	} else {
-		host := strings.Split(parts[0], ":")
-		uri.Host = host[0]
-		if len(host) > 1 {
-			p, _ := strconv.Atoi(host[1])
-			uri.Port = p
-		}
+	hostport := lp[0]
+	if user, host, ok := strings.Cut(lp[0], "@"); ok {
+		uri.User, _, _ = strings.Cut(user, ":") // ignoring the possibility that there may be a password
+		hostport = host
 	}
+	uri.Host, uri.Port = splitHostPort(hostport)
 	if len(lp) > 1 {
 		uri.Params = parseParameters(lp[1])
 	}
@@ -552,6 +822,21 @@ func parseSIPURI(l string) *SIPURI {
 	return uri
 }
 
+// splitHostPort splits the host and optional port, also for IPv6 references (e.g. [fd00::1]:5060).
+func splitHostPort(hp string) (string, int) {
+	host, port := hp, ""
+	if strings.HasPrefix(hp, "[") {
+		if end := strings.Index(hp, "]"); end > 0 {
+			host = hp[:end+1]
+			port = strings.TrimPrefix(hp[end+1:], ":")
+		}
+	} else {
+		host, port, _ = strings.Cut(hp, ":")
+	}
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
 func findDisplayName(l string) (string, string) {
 	startQuote := -1
 	endQuote := -1
@@ -629,13 +914,16 @@ func parseParameters(l string) map[string]string {
 	}
 	if k != "" {
 		params[k] = l[start:]
+	} else if start < len(l) {
+		params[l[start:]] = ""
 	}
 	return params
 }
 
 func paramsToString(params map[string]string) string {
 	var p []string
-	for k, v := range params {
+	for _, k := range slices.Sorted(maps.Keys(params)) {
+		v := params[k]
 		// we should probably also encode this / check for character set
 		// for now we rely on users to set the right one
 		k = strings.TrimSpace(k)
@@ -681,15 +969,21 @@ func (u *SIPURI) String() string {
 	if u.User == "" {
 		user = fmt.Sprintf("sip:%s", host)
 	}
-	if len(u.Params) > 1 {
+	if len(u.Params) > 0 {
 		return user + ";" + paramsToString(u.Params)
 	}
 	return user
 }
 
+// SIPCredential holds what a client needs to authenticate as an extension.
+type SIPCredential struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
 type SIPClient struct {
-	Address *SIPAddress
-	UA      string
+	Address *SIPAddress `json:"address"`
+	UA      string      `json:"ua"`
 }
 
 func (c *SIPClient) Key() string {
@@ -700,8 +994,16 @@ func NewSIPClientFromRegister(req *SIPRequest) *SIPClient {
 	if req.Method != "REGISTER" {
 		return nil
 	}
-
 	addr := req.Contact()
+	if addr == nil {
+		return nil
+	}
+	return NewSIPClient(req, addr)
+}
+
+// NewSIPClient creates a client for one of the contacts of a REGISTER request.
+func NewSIPClient(req *SIPRequest, contact *SIPAddress) *SIPClient {
+	addr := contact.Clone()
 	addr.URI.Params = make(map[string]string)
 	addr.Params = make(map[string]string)
 	client := &SIPClient{
@@ -0,0 +1,322 @@
+package data
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// fixtures returns the SIP messages in testdata/sip keyed by file name.
+func fixtures(tb testing.TB) map[string][]byte {
+	tb.Helper()
+	paths, err := filepath.Glob(filepath.Join("testdata", "sip", "*.txt"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if len(paths) == 0 {
+		tb.Fatal("no SIP fixtures found")
+	}
+	msgs := make(map[string][]byte)
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		msgs[filepath.Base(p)] = b
+	}
+	return msgs
+}
+
+// roundTrip parses a message, serializes it and parses the result again. It
+// returns both parsed messages and the serialized one.
+func roundTrip(b []byte) (any, any, []byte, error) {
+	if bytes.HasPrefix(bytes.TrimLeft(b, SIPNewline), []byte("SIP/")) {
+		first := &SIPResponse{}
+		if err := first.Parse(b); err != nil {
+			return nil, nil, nil, err
+		}
+		out := first.Serialize(true)
+		second := &SIPResponse{}
+		return first, second, out, second.Parse(out)
+	}
+	first := &SIPRequest{}
+	if err := first.Parse(b); err != nil {
+		return nil, nil, nil, err
+	}
+	out := first.Serialize(true)
+	second := &SIPRequest{}
+	return first, second, out, second.Parse(out)
+}
+
+func TestParseFixtures(t *testing.T) {
+	for name, b := range fixtures(t) {
+		t.Run(name, func(t *testing.T) {
+			first, second, _, err := roundTrip(b)
+			if err != nil {
+				t.Fatalf("round trip failed: %s", err)
+			}
+			// Content-Length is added when missing, everything else stays the same.
+			ignoreLength := cmpopts.IgnoreSliceElements(func(h *SIPHeader) bool {
+				return headerKey(h.Name) == "content-length"
+			})
+			if diff := cmp.Diff(first, second, ignoreLength); diff != "" {
+				t.Errorf("message changed in round trip (-first +second):\n%s", diff)
+			}
+
+			var msg *SIPMessage
+			switch m := first.(type) {
+			case *SIPRequest:
+				if m.RequestURI() == nil {
+					t.Errorf("invalid Request-URI: %q", m.URI)
+				}
+				msg = &m.SIPMessage
+			case *SIPResponse:
+				msg = &m.SIPMessage
+			}
+			if msg.TopVia() == nil {
+				t.Error("no Via found")
+			}
+			if msg.From() == nil || msg.To() == nil {
+				t.Error("no From/To found")
+			}
+			if seq, method := msg.CSeq(); seq == 0 || method == "" {
+				t.Error("no CSeq found")
+			}
+		})
+	}
+}
+
+// parseRequest parses a request written with LF line endings as CRLF.
+func parseRequest(t *testing.T, msg string) *SIPRequest {
+	t.Helper()
+	req := &SIPRequest{}
+	if err := req.Parse([]byte(strings.ReplaceAll(msg, "\n", SIPNewline))); err != nil {
+		t.Fatalf("Parse() failed: %s", err)
+	}
+	return req
+}
+
+func TestParseCompactHeaders(t *testing.T) {
+	req := parseRequest(t, `REGISTER sip:localnode.local.mesh SIP/2.0
+v: SIP/2.0/UDP 10.33.7.2:5060;branch=z9hG4bK.2S7tQ;rport
+f: "HB9XYZ" <sip:800034@localnode.local.mesh>;tag=Bc8CA
+t: sip:800034@localnode.local.mesh
+i: 9rWK7u0x5v
+m: <sip:800034@10.33.7.2;transport=udp>;expires=600
+o: dialog
+k: replaces
+c: text/plain
+l: 0
+CSeq: 20 REGISTER
+
+`)
+
+	for _, tc := range []struct {
+		header string
+		want   []string
+	}{
+		{"Via", []string{"SIP/2.0/UDP 10.33.7.2:5060;branch=z9hG4bK.2S7tQ;rport"}},
+		{"From", []string{`"HB9XYZ" <sip:800034@localnode.local.mesh>;tag=Bc8CA`}},
+		{"to", []string{"sip:800034@localnode.local.mesh"}},
+		{"Call-ID", []string{"9rWK7u0x5v"}},
+		{"Contact", []string{"<sip:800034@10.33.7.2;transport=udp>;expires=600"}},
+		{"Event", []string{"dialog"}},
+		{"Supported", []string{"replaces"}},
+		{"Content-Type", []string{"text/plain"}},
+		{"Content-Length", []string{"0"}},
+		{"v", []string{"SIP/2.0/UDP 10.33.7.2:5060;branch=z9hG4bK.2S7tQ;rport"}},
+	} {
+		if diff := cmp.Diff(tc.want, req.HeaderValues(tc.header)); diff != "" {
+			t.Errorf("HeaderValues(%q) mismatch (-want +got):\n%s", tc.header, diff)
+		}
+	}
+
+	if from := req.From(); from == nil || from.DisplayName != "HB9XYZ" || from.URI.User != "800034" || from.Params["tag"] != "Bc8CA" {
+		t.Errorf("From() = %+v, want HB9XYZ <800034> with tag Bc8CA", from)
+	}
+	if to := req.To(); to == nil || to.URI.User != "800034" || to.URI.Host != "localnode.local.mesh" {
+		t.Errorf("To() = %+v, want 800034@localnode.local.mesh", to)
+	}
+	if contact := req.Contact(); contact == nil || contact.URI.Host != "10.33.7.2" || contact.URI.Params["transport"] != "udp" {
+		t.Errorf("Contact() = %+v, want 10.33.7.2 via udp", contact)
+	}
+	if via := req.TopVia(); via == nil || via.Host != "10.33.7.2" || via.Port != 5060 || via.Branch() != "z9hG4bK.2S7tQ" {
+		t.Errorf("TopVia() = %+v, want 10.33.7.2:5060 with branch z9hG4bK.2S7tQ", via)
+	}
+}
+
+func TestParseHeaderValues(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		headers string
+		header  string
+		want    []string
+	}{
+		{
+			name:    "comma separated",
+			headers: "Via: SIP/2.0/UDP 10.54.21.1;branch=z9hG4bK1, SIP/2.0/UDP 10.81.3.17:5062;branch=z9hG4bK2\n",
+			header:  "Via",
+			want:    []string{"SIP/2.0/UDP 10.54.21.1;branch=z9hG4bK1", "SIP/2.0/UDP 10.81.3.17:5062;branch=z9hG4bK2"},
+		},
+		{
+			name:    "comma separated without spaces",
+			headers: "Allow-Events: talk,hold,conference\n",
+			header:  "Allow-Events",
+			want:    []string{"talk", "hold", "conference"},
+		},
+		{
+			name:    "several headers in order",
+			headers: "Via: SIP/2.0/UDP a;branch=z9hG4bK1, SIP/2.0/UDP b;branch=z9hG4bK2\nVia: SIP/2.0/UDP c;branch=z9hG4bK3\n",
+			header:  "Via",
+			want:    []string{"SIP/2.0/UDP a;branch=z9hG4bK1", "SIP/2.0/UDP b;branch=z9hG4bK2", "SIP/2.0/UDP c;branch=z9hG4bK3"},
+		},
+		{
+			name:    "commas in quotes and URIs",
+			headers: "Contact: \"Doe, John\" <sip:100@10.0.0.1;x=a,b>, <sip:100@10.0.0.2>\n",
+			header:  "Contact",
+			want:    []string{`"Doe, John" <sip:100@10.0.0.1;x=a,b>`, "<sip:100@10.0.0.2>"},
+		},
+		{
+			name:    "empty values",
+			headers: "Supported: replaces,, path,\n",
+			header:  "Supported",
+			want:    []string{"replaces", "path"},
+		},
+		{
+			name:    "folded with tabs",
+			headers: "Supported: outbound,\n\treplaces,\n\tfrom-change\n",
+			header:  "Supported",
+			want:    []string{"outbound", "replaces", "from-change"},
+		},
+		{
+			name:    "folded with spaces",
+			headers: "Subject: Lunch\n   is ready\nCSeq: 1 OPTIONS\n",
+			header:  "Subject",
+			want:    []string{"Lunch is ready"},
+		},
+		{
+			name:    "folded compact header",
+			headers: "v: SIP/2.0/UDP a;branch=z9hG4bK1,\n SIP/2.0/UDP b;branch=z9hG4bK2\n",
+			header:  "Via",
+			want:    []string{"SIP/2.0/UDP a;branch=z9hG4bK1", "SIP/2.0/UDP b;branch=z9hG4bK2"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := parseRequest(t, "OPTIONS sip:localnode.local.mesh SIP/2.0\n"+tc.headers+"\n")
+			if diff := cmp.Diff(tc.want, req.HeaderValues(tc.header)); diff != "" {
+				t.Errorf("HeaderValues(%q) mismatch (-want +got):\n%s", tc.header, diff)
+			}
+		})
+	}
+}
+
+func TestParseBody(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		msg     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "content length",
+			msg:  "MESSAGE sip:100@local.mesh SIP/2.0\r\nContent-Length: 5\r\n\r\nHello",
+			want: "Hello",
+		},
+		{
+			name: "content length shorter than body",
+			msg:  "MESSAGE sip:100@local.mesh SIP/2.0\r\nContent-Length: 5\r\n\r\nHello\r\nOPTIONS sip:100@local.mesh SIP/2.0\r\n",
+			want: "Hello",
+		},
+		{
+			name: "padded content length",
+			msg:  "MESSAGE sip:100@local.mesh SIP/2.0\r\nContent-Length:   5  \r\n\r\nHello",
+			want: "Hello",
+		},
+		{
+			name: "compact content length",
+			msg:  "MESSAGE sip:100@local.mesh SIP/2.0\r\nl: 2\r\n\r\nHello",
+			want: "He",
+		},
+		{
+			name: "zero content length",
+			msg:  "MESSAGE sip:100@local.mesh SIP/2.0\r\nContent-Length: 0\r\n\r\nHello",
+			want: "",
+		},
+		{
+			name: "no content length",
+			msg:  "MESSAGE sip:100@local.mesh SIP/2.0\r\nCSeq: 1 MESSAGE\r\n\r\nHello\r\n",
+			want: "Hello\r\n",
+		},
+		{
+			name: "empty lines in body",
+			msg:  "MESSAGE sip:100@local.mesh SIP/2.0\r\nContent-Length: 14\r\n\r\nHello\r\n\r\nWorld",
+			want: "Hello\r\n\r\nWorld",
+		},
+		{
+			name: "LF line endings",
+			msg:  "MESSAGE sip:100@local.mesh SIP/2.0\nContent-Length: 7\n\nHello\n\n",
+			want: "Hello\n\n",
+		},
+		{
+			name: "leading line breaks",
+			msg:  "\r\n\r\nMESSAGE sip:100@local.mesh SIP/2.0\r\nContent-Length: 5\r\n\r\nHello",
+			want: "Hello",
+		},
+		{
+			name:    "body shorter than content length",
+			msg:     "MESSAGE sip:100@local.mesh SIP/2.0\r\nContent-Length: 10\r\n\r\nHello",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &SIPRequest{}
+			err := req.Parse([]byte(tc.msg))
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("Parse() error = %v, want error: %t", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if got := string(req.Body); got != tc.want {
+				t.Errorf("Body = %q, want %q", got, tc.want)
+			}
+			if req.Method != "MESSAGE" || req.URI != "sip:100@local.mesh" {
+				t.Errorf("start line = %q %q, want MESSAGE sip:100@local.mesh", req.Method, req.URI)
+			}
+		})
+	}
+}
+
+func FuzzParseSIP(f *testing.F) {
+	for _, b := range fixtures(f) {
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		first, second, out, err := roundTrip(b)
+		if first == nil {
+			return // not a valid message
+		}
+		if err != nil {
+			t.Fatalf("serialized message can't be parsed: %s\n%q", err, out)
+		}
+		// Serializing is stable once a message went through the parser.
+		var again []byte
+		switch m := second.(type) {
+		case *SIPRequest:
+			again = m.Serialize(true)
+			m.TopVia()
+			m.RequestURI()
+		case *SIPResponse:
+			again = m.Serialize(true)
+			m.TopVia()
+		}
+		if !bytes.Equal(out, again) {
+			t.Errorf("serialization not stable:\n%q\n%q", out, again)
+		}
+	})
+}
@@ -0,0 +1,35 @@
+package data
+
+import (
+	"sync"
+	"time"
+)
+
+// SIPStats counts SIP messages dropped by the flood protection of the SIP server.
+type SIPStats struct {
+	Mu *sync.RWMutex `json:"-"`
+
+	Denied      uint64 `json:"denied"`       // source not allowed (see sip_allow/sip_deny)
+	RateLimited uint64 `json:"rate_limited"` // source exceeded the rate limit
+	Banned      uint64 `json:"banned"`       // source temporarily banned for flooding
+	Overloaded  uint64 `json:"overloaded"`   // all workers busy and queue full
+
+	// Currently banned sources (IPs) along with when the ban ends.
+	Bans map[string]time.Time `json:"bans,omitempty"`
+}
+
+// Snapshot returns a copy which can be used without holding the lock.
+func (s *SIPStats) Snapshot() *SIPStats {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+	c := *s
+	c.Mu = nil
+	c.Bans = make(map[string]time.Time)
+	now := time.Now()
+	for ip, until := range s.Bans {
+		if until.After(now) {
+			c.Bans[ip] = until
+		}
+	}
+	return &c
+}
@@ -10,6 +10,8 @@ type RuntimeInfo struct {
 	Updated time.Time
 
 	SysInfo *SysInfo
+	// Link metrics of the routes on the mesh (optional).
+	RouteMetrics []*RouteMetric
 }
 
 type SysInfo struct {
@@ -22,6 +24,12 @@ type SysInfo struct {
 	Gridsquare string `json:"grid_square"`
 
 	Hosts []*Host `json:"hosts"`
+
+	// Services advertised on the mesh (only with services=1).
+	Services []*Service `json:"services"`
+
+	// Links to the direct neighbors keyed by their IP (only with link_info=1).
+	LinkInfo map[string]*LinkInfo `json:"link_info"`
 }
 
 type System struct {
@@ -33,6 +41,29 @@ type Host struct {
 	IP   string `json:"ip"`
 }
 
+type Service struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Link     string `json:"link"`
+}
+
+type LinkInfo struct {
+	Hostname string `json:"hostname"`
+	LinkType string `json:"linkType"` // e.g. RF, DTD or TUN
+
+	// Share of packets received by us and by the neighbor (0-1, zero when unknown).
+	LinkQuality         float64 `json:"linkQuality"`
+	NeighborLinkQuality float64 `json:"neighborLinkQuality"`
+}
+
+// ETX returns the expected transmission count of the link (zero when unknown).
+func (l *LinkInfo) ETX() float64 {
+	if l.LinkQuality <= 0 || l.NeighborLinkQuality <= 0 {
+		return 0
+	}
+	return 1 / (l.LinkQuality * l.NeighborLinkQuality)
+}
+
 type NodeDetails struct {
 	Model           string `json:"model"`
 	BoardID         string `json:"board_id"`
@@ -12,8 +12,10 @@ type WebDefault struct {
 type WebInfo struct {
 	WebDefault
 	Registered  map[string]string `json:"registered_phones,omitempty"`
+	Federated   map[string]string `json:"federated_phones,omitempty"` // phone number -> home node
 	RecordStats RecordStats       `json:"records_stats,omitempty"`
 	Runtime     Runtime           `json:"runtime,omitempty"`
+	SIP         *SIPStats         `json:"sip_dropped,omitempty"`
 }
 
 type Runtime struct {
@@ -42,6 +44,7 @@ type WebMessage struct {
 	WebDefault
 
 	Success bool
+	Queued  bool // not delivered yet but retried later
 	From    string
 	To      string
 	Message string
@@ -69,3 +72,31 @@ type WebUpdateConfig struct {
 	Messages []string
 	Success  bool
 }
+
+type WebMessages struct {
+	WebDefault
+
+	Pending []*Message
+	History []*Message
+}
+
+type WebForwarding struct {
+	WebDefault
+
+	Success    bool
+	Message    string
+	Rules      []*ForwardingRule
+	Conditions []string
+}
+
+type WebCDR struct {
+	WebDefault
+
+	Message   string
+	Records   []*CDR
+	Total     int // matching records (more than shown when truncated)
+	Filter    CDRFilter
+	Since     string
+	Until     string
+	Truncated bool
+}
@@ -15,10 +15,15 @@ const (
 )
 
 func NameForEntry(entry *data.Entry, indicateActive bool, activePfx string) string {
-	var pfx string
-	if indicateActive && entry.Route != nil {
-		pfx = activePfx
+	pfx, label := entry.ActiveMarkers(indicateActive, activePfx)
+	name := nameForEntry(entry, pfx)
+	if name != "" {
+		name += label
 	}
+	return name
+}
+
+func nameForEntry(entry *data.Entry, pfx string) string {
 	switch {
 	case entry.LastName == "" && entry.FirstName == "" && entry.Callsign == "" && entry.PhoneNumber == "":
 		return ""
@@ -69,7 +74,7 @@ type Exporter interface {
 func export(entries []*data.Entry, format Format, activePfx string, resolve, indicateActive, filterInactive, debug bool) *data.GenericPhoneBook {
 	var targetEntries []*data.GenericEntry
 	for _, entry := range entries {
-		if filterInactive && entry.Route == nil {
+		if filterInactive && !entry.IsActive() {
 			if debug {
 				fmt.Printf("Export/Generic: Filtering inactive entry: %+v\n", entry)
 			}
@@ -33,17 +33,14 @@ type Grandstream struct{}
 func (g *Grandstream) Export(entries []*data.Entry, format Format, activePfx string, resolve, indicateActive, filterInactive, debug bool) ([]byte, error) {
 	var targetEntries []*GrandstreamEntry
 	for _, entry := range entries {
-		if filterInactive && entry.Route == nil {
+		if filterInactive && !entry.IsActive() {
 			if debug {
 				fmt.Printf("Export/Grandstream: Filtering inactive entry %+v\n", entry)
 			}
 			continue // ignoring inactive entry (no OLSR data)
 		}
 
-		var pfx string
-		if indicateActive && entry.Route != nil {
-			pfx = activePfx
-		}
+		pfx, label := entry.ActiveMarkers(indicateActive, activePfx)
 		var firstname, lastname string
 		switch {
 		case entry.LastName == "" && entry.FirstName == "" && entry.Callsign == "":
@@ -62,6 +59,7 @@ func (g *Grandstream) Export(entries []*data.Entry, format Format, activePfx str
 			firstname = fmt.Sprintf("%s%s (%s)", pfx, entry.FirstName, entry.Callsign)
 			lastname = entry.LastName
 		}
+		firstname += label
 
 		var tel []*GrandstreamPhone
 		switch format {
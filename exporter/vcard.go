@@ -18,7 +18,7 @@ func (v *VCard) Export(entries []*data.Entry, format Format, activePfx string, r
 	enc := vcard.NewEncoder(out)
 
 	for _, entry := range entries {
-		if filterInactive && entry.Route == nil {
+		if filterInactive && !entry.IsActive() {
 			if debug {
 				fmt.Printf("Export/vCard: Filtering inactive entry %+v\n", entry)
 			}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/arednch/phonebook/data"
@@ -20,6 +21,11 @@ const (
 	headerCallsign    = "callsign"
 	headerPhoneNumber = "telephone"
 	headerPrivate     = "privat"
+
+	headerGroupNumber   = "number"
+	headerGroupName     = "name"
+	headerGroupMember   = "member"
+	headerGroupPriority = "priority"
 )
 
 func ReadFromURL(url string, cache string, client *http.Client) ([]byte, error) {
@@ -141,6 +147,20 @@ func ReadSysInfoFromURL(url string, client *http.Client) (*data.SysInfo, error)
 	return &sysinfo, nil
 }
 
+func ReadRouteMetricsFromURL(url string, client *http.Client) ([]*data.RouteMetric, error) {
+	b, err := ReadFromURL(url, "", client)
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics data.RouteMetrics
+	if err := json.Unmarshal(b, &metrics); err != nil {
+		return nil, err
+	}
+
+	return metrics.Routes, nil
+}
+
 func ReadUpdatesFromURL(urls []string, client *http.Client) ([]*data.Update, error) {
 	for _, url := range urls {
 		b, err := ReadFromURL(url, "", client)
@@ -161,3 +181,92 @@ func ReadUpdatesFromURL(urls []string, client *http.Client) ([]*data.Update, err
 	}
 	return nil, errors.New("no URLs or none returned any updates")
 }
+
+// ReadSIPCredentials reads a JSON list of SIP credentials and indexes them by extension.
+func ReadSIPCredentials(path string) (map[string]*data.SIPCredential, error) {
+	b, err := ReadFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds []*data.SIPCredential
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return nil, err
+	}
+
+	credentials := make(map[string]*data.SIPCredential)
+	for _, c := range creds {
+		c.User = strings.TrimSpace(c.User)
+		if c.User == "" || c.Password == "" {
+			return nil, fmt.Errorf("SIP credentials need a user and password: %q", c.User)
+		}
+		credentials[c.User] = c
+	}
+	return credentials, nil
+}
+
+// ReadHuntGroups reads hunt groups from a CSV file with one line per member.
+// The name and priority columns are optional.
+func ReadHuntGroups(path string) ([]*data.HuntGroup, error) {
+	b, err := ReadFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(bytes.NewBuffer(b))
+	hdrs, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	headers := make(map[string]int)
+	for i, v := range hdrs {
+		headers[strings.ToLower(strings.TrimSpace(v))] = i
+	}
+	numberIdx, ok := headers[headerGroupNumber]
+	if !ok {
+		return nil, fmt.Errorf("unable to locate group number column in CSV: %s", headerGroupNumber)
+	}
+	memberIdx, ok := headers[headerGroupMember]
+	if !ok {
+		return nil, fmt.Errorf("unable to locate member column in CSV: %s", headerGroupMember)
+	}
+	nameIdx, nameIdxAvailable := headers[headerGroupName]
+	prioIdx, prioIdxAvailable := headers[headerGroupPriority]
+
+	var groups []*data.HuntGroup
+	byNumber := make(map[string]*data.HuntGroup)
+	for {
+		r, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		number := strings.TrimSpace(r[numberIdx])
+		member := &data.HuntGroupMember{
+			Number: strings.TrimSpace(r[memberIdx]),
+		}
+		if number == "" || member.Number == "" {
+			continue
+		}
+		if prioIdxAvailable && strings.TrimSpace(r[prioIdx]) != "" {
+			if member.Priority, err = strconv.ParseFloat(strings.TrimSpace(r[prioIdx]), 64); err != nil {
+				return nil, fmt.Errorf("invalid priority for member %s of group %s: %s", member.Number, number, err)
+			}
+		}
+
+		g, ok := byNumber[number]
+		if !ok {
+			g = &data.HuntGroup{Number: number}
+			byNumber[number] = g
+			groups = append(groups, g)
+		}
+		if nameIdxAvailable && g.Name == "" {
+			g.Name = strings.TrimSpace(r[nameIdx])
+		}
+		g.Members = append(g.Members, member)
+	}
+	return groups, nil
+}
@@ -0,0 +1,253 @@
+package ldap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// Upper bound of LDAP messages read from clients.
+	maxMessageSize = 1 << 20
+
+	// BER tags used in LDAP messages.
+	// https://datatracker.ietf.org/doc/html/rfc4511#section-4
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+
+	tagSearchRequest    = 0x63 // [APPLICATION 3]
+	tagSearchResultDone = 0x65 // [APPLICATION 5]
+	tagExtendedRequest  = 0x77 // [APPLICATION 23]
+	tagExtendedResponse = 0x78 // [APPLICATION 24]
+	tagExtendedName     = 0x80 // requestName [0]
+	tagExtendedRespName = 0x8a // responseName [10]
+
+	// Search filter choices.
+	// https://datatracker.ietf.org/doc/html/rfc4511#section-4.5.1.7
+	tagFilterAnd        = 0xa0
+	tagFilterOr         = 0xa1
+	tagFilterNot        = 0xa2
+	tagFilterEqual      = 0xa3
+	tagFilterSubstrings = 0xa4
+	tagFilterGreater    = 0xa5
+	tagFilterLess       = 0xa6
+	tagFilterPresent    = 0x87
+	tagFilterApprox     = 0xa8
+	tagFilterExtensible = 0xa9
+
+	tagSubstringInitial = 0x80
+	tagSubstringAny     = 0x81
+	tagSubstringFinal   = 0x82
+)
+
+// tlv is a BER encoded element: its tag, content and the full encoding.
+type tlv struct {
+	tag     byte
+	content []byte
+	raw     []byte
+}
+
+// readTLV reads a single BER element (e.g. a full LDAP message) from r.
+// Only single byte tags are supported, which is all LDAP uses.
+func readTLV(r io.Reader) (*tlv, error) {
+	hdr := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	n := int(hdr[1])
+	if hdr[1]&0x80 != 0 {
+		size := int(hdr[1] & 0x7f)
+		if size == 0 || size > 4 {
+			return nil, fmt.Errorf("unsupported length encoding: %x", hdr[1])
+		}
+		hdr = hdr[:2+size]
+		if _, err := io.ReadFull(r, hdr[2:]); err != nil {
+			return nil, err
+		}
+		n = 0
+		for _, b := range hdr[2:] {
+			n = n<<8 | int(b)
+		}
+	}
+	if n > maxMessageSize {
+		return nil, fmt.Errorf("message too large: %d bytes", n)
+	}
+	raw := make([]byte, len(hdr)+n)
+	copy(raw, hdr)
+	if _, err := io.ReadFull(r, raw[len(hdr):]); err != nil {
+		return nil, err
+	}
+	return &tlv{tag: hdr[0], content: raw[len(hdr):], raw: raw}, nil
+}
+
+// parseTLVs splits the content of a constructed element into its elements.
+func parseTLVs(b []byte) ([]*tlv, error) {
+	var elems []*tlv
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, errors.New("truncated element")
+		}
+		hdrLen, n := 2, int(b[1])
+		if b[1]&0x80 != 0 {
+			size := int(b[1] & 0x7f)
+			if size == 0 || size > 4 || len(b) < 2+size {
+				return nil, errors.New("invalid length")
+			}
+			hdrLen, n = 2+size, 0
+			for _, c := range b[2 : 2+size] {
+				n = n<<8 | int(c)
+			}
+		}
+		if n < 0 || len(b) < hdrLen+n {
+			return nil, errors.New("truncated element")
+		}
+		elems = append(elems, &tlv{tag: b[0], content: b[hdrLen : hdrLen+n], raw: b[:hdrLen+n]})
+		b = b[hdrLen+n:]
+	}
+	return elems, nil
+}
+
+// encodeTLV encodes an element with the given tag and content.
+func encodeTLV(tag byte, content ...[]byte) []byte {
+	var n int
+	for _, c := range content {
+		n += len(c)
+	}
+	out := []byte{tag}
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n <= 0xff:
+		out = append(out, 0x81, byte(n))
+	case n <= 0xffff:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	for _, c := range content {
+		out = append(out, c...)
+	}
+	return out
+}
+
+// decodeFilter builds a filter from its BER encoding and returns it along
+// with its string representation.
+// https://datatracker.ietf.org/doc/html/rfc4511#section-4.5.1.7
+func decodeFilter(t *tlv) (filter, string, error) {
+	switch t.tag {
+	case tagFilterAnd, tagFilterOr:
+		children, err := parseTLVs(t.content)
+		if err != nil {
+			return nil, "", err
+		}
+		var fs []filter
+		op := "&"
+		if t.tag == tagFilterOr {
+			op = "|"
+		}
+		str := "(" + op
+		for _, c := range children {
+			f, s, err := decodeFilter(c)
+			if err != nil {
+				return nil, "", err
+			}
+			fs = append(fs, f)
+			str += s
+		}
+		if t.tag == tagFilterOr {
+			return orFilter(fs), str + ")", nil
+		}
+		return andFilter(fs), str + ")", nil
+	case tagFilterNot:
+		children, err := parseTLVs(t.content)
+		if err != nil || len(children) != 1 {
+			return nil, "", errors.New("invalid not filter")
+		}
+		f, s, err := decodeFilter(children[0])
+		if err != nil {
+			return nil, "", err
+		}
+		return &notFilter{f}, "(!" + s + ")", nil
+	case tagFilterEqual, tagFilterGreater, tagFilterLess, tagFilterApprox:
+		children, err := parseTLVs(t.content)
+		if err != nil || len(children) != 2 {
+			return nil, "", errors.New("invalid attribute value assertion")
+		}
+		attr, value := filterAttribute(children[0].content), string(children[1].content)
+		ops := map[byte]int{
+			tagFilterEqual:   matchEqual,
+			tagFilterGreater: matchGreaterOrEqual,
+			tagFilterLess:    matchLessOrEqual,
+			tagFilterApprox:  matchApprox,
+		}
+		strs := map[byte]string{
+			tagFilterEqual:   "=",
+			tagFilterGreater: ">=",
+			tagFilterLess:    "<=",
+			tagFilterApprox:  "~=",
+		}
+		str := "(" + string(children[0].content) + strs[t.tag] + escapeValue(value) + ")"
+		return &compareFilter{attr: attr, op: ops[t.tag], value: value}, str, nil
+	case tagFilterSubstrings:
+		children, err := parseTLVs(t.content)
+		if err != nil || len(children) != 2 {
+			return nil, "", errors.New("invalid substring filter")
+		}
+		parts, err := parseTLVs(children[1].content)
+		if err != nil || len(parts) == 0 {
+			return nil, "", errors.New("invalid substring filter")
+		}
+		f := &substringFilter{attr: filterAttribute(children[0].content)}
+		initial, final := "", ""
+		var anys []string
+		for i, p := range parts {
+			v := string(p.content)
+			switch {
+			case p.tag == tagSubstringInitial && i == 0:
+				f.initial, initial = v, escapeValue(v)
+			case p.tag == tagSubstringAny:
+				f.any = append(f.any, v)
+				anys = append(anys, escapeValue(v))
+			case p.tag == tagSubstringFinal && i == len(parts)-1:
+				f.final, final = v, escapeValue(v)
+			default:
+				return nil, "", errors.New("invalid substring filter")
+			}
+		}
+		str := "(" + string(children[0].content) + "=" + initial + "*"
+		for _, a := range anys {
+			str += a + "*"
+		}
+		return f, str + final + ")", nil
+	case tagFilterPresent:
+		return &presentFilter{filterAttribute(t.content)}, "(" + string(t.content) + "=*)", nil
+	case tagFilterExtensible:
+		return &undefinedFilter{}, "(extensibleMatch)", nil
+	default:
+		return nil, "", fmt.Errorf("unknown filter type: %x", t.tag)
+	}
+}
+
+// filterAttribute normalizes an attribute description (options are ignored).
+func filterAttribute(b []byte) string {
+	attr, _, _ := strings.Cut(string(b), ";")
+	return strings.ToLower(strings.TrimSpace(attr))
+}
+
+// escapeValue escapes a value for the string representation of a filter.
+// https://datatracker.ietf.org/doc/html/rfc4515#section-3
+func escapeValue(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
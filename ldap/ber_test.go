@@ -0,0 +1,158 @@
+package ldap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// decodeHex decodes BER written as hex with spaces between elements.
+func decodeHex(tb testing.TB, s string) []byte {
+	tb.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+func TestDecodeFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		ber     string
+		want    filter
+		wantStr string
+		wantErr bool
+	}{
+		{
+			name:    "equal",
+			ber:     "a309 0402636e 0403446f65",
+			want:    &compareFilter{attr: "cn", op: matchEqual, value: "Doe"},
+			wantStr: "(cn=Doe)",
+		},
+		{
+			name:    "attribute case and options",
+			ber:     "a30b 0404434e3b78 0403446f65",
+			want:    &compareFilter{attr: "cn", op: matchEqual, value: "Doe"},
+			wantStr: "(CN;x=Doe)",
+		},
+		{
+			name:    "greater or equal with escaped value",
+			ber:     "a508 0402636e 0402612a",
+			want:    &compareFilter{attr: "cn", op: matchGreaterOrEqual, value: "a*"},
+			wantStr: `(cn>=a\2a)`,
+		},
+		{
+			name:    "less or equal",
+			ber:     "a608 0402636e 04023130",
+			want:    &compareFilter{attr: "cn", op: matchLessOrEqual, value: "10"},
+			wantStr: "(cn<=10)",
+		},
+		{
+			name:    "approx",
+			ber:     "a809 0402636e 0403446f65",
+			want:    &compareFilter{attr: "cn", op: matchApprox, value: "Doe"},
+			wantStr: "(cn~=Doe)",
+		},
+		{
+			name:    "present",
+			ber:     "870b 6f626a656374436c617373",
+			want:    &presentFilter{"objectclass"},
+			wantStr: "(objectClass=*)",
+		},
+		{
+			name:    "substrings",
+			ber:     "a40f 0402636e 3009 80014a 81016f 82016e",
+			want:    &substringFilter{attr: "cn", initial: "J", any: []string{"o"}, final: "n"},
+			wantStr: "(cn=J*o*n)",
+		},
+		{
+			name:    "substring final only",
+			ber:     "a40b 0402636e 3005 8203446f65",
+			want:    &substringFilter{attr: "cn", final: "Doe"},
+			wantStr: "(cn=*Doe)",
+		},
+		{
+			name: "and",
+			ber:  "a018 a3090402636e0403446f65 870b6f626a656374436c617373",
+			want: andFilter{
+				&compareFilter{attr: "cn", op: matchEqual, value: "Doe"},
+				&presentFilter{"objectclass"},
+			},
+			wantStr: "(&(cn=Doe)(objectClass=*))",
+		},
+		{
+			name:    "not",
+			ber:     "a20b a3090402636e0403446f65",
+			want:    &notFilter{&compareFilter{attr: "cn", op: matchEqual, value: "Doe"}},
+			wantStr: "(!(cn=Doe))",
+		},
+		{
+			name:    "empty or",
+			ber:     "a100",
+			want:    orFilter(nil),
+			wantStr: "(|)",
+		},
+		{
+			name:    "extensible",
+			ber:     "a905 8203446f65",
+			want:    &undefinedFilter{},
+			wantStr: "(extensibleMatch)",
+		},
+		{name: "unknown type", ber: "8f00", wantErr: true},
+		{name: "not with two filters", ber: "a216 a3090402636e0403446f65 a3090402636e0403446f65", wantErr: true},
+		{name: "equal without value", ber: "a304 0402636e", wantErr: true},
+		{name: "substring initial not first", ber: "a40c 0402636e 3006 82016e 80014a", wantErr: true},
+		{name: "truncated value", ber: "a309 0402636e 0405446f65", wantErr: true},
+		{name: "truncated filter in and", ber: "a00b a30a0402636e0403446f65", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			elems, err := parseTLVs(decodeHex(t, tc.ber))
+			if err != nil || len(elems) != 1 {
+				t.Fatalf("parseTLVs() = %d elements, %v", len(elems), err)
+			}
+			got, gotStr, err := decodeFilter(elems[0])
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("decodeFilter() error = %v, wantErr %t", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got, allowFilters); diff != "" {
+				t.Errorf("decodeFilter() mismatch (-want +got):\n%s", diff)
+			}
+			if gotStr != tc.wantStr {
+				t.Errorf("decodeFilter() string = %q, want %q", gotStr, tc.wantStr)
+			}
+		})
+	}
+}
+
+func TestReadTLV(t *testing.T) {
+	long := bytes.Repeat([]byte("x"), 200)
+	for _, tc := range []struct {
+		name        string
+		ber         []byte
+		wantContent []byte
+		wantErr     bool
+	}{
+		{name: "short length", ber: decodeHex(t, "0403 446f65"), wantContent: []byte("Doe")},
+		{name: "long length", ber: encodeTLV(tagOctetString, long), wantContent: long},
+		{name: "indefinite length", ber: decodeHex(t, "3080 0000"), wantErr: true},
+		{name: "too large", ber: decodeHex(t, "3084 7fffffff"), wantErr: true},
+		{name: "truncated", ber: decodeHex(t, "0405 446f65"), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readTLV(bytes.NewReader(tc.ber))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("readTLV() error = %v, wantErr %t", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(got.content, tc.wantContent) || !bytes.Equal(got.raw, tc.ber) {
+				t.Errorf("readTLV() = content %x, raw %x, want content %x, raw %x", got.content, got.raw, tc.wantContent, tc.ber)
+			}
+		})
+	}
+}
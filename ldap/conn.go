@@ -0,0 +1,183 @@
+package ldap
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/mark-rushakoff/ldapserver"
+)
+
+// Listener wraps the connections of a listener so requests are inspected
+// before the LDAP library handles them:
+//
+//   - Search filters are taken from the request itself. The library only
+//     passes on a lossy string representation (unescaped values, only the
+//     first substring component) which it fails to compile for some values.
+//   - StartTLS is handled on the connection (when tlsCfg is set), so requests
+//     can still be inspected after the upgrade.
+//   - Searches cut to the size limit of the client end with sizeLimitExceeded,
+//     which the library can't report along with entries.
+func (s *Server) Listener(ln net.Listener, tlsCfg *tls.Config) net.Listener {
+	return &listener{Listener: ln, server: s, tlsCfg: tlsCfg}
+}
+
+type listener struct {
+	net.Listener
+	server *Server
+	tlsCfg *tls.Config
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &requestConn{Conn: c, server: l.server, tlsCfg: l.tlsCfg}, nil
+}
+
+// requestConn hands LDAP messages to the library one by one. The library
+// reads a message and fully handles it before reading the next one, so the
+// search filter kept is always the one of the request being handled.
+type requestConn struct {
+	net.Conn
+	server *Server
+	tlsCfg *tls.Config
+
+	pending bytes.Buffer
+
+	// Filter of the current search request and whether its results were cut
+	// to the size limit.
+	filter        filter
+	filterStr     string
+	filterErr     error
+	limitExceeded bool
+}
+
+func (c *requestConn) Read(p []byte) (int, error) {
+	for c.pending.Len() == 0 {
+		msg, err := readTLV(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		out, err := c.inspect(msg)
+		if err != nil {
+			return 0, err
+		}
+		c.pending.Write(out)
+	}
+	return c.pending.Read(p)
+}
+
+// Write passes on the responses of the library. The result of a search whose
+// entries were cut to the size limit is set to sizeLimitExceeded. The library
+// writes one message at a time.
+// https://datatracker.ietf.org/doc/html/rfc4511#section-4.5.1.4
+func (c *requestConn) Write(p []byte) (int, error) {
+	if !c.limitExceeded {
+		return c.Conn.Write(p)
+	}
+	msg, err := readTLV(bytes.NewReader(p))
+	if err != nil || len(msg.raw) != len(p) || msg.tag != tagSequence {
+		return c.Conn.Write(p)
+	}
+	parts, err := parseTLVs(msg.content)
+	if err != nil || len(parts) < 2 || parts[1].tag != tagSearchResultDone {
+		return c.Conn.Write(p) // e.g. an entry
+	}
+	c.limitExceeded = false
+
+	result := ldapserver.LDAPResultCode(ldapserver.LDAPResultSizeLimitExceeded)
+	rest := [][]byte{parts[0].raw, encodeTLV(tagSearchResultDone,
+		encodeTLV(tagEnumerated, []byte{byte(result)}),
+		encodeTLV(tagOctetString),
+		encodeTLV(tagOctetString, []byte(ldapserver.LDAPResultCodeMap[result])),
+	)}
+	for _, p := range parts[2:] {
+		rest = append(rest, p.raw)
+	}
+	if _, err := c.Conn.Write(encodeTLV(tagSequence, rest...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// inspect looks at a message and returns what is passed on to the library.
+func (c *requestConn) inspect(msg *tlv) ([]byte, error) {
+	if msg.tag != tagSequence {
+		return msg.raw, nil
+	}
+	parts, err := parseTLVs(msg.content)
+	if err != nil || len(parts) < 2 {
+		return msg.raw, nil // left to the library to refuse
+	}
+	id, op := parts[0], parts[1]
+
+	switch op.tag {
+	case tagSearchRequest:
+		fields, err := parseTLVs(op.content)
+		if err != nil || len(fields) != 8 {
+			return msg.raw, nil
+		}
+		c.filter, c.filterStr, c.filterErr = decodeFilter(fields[6])
+		// The library gets a filter it can handle (it's not evaluated there).
+		fields[6] = &tlv{raw: encodeTLV(tagFilterPresent, []byte("objectClass"))}
+		var content [][]byte
+		for _, f := range fields {
+			content = append(content, f.raw)
+		}
+		rest := [][]byte{id.raw, encodeTLV(tagSearchRequest, content...)}
+		for _, p := range parts[2:] {
+			rest = append(rest, p.raw)
+		}
+		return encodeTLV(tagSequence, rest...), nil
+	case tagExtendedRequest:
+		fields, err := parseTLVs(op.content)
+		if err != nil || len(fields) == 0 || fields[0].tag != tagExtendedName || string(fields[0].content) != oidStartTLS {
+			return msg.raw, nil
+		}
+		return nil, c.startTLS(id)
+	}
+	return msg.raw, nil
+}
+
+// startTLS answers a StartTLS request and upgrades the connection.
+// https://datatracker.ietf.org/doc/html/rfc4511#section-4.14
+func (c *requestConn) startTLS(id *tlv) error {
+	result := ldapserver.LDAPResultCode(ldapserver.LDAPResultSuccess)
+	if c.tlsCfg == nil {
+		result = ldapserver.LDAPResultProtocolError
+	} else if _, ok := c.Conn.(*tls.Conn); ok {
+		result = ldapserver.LDAPResultOperationsError // TLS is already established
+	}
+	resp := encodeTLV(tagSequence, id.raw, encodeTLV(tagExtendedResponse,
+		encodeTLV(tagEnumerated, []byte{byte(result)}),
+		encodeTLV(tagOctetString),
+		encodeTLV(tagOctetString, []byte(ldapserver.LDAPResultCodeMap[result])),
+		encodeTLV(tagExtendedRespName, []byte(oidStartTLS)),
+	))
+	if _, err := c.Conn.Write(resp); err != nil {
+		return err
+	}
+	if result != ldapserver.LDAPResultSuccess {
+		return nil
+	}
+	if c.server.Config.Debug {
+		fmt.Printf("LDAP/StartTLS: Upgrading connection from %s\n", c.RemoteAddr())
+	}
+	c.Conn = tls.Server(c.Conn, c.tlsCfg)
+	return nil
+}
+
+// searchFilter returns the filter of the search request being handled.
+func (c *requestConn) searchFilter() (filter, string, error) {
+	c.limitExceeded = false
+	return c.filter, c.filterStr, c.filterErr
+}
+
+// sizeLimitExceeded marks the results of the search request being handled as
+// cut to the size limit.
+func (c *requestConn) sizeLimitExceeded() {
+	c.limitExceeded = true
+}
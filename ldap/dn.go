@@ -0,0 +1,166 @@
+package ldap
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mark-rushakoff/ldapserver"
+)
+
+const (
+	// DN of the subschema entry announced in the rootDSE.
+	schemaDN = "cn=Subschema"
+
+	// Paged results control, supported by the server.
+	// https://datatracker.ietf.org/doc/html/rfc2696
+	oidPagedResults = "1.2.840.113556.1.4.319"
+
+	// StartTLS extended operation, supported when enabled.
+	// https://datatracker.ietf.org/doc/html/rfc4511#section-4.14
+	oidStartTLS = "1.3.6.1.4.1.1466.20037"
+)
+
+var (
+	// Attributes of the entries which aren't part of the standard schemas. There
+	// are no registered OIDs for them, hence the descriptive "<name>-oid" ones.
+	customAttributes = []string{
+		"callsign",
+		"firstname",
+		"lastname",
+		"meshname",
+		"sipPhone",
+		"telephoneHostname",
+		"telephoneIP",
+	}
+)
+
+// escapeDNValue escapes special characters in an attribute value of a DN.
+// https://datatracker.ietf.org/doc/html/rfc4514#section-2.4
+func escapeDNValue(v string) string {
+	var b strings.Builder
+	for i, c := range v {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, c),
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(v)-1 && c == ' ':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// normalizeDN makes DNs comparable by ignoring case and spaces around separators.
+func normalizeDN(dn string) string {
+	rdns := strings.Split(dn, ",")
+	for i, rdn := range rdns {
+		attr, value, _ := strings.Cut(rdn, "=")
+		rdns[i] = strings.ToLower(strings.TrimSpace(attr)) + "=" + strings.ToLower(strings.TrimSpace(value))
+	}
+	if len(rdns) == 1 && rdns[0] == "=" {
+		return ""
+	}
+	return strings.Join(rdns, ",")
+}
+
+// isDescendant checks whether the (normalized) DN is below the (normalized) base.
+func isDescendant(dn, base string) bool {
+	if base == "" {
+		return dn != ""
+	}
+	return strings.HasSuffix(dn, ","+base)
+}
+
+// baseEntry describes the base DN itself based on its first RDN (e.g. "ou=phonebook").
+func baseEntry(dn string) *ldapserver.Entry {
+	attr, value, _ := strings.Cut(strings.Split(dn, ",")[0], "=")
+	attr, value = strings.TrimSpace(attr), strings.TrimSpace(value)
+	classes := []string{"top"}
+	switch strings.ToLower(attr) {
+	case "ou":
+		classes = append(classes, "organizationalUnit")
+	case "o":
+		classes = append(classes, "organization")
+	case "dc":
+		classes = append(classes, "domain", "dcObject")
+	}
+	return &ldapserver.Entry{
+		DN: dn,
+		Attributes: []*ldapserver.EntryAttribute{
+			{Name: "objectClass", Values: classes},
+			{Name: attr, Values: []string{value}},
+		},
+	}
+}
+
+// rootDSE describes the server so clients can detect the directory and its capabilities.
+// https://datatracker.ietf.org/doc/html/rfc4512#section-5.1
+func (s *Server) rootDSE() *ldapserver.Entry {
+	dse := &ldapserver.Entry{
+		DN: "",
+		Attributes: []*ldapserver.EntryAttribute{
+			{Name: "objectClass", Values: []string{"top", "extensibleObject"}},
+			{Name: "namingContexts", Values: []string{s.Config.GetLDAPBaseDN()}},
+			{Name: "defaultNamingContext", Values: []string{s.Config.GetLDAPBaseDN()}},
+			{Name: "subschemaSubentry", Values: []string{schemaDN}},
+			{Name: "supportedLDAPVersion", Values: []string{"3"}},
+			{Name: "supportedControl", Values: []string{oidPagedResults}},
+			{Name: "vendorName", Values: []string{"AREDN Phonebook"}},
+		},
+	}
+	if s.Config.LDAPStartTLS {
+		dse.Attributes = append(dse.Attributes, &ldapserver.EntryAttribute{Name: "supportedExtension", Values: []string{oidStartTLS}})
+	}
+	return dse
+}
+
+// schema describes the attributes of the entries which aren't part of the standard schemas.
+// https://datatracker.ietf.org/doc/html/rfc4512#section-4.2
+func (s *Server) schema() *ldapserver.Entry {
+	var types []string
+	for _, a := range customAttributes {
+		types = append(types, fmt.Sprintf("( %s-oid NAME '%s' EQUALITY caseIgnoreMatch SUBSTR caseIgnoreSubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 )", strings.ToLower(a), a))
+	}
+	return &ldapserver.Entry{
+		DN: schemaDN,
+		Attributes: []*ldapserver.EntryAttribute{
+			{Name: "objectClass", Values: []string{"top", "subschema"}},
+			{Name: "cn", Values: []string{"Subschema"}},
+			{Name: "attributeTypes", Values: types},
+			{Name: "objectClasses", Values: []string{
+				fmt.Sprintf("( arednphonebookentry-oid NAME 'arednPhonebookEntry' SUP top AUXILIARY MAY ( %s ) )", strings.Join(customAttributes, " $ ")),
+			}},
+		},
+	}
+}
+
+// selectAttributes returns the requested attributes of an entry: all user
+// attributes when none or "*" are requested and none for "1.1". Only the
+// names are returned when typesOnly is set.
+// https://datatracker.ietf.org/doc/html/rfc4511#section-4.5.1.8
+func selectAttributes(entry *ldapserver.Entry, requested []string, typesOnly bool) *ldapserver.Entry {
+	all := len(requested) == 0
+	wanted := make(map[string]bool)
+	for _, r := range requested {
+		switch r = strings.ToLower(strings.TrimSpace(r)); r {
+		case "*", "+", "":
+			all = true
+		case "1.1":
+		default:
+			wanted[r] = true
+		}
+	}
+
+	selected := &ldapserver.Entry{DN: entry.DN}
+	for _, a := range entry.Attributes {
+		if !all && !wanted[strings.ToLower(a.Name)] {
+			continue
+		}
+		attr := &ldapserver.EntryAttribute{Name: a.Name, Values: a.Values}
+		if typesOnly {
+			attr.Values = []string{}
+		}
+		selected.Attributes = append(selected.Attributes, attr)
+	}
+	return selected
+}
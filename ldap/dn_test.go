@@ -0,0 +1,134 @@
+package ldap
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mark-rushakoff/ldapserver"
+)
+
+func TestEscapeDNValue(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  string
+	}{
+		{"123456", "123456"},
+		{"+41123456", `\+41123456`},
+		{"Doe, John", `Doe\, John`},
+		{`a=b;c<d>"e"\f`, `a\=b\;c\<d\>\"e\"\\f`},
+		{"#1", `\#1`},
+		{"1#", "1#"},
+		{" 1 2 ", `\ 1 2\ `},
+		{"Zürich", "Zürich"},
+	} {
+		if got := escapeDNValue(tc.value); got != tc.want {
+			t.Errorf("escapeDNValue(%q) = %q, want %q", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeDN(t *testing.T) {
+	for _, tc := range []struct {
+		dn   string
+		want string
+	}{
+		{"", ""},
+		{" ", ""},
+		{"ou=phonebook", "ou=phonebook"},
+		{"OU = Phonebook , DC=Example,dc=ORG", "ou=phonebook,dc=example,dc=org"},
+		{"telephoneNumber=123456,ou=phonebook", "telephonenumber=123456,ou=phonebook"},
+	} {
+		if got := normalizeDN(tc.dn); got != tc.want {
+			t.Errorf("normalizeDN(%q) = %q, want %q", tc.dn, got, tc.want)
+		}
+	}
+}
+
+func TestIsDescendant(t *testing.T) {
+	for _, tc := range []struct {
+		dn   string
+		base string
+		want bool
+	}{
+		{"telephonenumber=1,ou=phonebook", "ou=phonebook", true},
+		{"telephonenumber=1,ou=phonebook,dc=org", "dc=org", true},
+		{"ou=phonebook", "ou=phonebook", false},
+		{"telephonenumber=1,ou=phonebook2", "ou=phonebook", false},
+		{"telephonenumber=1,xou=phonebook", "ou=phonebook", false},
+		{"telephonenumber=1", "", true},
+		{"", "", false},
+	} {
+		if got := isDescendant(tc.dn, tc.base); got != tc.want {
+			t.Errorf("isDescendant(%q, %q) = %t, want %t", tc.dn, tc.base, got, tc.want)
+		}
+	}
+}
+
+func TestBaseEntry(t *testing.T) {
+	for _, tc := range []struct {
+		dn          string
+		wantClasses []string
+		wantAttr    string
+		wantValue   string
+	}{
+		{"ou=phonebook,dc=example", []string{"top", "organizationalUnit"}, "ou", "phonebook"},
+		{"O=Example", []string{"top", "organization"}, "O", "Example"},
+		{"dc=example, dc=org", []string{"top", "domain", "dcObject"}, "dc", "example"},
+		{"cn=phonebook", []string{"top"}, "cn", "phonebook"},
+	} {
+		want := &ldapserver.Entry{
+			DN: tc.dn,
+			Attributes: []*ldapserver.EntryAttribute{
+				{Name: "objectClass", Values: tc.wantClasses},
+				{Name: tc.wantAttr, Values: []string{tc.wantValue}},
+			},
+		}
+		if diff := cmp.Diff(want, baseEntry(tc.dn)); diff != "" {
+			t.Errorf("baseEntry(%q) mismatch (-want +got):\n%s", tc.dn, diff)
+		}
+	}
+}
+
+func TestSelectAttributes(t *testing.T) {
+	entry := &ldapserver.Entry{
+		DN: "telephoneNumber=1,ou=phonebook",
+		Attributes: []*ldapserver.EntryAttribute{
+			{Name: "cn", Values: []string{"John Doe"}},
+			{Name: "telephoneNumber", Values: []string{"1"}},
+		},
+	}
+	all := []string{"cn", "telephoneNumber"}
+	for _, tc := range []struct {
+		name      string
+		requested []string
+		typesOnly bool
+		want      []string // selected attribute names
+	}{
+		{name: "none requested", want: all},
+		{name: "all user attributes", requested: []string{"*"}, want: all},
+		{name: "by name ignoring case", requested: []string{"TELEPHONENUMBER"}, want: []string{"telephoneNumber"}},
+		{name: "unknown", requested: []string{"mail"}},
+		{name: "no attributes", requested: []string{"1.1"}},
+		{name: "types only", requested: []string{"cn"}, typesOnly: true, want: []string{"cn"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := selectAttributes(entry, tc.requested, tc.typesOnly)
+			if got.DN != entry.DN {
+				t.Errorf("selectAttributes() DN = %q, want %q", got.DN, entry.DN)
+			}
+			var names []string
+			for _, a := range got.Attributes {
+				names = append(names, a.Name)
+				if tc.typesOnly && len(a.Values) > 0 {
+					t.Errorf("selectAttributes() returned values for %s with typesOnly", a.Name)
+				}
+				if !tc.typesOnly && len(a.Values) == 0 {
+					t.Errorf("selectAttributes() returned no values for %s", a.Name)
+				}
+			}
+			if diff := cmp.Diff(tc.want, names); diff != "" {
+				t.Errorf("selectAttributes() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// filter is a parsed search filter which can be evaluated against the
+// attributes of an entry (keyed by lower case attribute name).
+// https://datatracker.ietf.org/doc/html/rfc4515
+type filter interface {
+	match(attrs map[string][]string) bool
+}
+
+type andFilter []filter
+
+func (f andFilter) match(attrs map[string][]string) bool {
+	for _, c := range f {
+		if !c.match(attrs) {
+			return false
+		}
+	}
+	return true
+}
+
+type orFilter []filter
+
+func (f orFilter) match(attrs map[string][]string) bool {
+	for _, c := range f {
+		if c.match(attrs) {
+			return true
+		}
+	}
+	return false
+}
+
+type notFilter struct {
+	filter filter
+}
+
+func (f *notFilter) match(attrs map[string][]string) bool {
+	return !f.filter.match(attrs)
+}
+
+type presentFilter struct {
+	attr string
+}
+
+func (f *presentFilter) match(attrs map[string][]string) bool {
+	return len(attrs[f.attr]) > 0
+}
+
+// Filter types comparing attribute values.
+const (
+	matchEqual = iota
+	matchGreaterOrEqual
+	matchLessOrEqual
+	matchApprox
+)
+
+type compareFilter struct {
+	attr  string
+	op    int
+	value string
+}
+
+func (f *compareFilter) match(attrs map[string][]string) bool {
+	want := normalizeValue(f.attr, f.value)
+	for _, v := range attrs[f.attr] {
+		v = normalizeValue(f.attr, v)
+		switch f.op {
+		case matchEqual:
+			if v == want {
+				return true
+			}
+		case matchGreaterOrEqual:
+			if v >= want {
+				return true
+			}
+		case matchLessOrEqual:
+			if v <= want {
+				return true
+			}
+		case matchApprox:
+			if strings.ReplaceAll(v, " ", "") == strings.ReplaceAll(want, " ", "") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type substringFilter struct {
+	attr    string
+	initial string
+	any     []string
+	final   string
+}
+
+func (f *substringFilter) match(attrs map[string][]string) bool {
+	initial := normalizeValue(f.attr, f.initial)
+	final := normalizeValue(f.attr, f.final)
+	for _, v := range attrs[f.attr] {
+		v = normalizeValue(f.attr, v)
+		if !strings.HasPrefix(v, initial) {
+			continue
+		}
+		rest := v[len(initial):]
+		ok := true
+		for _, a := range f.any {
+			a = normalizeValue(f.attr, a)
+			i := strings.Index(rest, a)
+			if i < 0 {
+				ok = false
+				break
+			}
+			rest = rest[i+len(a):]
+		}
+		if ok && strings.HasSuffix(rest, final) {
+			return true
+		}
+	}
+	return false
+}
+
+// undefinedFilter is used for filters we can't evaluate (e.g. extensible
+// matches), which never match.
+// https://datatracker.ietf.org/doc/html/rfc4511#section-4.5.1.7
+type undefinedFilter struct{}
+
+func (f *undefinedFilter) match(map[string][]string) bool {
+	return false
+}
+
+// normalizeValue prepares values for case insensitive comparison. Phone
+// numbers additionally ignore spaces and dashes (telephoneNumberMatch).
+func normalizeValue(attr, v string) string {
+	v = strings.ToLower(strings.Join(strings.Fields(v), " "))
+	if attr == "telephonenumber" {
+		v = strings.NewReplacer(" ", "", "-", "").Replace(v)
+	}
+	return v
+}
+
+// parseFilter parses the string representation of a search filter.
+// An empty filter matches all entries.
+func parseFilter(s string) (filter, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return andFilter{}, nil
+	}
+	f, rest, err := parseFilterAt(s)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected data after filter: %q", rest)
+	}
+	return f, nil
+}
+
+// parseFilterAt parses a filter at the start of s and returns what's left.
+func parseFilterAt(s string) (filter, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", fmt.Errorf("filter needs to start with '(': %q", s)
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", errors.New("unexpected end of filter")
+	}
+
+	var f filter
+	switch s[0] {
+	case '&', '|':
+		var fs []filter
+		op := s[0]
+		s = s[1:]
+		for strings.HasPrefix(s, "(") {
+			c, rest, err := parseFilterAt(s)
+			if err != nil {
+				return nil, "", err
+			}
+			fs = append(fs, c)
+			s = rest
+		}
+		if op == '&' {
+			f = andFilter(fs)
+		} else {
+			f = orFilter(fs)
+		}
+	case '!':
+		c, rest, err := parseFilterAt(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		f = &notFilter{c}
+		s = rest
+	default:
+		end := strings.IndexByte(s, ')')
+		if end < 0 {
+			return nil, "", errors.New("unexpected end of filter")
+		}
+		item, err := parseItem(s[:end])
+		if err != nil {
+			return nil, "", err
+		}
+		f = item
+		s = s[end:]
+	}
+
+	if !strings.HasPrefix(s, ")") {
+		return nil, "", errors.New("filter needs to end with ')'")
+	}
+	return f, s[1:], nil
+}
+
+// parseItem parses a simple filter (without parentheses) like "cn=doe*".
+func parseItem(s string) (filter, error) {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid filter item: %q", s)
+	}
+	attr, raw := s[:i], s[i+1:]
+
+	op := matchEqual
+	switch attr[len(attr)-1] {
+	case '>':
+		op = matchGreaterOrEqual
+	case '<':
+		op = matchLessOrEqual
+	case '~':
+		op = matchApprox
+	case ':':
+		return &undefinedFilter{}, nil // extensible match
+	}
+	if op != matchEqual {
+		attr = attr[:len(attr)-1]
+	}
+	// Attribute options (e.g. "cn;lang-en") are ignored.
+	attr, _, _ = strings.Cut(attr, ";")
+	attr = strings.ToLower(strings.TrimSpace(attr))
+	if attr == "" {
+		return nil, fmt.Errorf("invalid filter item: %q", s)
+	}
+
+	if op != matchEqual || !strings.Contains(raw, "*") {
+		v, err := unescapeValue(raw)
+		if err != nil {
+			return nil, err
+		}
+		return &compareFilter{attr: attr, op: op, value: v}, nil
+	}
+	if raw == "*" {
+		return &presentFilter{attr}, nil
+	}
+
+	parts := strings.Split(raw, "*")
+	for i, p := range parts {
+		v, err := unescapeValue(p)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = v
+	}
+	f := &substringFilter{
+		attr:    attr,
+		initial: parts[0],
+		final:   parts[len(parts)-1],
+	}
+	for _, p := range parts[1 : len(parts)-1] {
+		if p != "" {
+			f.any = append(f.any, p)
+		}
+	}
+	return f, nil
+}
+
+// unescapeValue resolves the hex escapes (e.g. "\2a" for '*') in a filter value.
+func unescapeValue(v string) (string, error) {
+	if !strings.Contains(v, `\`) {
+		return v, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' {
+			b.WriteByte(v[i])
+			continue
+		}
+		if i+3 > len(v) {
+			return "", fmt.Errorf("invalid escape in filter value: %q", v)
+		}
+		c, err := hex.DecodeString(v[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in filter value: %q", v)
+		}
+		b.Write(c)
+		i += 2
+	}
+	return b.String(), nil
+}
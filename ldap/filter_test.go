@@ -0,0 +1,116 @@
+package ldap
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// allowFilters compares the unexported fields of parsed filters.
+var allowFilters = cmp.AllowUnexported(notFilter{}, presentFilter{}, compareFilter{}, substringFilter{})
+
+func TestParseFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		filter  string
+		want    filter
+		wantErr bool
+	}{
+		{name: "empty", filter: " ", want: andFilter{}},
+		{name: "equal", filter: "(cn=Doe)", want: &compareFilter{attr: "cn", op: matchEqual, value: "Doe"}},
+		{name: "attribute case and options", filter: "(CN;lang-en=Doe)", want: &compareFilter{attr: "cn", op: matchEqual, value: "Doe"}},
+		{name: "greater or equal", filter: "(telephoneNumber>=100)", want: &compareFilter{attr: "telephonenumber", op: matchGreaterOrEqual, value: "100"}},
+		{name: "less or equal", filter: "(telephoneNumber<=200)", want: &compareFilter{attr: "telephonenumber", op: matchLessOrEqual, value: "200"}},
+		{name: "approx", filter: "(sn~=doe)", want: &compareFilter{attr: "sn", op: matchApprox, value: "doe"}},
+		{name: "present", filter: "(objectClass=*)", want: &presentFilter{"objectclass"}},
+		{
+			name:   "substrings",
+			filter: "(cn=J*o**h*n)",
+			want:   &substringFilter{attr: "cn", initial: "J", any: []string{"o", "h"}, final: "n"},
+		},
+		{name: "substring without initial", filter: "(cn=*Doe)", want: &substringFilter{attr: "cn", final: "Doe"}},
+		{name: "escaped asterisk", filter: `(cn=a\2a)`, want: &compareFilter{attr: "cn", op: matchEqual, value: "a*"}},
+		{name: "escaped parentheses", filter: `(cn=\28x\29*)`, want: &substringFilter{attr: "cn", initial: "(x)"}},
+		{name: "extensible", filter: "(cn:caseExactMatch:=Doe)", want: &undefinedFilter{}},
+		{
+			name:   "nested",
+			filter: "(&(objectClass=person)(|(sn=Doe)(!(cn=John*))))",
+			want: andFilter{
+				&compareFilter{attr: "objectclass", op: matchEqual, value: "person"},
+				orFilter{
+					&compareFilter{attr: "sn", op: matchEqual, value: "Doe"},
+					&notFilter{&substringFilter{attr: "cn", initial: "John"}},
+				},
+			},
+		},
+		{name: "empty and", filter: "(&)", want: andFilter(nil)},
+		{name: "missing parentheses", filter: "cn=Doe", wantErr: true},
+		{name: "unterminated", filter: "(cn=Doe", wantErr: true},
+		{name: "unterminated and", filter: "(&(cn=Doe)", wantErr: true},
+		{name: "trailing data", filter: "(cn=Doe)(sn=Doe)", wantErr: true},
+		{name: "missing attribute", filter: "(=Doe)", wantErr: true},
+		{name: "missing operator", filter: "(cn)", wantErr: true},
+		{name: "invalid escape", filter: `(cn=\zz)`, wantErr: true},
+		{name: "truncated escape", filter: `(cn=a\2)`, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseFilter(tc.filter)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseFilter(%q) error = %v, wantErr %t", tc.filter, err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got, allowFilters); diff != "" {
+				t.Errorf("parseFilter(%q) mismatch (-want +got):\n%s", tc.filter, diff)
+			}
+		})
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	attrs := map[string][]string{
+		"objectclass":     {"top", "person"},
+		"cn":              {"John  Doe"},
+		"sn":              {"Doe"},
+		"telephonenumber": {"123-456"},
+	}
+	for _, tc := range []struct {
+		filter string
+		want   bool
+	}{
+		{"", true},
+		{"(objectClass=person)", true},
+		{"(objectClass=PERSON)", true},
+		{"(objectClass=device)", false},
+		{"(cn=john doe)", true},
+		{"(mail=*)", false},
+		{"(sn=*)", true},
+		{"(cn=J*D*e)", true},
+		{"(cn=*ohn*)", true},
+		{"(cn=*Doe*John)", false},
+		{"(cn=Jo*n*n)", false},
+		{"(telephoneNumber=123456)", true},
+		{"(telephoneNumber=12 34 56)", true},
+		{"(telephoneNumber=12*56)", true},
+		{"(telephoneNumber>=123000)", true},
+		{"(telephoneNumber<=123000)", false},
+		{"(cn~=JohnDoe)", true},
+		{"(cn:caseExactMatch:=John Doe)", false},
+		{"(!(cn:caseExactMatch:=John Doe))", true},
+		{"(&(sn=Doe)(cn=John*))", true},
+		{"(&(sn=Doe)(cn=Jane*))", false},
+		{"(|(sn=Smith)(cn=John*))", true},
+		{"(|(sn=Smith)(cn=Jane*))", false},
+		{"(&)", true},
+		{"(|)", false},
+		{"(!(sn=Doe))", false},
+	} {
+		t.Run(tc.filter, func(t *testing.T) {
+			f, err := parseFilter(tc.filter)
+			if err != nil {
+				t.Fatalf("parseFilter(%q) returned error: %s", tc.filter, err)
+			}
+			if got := f.match(attrs); got != tc.want {
+				t.Errorf("match(%q) = %t, want %t", tc.filter, got, tc.want)
+			}
+		})
+	}
+}
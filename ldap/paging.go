@@ -0,0 +1,96 @@
+package ldap
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mark-rushakoff/ldapserver"
+)
+
+const (
+	// Results of paged searches are kept for clients to fetch the next page within.
+	pagingTimeout = 5 * time.Minute
+)
+
+// pagedResult holds the remaining results of a paged search as they were when
+// the search started, so reloads in between pages don't shift them.
+// https://datatracker.ietf.org/doc/html/rfc2696
+type pagedResult struct {
+	boundDN string
+	entries []*ldapserver.Entry
+}
+
+// pagingControl returns the paged results control of a search request (if any).
+func pagingControl(controls []ldapserver.Control) *ldapserver.ControlPaging {
+	for _, c := range controls {
+		if p, ok := c.(*ldapserver.ControlPaging); ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// nextPage continues a paged search from the results stored under the cookie.
+// A page size of 0 abandons the search.
+func (s *Server) nextPage(boundDN string, ctrl *ldapserver.ControlPaging) (ldapserver.ServerSearchResult, error) {
+	s.init()
+
+	res, ok := s.pages.Get(string(ctrl.Cookie))
+	if !ok || res.boundDN != boundDN {
+		if s.Config.Debug {
+			fmt.Printf("LDAP/Search: Unknown or expired paging cookie %x\n", ctrl.Cookie)
+		}
+		return ldapserver.ServerSearchResult{ResultCode: ldapserver.LDAPResultUnwillingToPerform}, errors.New("unknown or expired paging cookie")
+	}
+	s.pages.Remove(string(ctrl.Cookie))
+	if ctrl.PagingSize == 0 {
+		return s.page(boundDN, nil, ctrl), nil
+	}
+	return s.page(boundDN, res.entries, ctrl), nil
+}
+
+// page returns the next page of results and keeps the remaining ones under a
+// new cookie (the cookie is empty when there are no more results).
+func (s *Server) page(boundDN string, entries []*ldapserver.Entry, ctrl *ldapserver.ControlPaging) ldapserver.ServerSearchResult {
+	s.init()
+
+	n := len(entries)
+	if ctrl.PagingSize > 0 {
+		n = min(n, int(ctrl.PagingSize))
+	}
+	results, rest := entries[:n], entries[n:]
+
+	resp := ldapserver.NewControlPaging(0)
+	resp.SetCookie([]byte{})
+	if len(rest) > 0 {
+		cookie, err := newCookie()
+		if err != nil {
+			// Without a cookie, the client only gets the first page.
+			fmt.Printf("LDAP/Search: unable to generate paging cookie: %s\n", err)
+		} else {
+			s.pages.Set(cookie, &pagedResult{boundDN: boundDN, entries: rest}, pagingTimeout)
+			resp.SetCookie([]byte(cookie))
+		}
+	}
+	if s.Config.Debug {
+		fmt.Printf("LDAP/Search: Returning page of %d results (%d remaining)\n", len(results), len(rest))
+	}
+
+	return ldapserver.ServerSearchResult{
+		Entries:    results,
+		Referrals:  []string{},
+		Controls:   []ldapserver.Control{resp},
+		ResultCode: ldapserver.LDAPResultSuccess,
+	}
+}
+
+func newCookie() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -1,12 +1,11 @@
 package ldap
 
 import (
-	"encoding/binary"
+	"crypto/subtle"
 	"fmt"
 	"net"
-	"regexp"
-	"sort"
 	"strings"
+	"sync"
 
 	"github.com/mark-rushakoff/ldapserver"
 
@@ -14,28 +13,58 @@ import (
 	"github.com/arednch/phonebook/data"
 )
 
-var (
-	filterRE = regexp.MustCompile(`\(\w*=\*?([a-zA-Z0-9]+)\*?\)`)
-)
-
-func CookieToIdx(c []byte) uint32 {
-	return binary.LittleEndian.Uint32(c)
+// attributeValues returns the values of the attributes keyed by lower case name.
+func attributeValues(attrs []*ldapserver.EntryAttribute) map[string][]string {
+	values := make(map[string][]string)
+	for _, a := range attrs {
+		name := strings.ToLower(a.Name)
+		values[name] = append(values[name], a.Values...)
+	}
+	return values
 }
 
-func IdxToCookie(idx uint32) []byte {
-	c := make([]byte, 4)
-	binary.LittleEndian.PutUint32(c, idx)
-	return c
+// entryDN returns the DN of a phonebook entry, which is stable as long as its phone number doesn't change.
+func entryDN(number, baseDN string) string {
+	dn := "telephoneNumber=" + escapeDNValue(number)
+	if baseDN == "" {
+		return dn
+	}
+	return dn + "," + baseDN
 }
 
+// What anonymous binds get to see.
+var anonymousAccount = &data.LDAPAccount{ActiveOnly: true, HideIPs: true}
+
 type Server struct {
 	Config *configuration.Config
 
 	Records *data.Records
+
+	initOnce sync.Once
+	// Remaining results of paged searches by cookie.
+	pages *data.TTLCache[string, *pagedResult]
+}
+
+func (s *Server) init() {
+	s.initOnce.Do(func() {
+		s.pages = data.NewTTL[string, *pagedResult]()
+	})
 }
 
 func (s *Server) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldapserver.LDAPResultCode, error) {
-	if bindDN == s.Config.LDAPUser && bindSimplePw == s.Config.LDAPPwd {
+	if bindDN == "" && bindSimplePw == "" {
+		if s.Config.GetLDAPAnonymous() {
+			if s.Config.Debug {
+				fmt.Println("LDAP/Bind: Anonymous request (allowed)")
+			}
+			return ldapserver.LDAPResultSuccess, nil
+		}
+		if s.Config.Debug {
+			fmt.Println("LDAP/Bind: Anonymous request (not allowed)")
+		}
+		return ldapserver.LDAPResultInappropriateAuthentication, nil
+	}
+	if s.authenticate(bindDN, bindSimplePw) {
 		if s.Config.Debug {
 			fmt.Printf("LDAP/Bind: Request for DN %q (valid credentials)\n", bindDN)
 		}
@@ -47,25 +76,135 @@ func (s *Server) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldapserver.LD
 	return ldapserver.LDAPResultInvalidCredentials, nil
 }
 
-func (s *Server) Search(boundDN string, searchReq ldapserver.SearchRequest, conn net.Conn) (ldapserver.ServerSearchResult, error) {
-	var searchQuery string
-	if searchReq.Filter != "" {
-		parts := filterRE.FindStringSubmatch(searchReq.Filter)
-		if len(parts) > 1 {
-			searchQuery = strings.ToLower(parts[1])
+// authenticate checks the credentials against the configured user (if in use)
+// and the LDAP accounts. Unauthenticated binds (DN without password) are refused.
+func (s *Server) authenticate(bindDN, pw string) bool {
+	if pw == "" {
+		return false
+	}
+	if s.isLegacyUser(bindDN) {
+		return subtle.ConstantTimeCompare([]byte(pw), []byte(s.Config.LDAPPwd)) == 1
+	}
+	if a := s.findAccount(bindDN); a != nil {
+		return a.CheckPassword(pw)
+	}
+	return false
+}
+
+// isLegacyUser checks whether the DN is the one of the configured user, which
+// is only in use as long as no LDAP accounts are configured.
+func (s *Server) isLegacyUser(bindDN string) bool {
+	return s.Config.LDAPUser != "" && len(s.Config.LDAPAccounts) == 0 && bindDN == s.Config.LDAPUser
+}
+
+// findAccount looks up the LDAP account of a bind DN, which is either the user
+// itself or "cn=<user>" below the base DN.
+func (s *Server) findAccount(bindDN string) *data.LDAPAccount {
+	dn := normalizeDN(bindDN)
+	for _, a := range s.Config.LDAPAccounts {
+		if a.User == bindDN || dn == normalizeDN("cn="+escapeDNValue(a.User)+","+s.Config.GetLDAPBaseDN()) {
+			return a
 		}
 	}
+	return nil
+}
+
+// accountFor returns the account of a bound connection defining what it gets
+// to see. Anonymous connections (if allowed) only see active entries without IPs.
+func (s *Server) accountFor(boundDN string) (*data.LDAPAccount, bool) {
+	if boundDN == "" {
+		return anonymousAccount, s.Config.GetLDAPAnonymous()
+	}
+	if s.isLegacyUser(boundDN) {
+		return &data.LDAPAccount{User: boundDN}, true
+	}
+	a := s.findAccount(boundDN)
+	return a, a != nil
+}
+
+func (s *Server) Search(boundDN string, searchReq ldapserver.SearchRequest, conn net.Conn) (ldapserver.ServerSearchResult, error) {
+	// Filters are taken from the request itself when possible (see Listener).
+	var f filter
+	var filterStr string
+	var err error
+	if c, ok := conn.(*requestConn); ok {
+		f, filterStr, err = c.searchFilter()
+	} else {
+		filterStr = searchReq.Filter
+		f, err = parseFilter(searchReq.Filter)
+	}
 	if s.Config.Debug {
-		fmt.Printf("LDAP/Search: Search filter %q, searching for %q\n", searchReq.Filter, searchQuery)
+		fmt.Printf("LDAP/Search: Search filter %q, base %q, scope %q\n", filterStr, searchReq.BaseDN, ldapserver.ScopeMap[searchReq.Scope])
+	}
+	if err != nil {
+		if s.Config.Debug {
+			fmt.Printf("LDAP/Search: Invalid search filter %q: %s\n", filterStr, err)
+		}
+		return ldapserver.ServerSearchResult{ResultCode: ldapserver.LDAPResultProtocolError}, fmt.Errorf("invalid search filter: %s", err)
+	}
+
+	// The rootDSE and schema are only returned when asked for explicitly.
+	base := normalizeDN(searchReq.BaseDN)
+	if searchReq.Scope == ldapserver.ScopeBaseObject {
+		switch base {
+		case "":
+			return s.singleResult(searchReq, f, s.rootDSE()), nil
+		case normalizeDN(schemaDN):
+			return s.singleResult(searchReq, f, s.schema()), nil
+		}
 	}
-	s.Records.Mu.RLock()
-	defer s.Records.Mu.RUnlock()
-	sort.Sort(data.ByName(s.Records.Entries))
 
-	// Populate a (sorted) list of results for the given search query.
+	// Connections which aren't bound can't be told apart from anonymous binds.
+	account, ok := s.accountFor(boundDN)
+	if !ok {
+		if s.Config.Debug {
+			fmt.Printf("LDAP/Search: Denying search for DN %q\n", boundDN)
+		}
+		return ldapserver.ServerSearchResult{ResultCode: ldapserver.LDAPResultInsufficientAccessRights}, fmt.Errorf("access denied for DN %q", boundDN)
+	}
+
+	// Without a configured base DN, entries are returned under whatever base
+	// DN the client searches (phones usually don't allow to leave it empty).
+	baseDN := s.Config.LDAPBaseDN
+	if baseDN == "" {
+		baseDN = searchReq.BaseDN
+		if strings.HasPrefix(base, "telephonenumber=") {
+			_, baseDN, _ = strings.Cut(baseDN, ",") // search for a single entry
+		}
+	}
+	phonebookDN := normalizeDN(baseDN)
+	var entryBase bool // search for a single entry
+	switch {
+	case base == phonebookDN:
+		if searchReq.Scope == ldapserver.ScopeBaseObject {
+			return s.singleResult(searchReq, f, baseEntry(baseDN)), nil
+		}
+	case isDescendant(phonebookDN, base):
+		if searchReq.Scope != ldapserver.ScopeWholeSubtree {
+			return s.singleResult(searchReq, f), nil // entries are not immediately below
+		}
+	case isDescendant(base, phonebookDN):
+		if searchReq.Scope == ldapserver.ScopeSingleLevel {
+			return s.singleResult(searchReq, f), nil // entries have no children
+		}
+		entryBase = true
+	default:
+		return ldapserver.ServerSearchResult{ResultCode: ldapserver.LDAPResultNoSuchObject}, fmt.Errorf("no such object: %q", searchReq.BaseDN)
+	}
+
+	// Follow-up pages are served from the results of the initial search.
+	ctrl := pagingControl(searchReq.Controls)
+	if ctrl != nil && len(ctrl.Cookie) > 0 {
+		return s.nextPage(boundDN, ctrl)
+	}
+
+	resolve := s.Config.Resolve && !account.HideIPs
+
+	// Populate a list of results for the given search query (records are sorted by name).
+	s.Records.Mu.RLock()
 	entries := []*ldapserver.Entry{}
 	for _, entry := range s.Records.Entries {
-		if s.Config.FilterInactive && entry.Route == nil {
+		if (s.Config.FilterInactive || account.ActiveOnly) && !entry.IsActive() {
 			if s.Config.Debug {
 				fmt.Printf("LDAP/Search: Filtering inactive entry: %+v\n", entry)
 			}
@@ -73,7 +212,7 @@ func (s *Server) Search(boundDN string, searchReq ldapserver.SearchRequest, conn
 		}
 
 		var pfx string
-		if s.Config.IndicateActive && entry.Route != nil {
+		if s.Config.IndicateActive && entry.IsActive() {
 			pfx = s.Config.ActivePfx
 		}
 		name := entry.DisplayName(pfx)
@@ -81,19 +220,11 @@ func (s *Server) Search(boundDN string, searchReq ldapserver.SearchRequest, conn
 			continue // there's no point in adding an empty contact
 		}
 
-		// provide a super simple way to filter entries
-		if searchQuery != "" && !strings.Contains(strings.ToLower(name), searchQuery) {
-			if s.Config.Debug {
-				fmt.Printf("LDAP/Search: Filtering entry %q not matching search: %+v\n", name, entry)
-			}
-			continue
-		}
-
 		telAttrs := map[string]bool{}
 		for _, frmt := range s.Config.Formats {
 			switch frmt {
 			case "direct":
-				if s.Config.Resolve && entry.Route != nil {
+				if resolve && entry.Route != nil {
 					telAttrs[entry.Route.IP] = true
 				} else {
 					telAttrs[entry.DirectCallAddress()] = true
@@ -101,7 +232,7 @@ func (s *Server) Search(boundDN string, searchReq ldapserver.SearchRequest, conn
 			case "pbx":
 				telAttrs[entry.PhoneNumber] = true
 			default:
-				if s.Config.Resolve && entry.Route != nil {
+				if resolve && entry.Route != nil {
 					telAttrs[entry.Route.IP] = true
 					telAttrs[entry.PhoneNumber] = true
 				} else {
@@ -111,14 +242,20 @@ func (s *Server) Search(boundDN string, searchReq ldapserver.SearchRequest, conn
 			}
 		}
 
+		dn := entryDN(entry.PhoneNumber, baseDN)
+		if entryBase && normalizeDN(dn) != base {
+			continue
+		}
+
 		attrs := []*ldapserver.EntryAttribute{
-			{Name: "objectClass", Values: []string{"person"}},
+			{Name: "objectClass", Values: []string{"top", "person", "organizationalPerson", "inetOrgPerson", "arednPhonebookEntry"}},
 
 			{Name: "displayname", Values: []string{name}},
 			{Name: "cn", Values: []string{name}},
 			{Name: "meshname", Values: []string{name}},
 			{Name: "firstname", Values: []string{entry.FirstName}},
 			{Name: "gn", Values: []string{entry.FirstName}},
+			{Name: "givenName", Values: []string{entry.FirstName}},
 			{Name: "lastname", Values: []string{entry.LastName}},
 			{Name: "sn", Values: []string{entry.LastName}},
 			{Name: "callsign", Values: []string{entry.Callsign}},
@@ -126,7 +263,7 @@ func (s *Server) Search(boundDN string, searchReq ldapserver.SearchRequest, conn
 			{Name: "telephoneNumber", Values: []string{entry.PhoneNumber}},
 			{Name: "telephoneHostname", Values: []string{entry.DirectCallAddress()}},
 		}
-		if entry.Route != nil {
+		if entry.Route != nil && !account.HideIPs {
 			attrs = append(attrs, &ldapserver.EntryAttribute{Name: "telephoneIP", Values: []string{entry.Route.IP}})
 		}
 
@@ -137,61 +274,55 @@ func (s *Server) Search(boundDN string, searchReq ldapserver.SearchRequest, conn
 			}...)
 		}
 
-		entries = append(entries, &ldapserver.Entry{
-			DN:         fmt.Sprintf("sn=%s,%s", name, searchReq.BaseDN),
+		if !f.match(attributeValues(attrs)) {
+			if s.Config.Debug {
+				fmt.Printf("LDAP/Search: Filtering entry %q not matching search: %+v\n", name, entry)
+			}
+			continue
+		}
+
+		entries = append(entries, selectAttributes(&ldapserver.Entry{
+			DN:         dn,
 			Attributes: attrs,
-		})
+		}, searchReq.Attributes, searchReq.TypesOnly))
 	}
 
-	// If there's no search size limit or fewer entries than the search size limit, we return them immediately.
-	if searchReq.SizeLimit <= 0 || len(entries) <= searchReq.SizeLimit {
-		return ldapserver.ServerSearchResult{
-			Entries:    entries,
-			Referrals:  []string{},
-			Controls:   []ldapserver.Control{},
-			ResultCode: ldapserver.LDAPResultSuccess,
-		}, nil
-	}
+	s.Records.Mu.RUnlock()
 
-	// Based on the overall results, filter down the ones to return based on size limit and paging.
-	// First, get a potentially already existing paging control.
-	var ctrl *ldapserver.ControlPaging
-	for _, c := range searchReq.Controls {
-		if c.GetControlType() == ldapserver.ControlTypePaging {
-			ctrl = c.(*ldapserver.ControlPaging)
-			break
-		}
+	if ctrl != nil {
+		return s.page(boundDN, entries, ctrl), nil
 	}
-	if ctrl == nil {
-		ctrl = ldapserver.NewControlPaging(uint32(searchReq.SizeLimit))
+	// Without paging, results beyond the size limit of the client are dropped
+	// and the search ends with sizeLimitExceeded (see Listener).
+	if searchReq.SizeLimit > 0 && len(entries) > searchReq.SizeLimit {
+		if s.Config.Debug {
+			fmt.Printf("LDAP/Search: Reached search size limit provided by client (%d). Returning %d out of %d results.\n", searchReq.SizeLimit, searchReq.SizeLimit, len(entries))
+		}
+		entries = entries[:searchReq.SizeLimit]
+		if c, ok := conn.(*requestConn); ok {
+			c.sizeLimitExceeded()
+		}
 	}
+	return ldapserver.ServerSearchResult{
+		Entries:    entries,
+		Referrals:  []string{},
+		Controls:   []ldapserver.Control{},
+		ResultCode: ldapserver.LDAPResultSuccess,
+	}, nil
+}
 
-	// Determine where we left of last time.
-	start := uint32(0)
-	if ctrl.Cookie != nil {
-		start = CookieToIdx(ctrl.Cookie)
-	}
+// singleResult returns the given entries (if matching the filter) without paging.
+func (s *Server) singleResult(searchReq ldapserver.SearchRequest, f filter, entries ...*ldapserver.Entry) ldapserver.ServerSearchResult {
 	results := []*ldapserver.Entry{}
-	for i, entry := range entries {
-		if uint32(i) < start {
-			// Ignore results that we already returned.
-			continue
+	for _, e := range entries {
+		if f.match(attributeValues(e.Attributes)) {
+			results = append(results, selectAttributes(e, searchReq.Attributes, searchReq.TypesOnly))
 		}
-		if len(results) >= searchReq.SizeLimit {
-			if s.Config.Debug {
-				fmt.Printf("LDAP/Search: Reached search size limit provided by client (%d). Returning %d out of %d results.\n", searchReq.SizeLimit, len(results), len(entries))
-			}
-			break
-		}
-		results = append(results, entry)
 	}
-	ctrl.SetCookie(IdxToCookie(start + uint32(len(results))))
 	return ldapserver.ServerSearchResult{
-		Entries:   results,
-		Referrals: []string{},
-		Controls: []ldapserver.Control{
-			ctrl,
-		},
+		Entries:    results,
+		Referrals:  []string{},
+		Controls:   []ldapserver.Control{},
 		ResultCode: ldapserver.LDAPResultSuccess,
-	}, nil
+	}
 }
@@ -0,0 +1,114 @@
+package ldap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/arednch/phonebook/data"
+)
+
+const (
+	// Validity of generated self-signed certificates.
+	selfSignedValidity = 10 * 365 * 24 * time.Hour
+)
+
+// TLSConfig returns the TLS config for LDAPS and StartTLS using the configured
+// certificate. Without one, a self-signed certificate is generated on first
+// start and persisted next to the cache so clients can pin it.
+func (s *Server) TLSConfig() (*tls.Config, error) {
+	certFile, keyFile, selfSigned := s.Config.GetLDAPCertPaths()
+
+	var cert tls.Certificate
+	var err error
+	switch {
+	case !selfSigned:
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	case certFile == "":
+		// Nowhere to persist it, so a new one is generated on every start.
+		var certPEM, keyPEM []byte
+		if certPEM, keyPEM, err = selfSignedCertificate(); err == nil {
+			cert, err = tls.X509KeyPair(certPEM, keyPEM)
+		}
+	default:
+		cert, err = loadOrCreateCertificate(certFile, keyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to load certificate: %s", err)
+	}
+	if s.Config.Debug {
+		fmt.Printf("LDAP/TLS: Using certificate %q (self-signed: %t)\n", certFile, selfSigned)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// loadOrCreateCertificate loads a previously generated certificate or generates
+// and persists a new one when there's none yet.
+func loadOrCreateCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return cert, err
+	}
+
+	certPEM, keyPEM, err := selfSignedCertificate()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// selfSignedCertificate generates a certificate (and key) for the node's hostname.
+func selfSignedCertificate() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localnode"
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"AREDN Phonebook"}},
+		DNSNames:              []string{hostname, fmt.Sprintf("%s.%s", hostname, data.AREDNDomain)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
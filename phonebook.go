@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"embed"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -10,11 +13,13 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mark-rushakoff/ldapserver"
@@ -33,7 +38,12 @@ var (
 	// Generally applicable flags.
 	conf            = flag.String("conf", "", "Path to the JSON config file instead of parsing flags.")
 	sources         = flag.String("sources", "", "Comma separated paths or URLs to fetch the phonebook CSV from.")
-	sysInfoURL      = flag.String("sysinfo", "", "URL of sysinfo JSON API. Usually: http://localnode.local.mesh/cgi-bin/sysinfo.json?hosts=1")
+	sysInfoURL      = flag.String("sysinfo", "", "URL of sysinfo JSON API. Usually: http://localnode.local.mesh/cgi-bin/sysinfo.json?hosts=1&link_info=1&services=1")
+	routeSrcs       = flag.String("route_sources", "sysinfo,olsr,babel", "Comma separated list of sources to read routing data from, tried in order. Supported: sysinfo,olsr,babel")
+	olsrFile        = flag.String("olsr", configuration.DefaultOLSRFile, "Path to the OLSR hosts file.")
+	babelHosts      = flag.String("babel_hosts", configuration.DefaultBabelHosts, "Path to the hosts file (or folder of hosts files) used with Babel.")
+	routeMetrics    = flag.String("route_metrics", "", "URL of the OLSR routes (jsoninfo) to read link quality from. Usually: http://localnode.local.mesh:9090/routes")
+	babelSocket     = flag.String("babel_socket", "", "Path to the local control socket of babeld to read link quality from. Usually: /var/run/babel.sock")
 	daemonize       = flag.Bool("server", false, "Phonebook acts as a server when set to true.")
 	ldapServer      = flag.Bool("ldap_server", false, "Phonebook also runs an LDAP server when in server mode.")
 	sipServer       = flag.Bool("sip_server", false, "Phonebook also runs a SIP server when in server mode.")
@@ -62,15 +72,42 @@ var (
 	ldapPort   = flag.Int("ldap_port", 3890, "Port to listen on for the LDAP server (when running as a server AND LDAP server is on as well).")
 	ldapUser   = flag.String("ldap_user", "aredn", "Username to provide to connect to the LDAP server.")
 	ldapPwd    = flag.String("ldap_pwd", "aredn", "Password to provide to connect to the LDAP server.")
+	ldapBaseDN = flag.String("ldap_base_dn", "", "Base DN of the LDAP directory (entries are returned below any base DN searched when empty).")
+	ldapsPort  = flag.Int("ldaps_port", 0, "Port to listen on for LDAPS (LDAP over TLS). 0 disables LDAPS.")
+	ldapTLS    = flag.Bool("ldap_starttls", false, "Offers StartTLS on the LDAP port.")
+	ldapCert   = flag.String("ldap_cert", "", "Path to the certificate (PEM) for LDAPS/StartTLS. A self-signed one is generated next to the cache when not set.")
+	ldapKey    = flag.String("ldap_key", "", "Path to the private key (PEM) of -ldap_cert.")
+	ldapAnon   = flag.Bool("ldap_anonymous", true, "Allows anonymous binds to the LDAP server (active entries without IPs only).")
+	ldapHash   = flag.Bool("ldap_hash_password", false, "Reads a password from stdin, prints its hash for use in LDAP accounts and exits.")
 	sipPort    = flag.Int("sip_port", 5060, "Port to listen on for SIP traffic (when running as a server AND SIP server is on as well).")
+	sipMode    = flag.String("sip_mode", "redirect", "How the SIP server hands over calls. Supported: redirect,proxy")
+	sipMinExp  = flag.Int("sip_min_expires", configuration.DefaultSIPMinExpires, "Minimal SIP registration expiry in seconds accepted from clients.")
+	sipMaxExp  = flag.Int("sip_max_expires", configuration.DefaultSIPMaxExpires, "Maximal SIP registration expiry in seconds granted to clients.")
+	sipAuth    = flag.String("sip_auth", "none", "Which SIP requests need to be authenticated for extensions with credentials. Supported: none,register,all")
+	sipCreds   = flag.String("sip_credentials", "", "Path to the JSON file with SIP credentials per extension.")
+	sipTrans   = flag.String("sip_transports", "udp", "Comma separated list of transports to run the SIP server on. Supported: udp,tcp")
+	sipGroups  = flag.String("sip_groups_file", "", "Path to a CSV file with SIP hunt groups (columns: number, name, member, priority).")
+	sipProbe   = flag.Duration("sip_probe", 0, "Interval in which to probe phones with a route via SIP OPTIONS (0 disables probing).")
+	sipWorkers = flag.Int("sip_workers", configuration.DefaultSIPWorkers, "Number of workers handling SIP messages (bounds CPU usage under load).")
+	sipRate    = flag.Int("sip_rate_limit", configuration.DefaultSIPRateLimit, "SIP messages per second accepted from a single source. Sources flooding the server are banned temporarily.")
+	sipAllow   = flag.String("sip_allow", "", "Comma separated list of IPs/CIDRs allowed to use the SIP server (empty allows all).")
+	sipDeny    = flag.String("sip_deny", "", "Comma separated list of IPs/CIDRs denied from using the SIP server (takes precedence over sip_allow).")
+	sipCDR     = flag.Bool("sip_cdr", false, "Record calls and messages handled by the SIP server (call detail records) next to the cache.")
+	sipPeers   = flag.String("sip_peers", "", "Comma separated list of other phonebook servers (hosts or URLs) to exchange SIP registrations with.")
+	sipDisc    = flag.Bool("sip_peer_discovery", false, "Also exchange SIP registrations with phonebook servers advertised as services in sysinfo.")
+	sipFedKey  = flag.String("sip_federation_key", "", "Shared key phonebook servers need to present to exchange SIP registrations.")
 	updateURLs = flag.String("update_urls", "", "Comma separated list of URLs to pull optional information from. Used for update notifications and such.")
 )
 
 const (
 	defaultExtension = ".xml"
 	sysInfoReload    = 5 * time.Minute
+	sysInfoMaxAge    = 3 * sysInfoReload // older sysinfo is not used for routing data
 	updateInfoReload = 24 * time.Hour
 	httpTimeout      = 10 * time.Second
+
+	// Interval to persist SIP registrations in (only written when changed).
+	registrationsSnapshot = 5 * time.Minute
 )
 
 var (
@@ -136,6 +173,24 @@ func mergePhonebookWithRouting(records []*data.Entry, hostData map[string]*data.
 	return append(records, routableEntries...)
 }
 
+// routeSources returns the configured sources of routing data in the order they're tried.
+func routeSources(cfg *configuration.Config) []route.Source {
+	var srcs []route.Source
+	for _, name := range cfg.GetRouteSources() {
+		switch name {
+		case configuration.RouteSourceSysInfo:
+			if cfg.SysInfoURL != "" {
+				srcs = append(srcs, &route.SysInfo{RuntimeInfo: runtimeInfo, MaxAge: sysInfoMaxAge})
+			}
+		case configuration.RouteSourceOLSR:
+			srcs = append(srcs, &route.OLSR{Path: cfg.GetOLSRFile()})
+		case configuration.RouteSourceBabel:
+			srcs = append(srcs, &route.Babel{Path: cfg.GetBabelHosts()})
+		}
+	}
+	return srcs
+}
+
 func refreshSysinfo(cfg *configuration.Config, client *http.Client) error {
 	si, err := importer.ReadSysInfoFromURL(cfg.SysInfoURL, client)
 	if err != nil {
@@ -148,6 +203,41 @@ func refreshSysinfo(cfg *configuration.Config, client *http.Client) error {
 	return nil
 }
 
+// discoverPeers returns the hosts from sysinfo advertising a phonebook service.
+func discoverPeers() []string {
+	runtimeInfo.Mu.RLock()
+	defer runtimeInfo.Mu.RUnlock()
+	if runtimeInfo.SysInfo == nil {
+		return nil
+	}
+	return route.ReadPeersFromSysInfo(runtimeInfo.SysInfo)
+}
+
+// refreshRouteMetrics reads the link metrics of the routes from OLSR and/or
+// Babel (nodes can run both while migrating).
+func refreshRouteMetrics(cfg *configuration.Config, client *http.Client) error {
+	var metrics []*data.RouteMetric
+	var errs []error
+	if cfg.RouteMetricsURL != "" {
+		m, err := importer.ReadRouteMetricsFromURL(cfg.RouteMetricsURL, client)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error reading route metrics from %q: %s", cfg.RouteMetricsURL, err))
+		}
+		metrics = append(metrics, m...)
+	}
+	if cfg.BabelSocket != "" {
+		m, err := route.ReadBabelMetrics(cfg.BabelSocket)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error reading route metrics from %q: %s", cfg.BabelSocket, err))
+		}
+		metrics = append(metrics, m...)
+	}
+	runtimeInfo.Mu.Lock()
+	defer runtimeInfo.Mu.Unlock()
+	runtimeInfo.RouteMetrics = metrics
+	return errors.Join(errs...)
+}
+
 func refreshUpdates(cfg *configuration.Config, client *http.Client) error {
 	u, _ := importer.ReadUpdatesFromURL(cfg.UpdateURLs, client)
 	if u == nil {
@@ -206,24 +296,37 @@ func refreshRecords(cfg *configuration.Config, client *http.Client) (string, err
 		return "", fmt.Errorf("error reading phonebook: %s", err)
 	}
 
-	runtimeInfo.Mu.Lock()
-	defer runtimeInfo.Mu.Unlock()
-	var hostData map[string]*data.RouteEntry
-	switch {
-	case runtimeInfo.SysInfo == nil:
-		fmt.Println("not reading network information: sysinfo not available")
-
-	case runtimeInfo.SysInfo != nil:
-		hostData, err = route.ReadFromSysInfo(runtimeInfo.SysInfo)
-		if err != nil {
-			fmt.Printf("error reading OLSR data from sysinfo: %s\n", err)
-		}
+	hostData, src, err := route.Read(routeSources(cfg))
+	if err != nil {
+		fmt.Printf("not reading network information: %s\n", err)
+	} else if cfg.Debug {
+		fmt.Printf("Read routing data for %d hosts from %s\n", len(hostData), src)
+	}
+	runtimeInfo.Mu.RLock()
+	route.ApplyMetrics(hostData, runtimeInfo.RouteMetrics)
+	if runtimeInfo.SysInfo != nil {
+		route.ApplyLinkInfo(hostData, runtimeInfo.SysInfo.LinkInfo)
 	}
+	runtimeInfo.Mu.RUnlock()
 
 	rec = mergePhonebookWithRouting(rec, hostData, cfg)
 
 	records.Mu.Lock()
 	defer records.Mu.Unlock()
+	// Keep the reachability of phones until they are probed again.
+	reachability := make(map[string]*data.Reachability)
+	for _, e := range records.Entries {
+		if e.Reachability != nil {
+			reachability[e.PhoneNumber] = e.Reachability
+		}
+	}
+	for _, e := range rec {
+		if e.Route != nil {
+			e.Reachability = reachability[e.PhoneNumber]
+		}
+	}
+	// Sorted (active first) before being shared so readers never need to reorder the records.
+	sort.Sort(data.ByName(rec))
 	records.Entries = rec
 	records.Updated = time.Now()
 
@@ -233,7 +336,6 @@ func refreshRecords(cfg *configuration.Config, client *http.Client) (string, err
 func exportOnce(cfg *configuration.Config) error {
 	records.Mu.RLock()
 	defer records.Mu.RUnlock()
-	sort.Sort(data.ByName(records.Entries))
 
 	for _, outTgt := range cfg.Targets {
 		if cfg.Debug {
@@ -344,18 +446,55 @@ func runServer(ctx context.Context, cfg *configuration.Config, cfgPath string, c
 			Config:  cfg,
 			Records: records,
 		}
+		if cfg.LDAPUser != "" && len(cfg.LDAPAccounts) > 0 {
+			fmt.Printf("LDAP user %q is disabled as LDAP accounts are configured\n", cfg.LDAPUser)
+		}
 		s := ldapserver.NewServer()
 		s.Bind = ldapSrv.Bind
 		s.Search = ldapSrv.Search
 
+		// StartTLS is handled by the listener of the LDAP port.
+		var startTLS *tls.Config
+		if cfg.IsLDAPTLS() {
+			tlsCfg, err := ldapSrv.TLSConfig()
+			if err != nil {
+				return fmt.Errorf("unable to set up TLS for the LDAP server: %s", err)
+			}
+			if cfg.LDAPStartTLS {
+				startTLS = tlsCfg
+			}
+			if cfg.LDAPSPort > 0 {
+				ln, err := tls.Listen("tcp", fmt.Sprintf(":%d", cfg.LDAPSPort), tlsCfg)
+				if err != nil {
+					return fmt.Errorf("unable to listen for LDAPS: %s", err)
+				}
+				go func() {
+					if err := s.Serve(ldapSrv.Listener(ln, nil)); err != nil {
+						fmt.Printf("LDAPS server failed: %s\n", err)
+					}
+				}()
+			}
+		}
+
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.LDAPPort))
+		if err != nil {
+			return fmt.Errorf("unable to listen for LDAP: %s", err)
+		}
 		go func() {
-			if err := s.ListenAndServe(fmt.Sprintf(":%d", cfg.LDAPPort)); err != nil {
+			if err := s.Serve(ldapSrv.Listener(ln, startTLS)); err != nil {
 				fmt.Printf("LDAP server failed: %s\n", err)
 			}
 		}()
 	}
 
 	var sipSrv *sip.Server
+	var deliverMessage server.DeliverMessage
+	var prepareForwardingRule server.PrepareForwardingRule
+	var registerCache *data.TTLCache[string, *data.SIPClient]
+	var messages *data.Messages
+	var forwarding *data.Forwarding
+	var sipStats *data.SIPStats
+	var federated *data.TTLCache[string, *data.FederatedRegistration]
 	if cfg.SIPServer {
 		identities, err := getLocalIdentities()
 		if err != nil {
@@ -369,28 +508,151 @@ func runServer(ctx context.Context, cfg *configuration.Config, cfgPath string, c
 				fmt.Printf("  - %s\n", k)
 			}
 		}
+		var credentials map[string]*data.SIPCredential
+		if cfg.SIPCredsFile != "" {
+			if credentials, err = importer.ReadSIPCredentials(cfg.SIPCredsFile); err != nil {
+				return fmt.Errorf("unable to read SIP credentials from %q: %s", cfg.SIPCredsFile, err)
+			}
+			if cfg.Debug {
+				fmt.Printf("read SIP credentials for %d extensions\n", len(credentials))
+			}
+		}
+		groups := make(map[string]*data.HuntGroup)
+		for _, g := range cfg.SIPGroups {
+			groups[g.Number] = g
+		}
+		if cfg.SIPGroupsFile != "" {
+			gs, err := importer.ReadHuntGroups(cfg.SIPGroupsFile)
+			if err != nil {
+				return fmt.Errorf("unable to read SIP hunt groups from %q: %s", cfg.SIPGroupsFile, err)
+			}
+			if err := configuration.ValidateSIPGroups(gs); err != nil {
+				return err
+			}
+			for _, g := range gs {
+				groups[g.Number] = g
+			}
+		}
+		if cfg.Debug && len(groups) > 0 {
+			fmt.Printf("using %d SIP hunt groups\n", len(groups))
+		}
 		sipSrv = &sip.Server{
 			Config:          cfg,
 			Records:         records,
 			RegisterCache:   data.NewTTL[string, *data.SIPClient](),
 			LocalIdentities: identities,
+			Credentials:     credentials,
+			Groups:          make(map[string]*data.HuntGroup),
+			Forwarding:      &data.Forwarding{Mu: &sync.RWMutex{}},
+			Messages:        &data.Messages{Mu: &sync.RWMutex{}},
+			Stats:           &data.SIPStats{Mu: &sync.RWMutex{}},
+			Federated:       data.NewTTL[string, *data.FederatedRegistration](),
+		}
+		for _, g := range groups {
+			sipSrv.PrepareHuntGroup(g)
+			sipSrv.Groups[g.Number] = g
+		}
+		deliverMessage = sipSrv.DeliverMessage
+		prepareForwardingRule = sipSrv.PrepareForwardingRule
+		registerCache = sipSrv.RegisterCache
+		messages = sipSrv.Messages
+		forwarding = sipSrv.Forwarding
+		sipStats = sipSrv.Stats
+		federated = sipSrv.Federated
+
+		if path := cfg.GetForwardingPath(); path != "" {
+			if err := forwarding.Load(path); err != nil {
+				if !os.IsNotExist(err) {
+					fmt.Printf("unable to read call forwarding rules from %q: %s\n", path, err)
+				}
+			} else {
+				for _, r := range forwarding.Rules {
+					if err := sipSrv.PrepareForwardingRule(r); err != nil {
+						fmt.Printf("call forwarding rule %s for %s won't apply: %s\n", r.ID, r.Number, err)
+					}
+				}
+				if cfg.Debug {
+					fmt.Printf("read %d call forwarding rules from %q\n", len(forwarding.Rules), path)
+				}
+			}
 		}
 
-		go func() {
+		if path := cfg.GetMessagesPath(); path != "" {
+			if err := sipSrv.LoadMessages(path); err != nil {
+				if !os.IsNotExist(err) {
+					fmt.Printf("unable to restore SIP messages from %q: %s\n", path, err)
+				}
+			} else if cfg.Debug {
+				fmt.Printf("restored %d pending SIP messages from %q\n", len(messages.Pending), path)
+			}
+		}
+
+		// Restored before listening so fresh registrations aren't overwritten.
+		if path := cfg.GetRegistrationsPath(); path != "" {
+			if n, err := sipSrv.LoadRegistrations(path); err != nil {
+				if !os.IsNotExist(err) {
+					fmt.Printf("unable to restore SIP registrations from %q: %s\n", path, err)
+				}
+			} else if cfg.Debug {
+				fmt.Printf("restored %d SIP registrations from %q\n", n, path)
+			}
+		}
+
+		// Listen before starting the workers so they can send via UDP.
+		for _, proto := range cfg.GetSIPTransports() {
+			proto := strings.ToLower(strings.TrimSpace(proto))
 			if cfg.Debug {
-				fmt.Println("Starting SIP Listener")
+				fmt.Printf("Starting SIP Listener (%s)\n", proto)
 			}
-			if err := sipSrv.ListenAndServe(ctx, "udp", fmt.Sprintf(":%d", cfg.SIPPort)); err != nil {
-				fmt.Printf("SIP server failed: %s\n", err)
+			if err := sipSrv.Listen(ctx, proto, fmt.Sprintf(":%d", cfg.SIPPort)); err != nil {
+				return fmt.Errorf("unable to start SIP server (%s): %s", proto, err)
 			}
-		}()
+		}
+
+		go sipSrv.RunMessageQueue()
+		go sipSrv.RunPresence()
+		if cfg.SIPProbe > 0 {
+			go sipSrv.RunProber(cfg.SIPProbe)
+		}
+		if cfg.IsSIPFederated() {
+			go sipSrv.RunFederation(client, discoverPeers)
+		}
+
+		if path := cfg.GetRegistrationsPath(); path != "" {
+			go func() {
+				for {
+					time.Sleep(registrationsSnapshot)
+					if err := sipSrv.SaveRegistrations(path); err != nil {
+						fmt.Printf("unable to persist SIP registrations to %q: %s\n", path, err)
+					}
+				}
+			}()
+
+			// Persist the latest registrations when being stopped (e.g. node reboot).
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+			go func() {
+				<-sigs
+				if err := sipSrv.SaveRegistrations(path); err != nil {
+					fmt.Printf("unable to persist SIP registrations to %q: %s\n", path, err)
+				}
+				os.Exit(0)
+			}()
+		}
 	}
 
-	if cfg.SysInfoURL != "" {
+	if cfg.SysInfoURL != "" || cfg.RouteMetricsURL != "" || cfg.BabelSocket != "" {
 		go func() {
 			for {
-				if err := refreshSysinfo(cfg, client); err != nil {
-					fmt.Printf("error refreshing sysinfo: %s\n", err)
+				if cfg.SysInfoURL != "" {
+					if err := refreshSysinfo(cfg, client); err != nil {
+						fmt.Printf("error refreshing sysinfo: %s\n", err)
+					}
+				}
+				if cfg.RouteMetricsURL != "" || cfg.BabelSocket != "" {
+					if err := refreshRouteMetrics(cfg, client); err != nil {
+						fmt.Printf("error refreshing route metrics: %s\n", err)
+					}
 				}
 				time.Sleep(sysInfoReload)
 			}
@@ -401,6 +663,10 @@ func runServer(ctx context.Context, cfg *configuration.Config, cfgPath string, c
 		for {
 			if updatedFrom, err := refreshRecordsAndExport(cfg, client); err == nil {
 				fmt.Printf("Updated phonebook records from %q\n", updatedFrom)
+				if sipSrv != nil {
+					// Recipients of queued messages might be reachable now.
+					go sipSrv.FlushRoutableMessages()
+				}
 			} else {
 				fmt.Printf("error refreshing and exporting phone records: %s\n", err)
 			}
@@ -428,7 +694,7 @@ func runServer(ctx context.Context, cfg *configuration.Config, cfgPath string, c
 			return err
 		}
 		tmpls := template.Must(template.ParseFS(webFS, "templates/*.html"))
-		srv := server.NewServer(cfg, cfgPath, ver, records, runtimeInfo, exporters, updates, refreshRecordsAndExport, sipSrv.SendSIPMessage, sipSrv.RegisterCache, tmpls, client)
+		srv := server.NewServer(cfg, cfgPath, ver, records, runtimeInfo, exporters, updates, refreshRecordsAndExport, deliverMessage, prepareForwardingRule, registerCache, messages, forwarding, sipStats, federated, tmpls, client)
 		http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(resFS))))
 		http.HandleFunc("/", srv.Index)
 		http.HandleFunc("/index.html", srv.Index)
@@ -436,17 +702,26 @@ func runServer(ctx context.Context, cfg *configuration.Config, cfgPath string, c
 		http.HandleFunc("/phonebook", srv.ServePhonebook)
 		http.HandleFunc("/showconfig", srv.ShowConfig)
 		http.HandleFunc("/reload", srv.ReloadPhonebook)
+		if cfg.SIPServer && cfg.IsSIPFederated() {
+			http.HandleFunc(data.FederationPath, srv.Registrations) // signed with the federation key
+		}
 		if cfg.WebUser != "" && cfg.WebPwd != "" {
 			if cfg.Debug {
 				fmt.Println("protecting most web endpoints with configured basicAuth user/pwd")
 			}
 			http.HandleFunc("/message", srv.BasicAuth(srv.SendMessage))
+			http.HandleFunc("/messages", srv.BasicAuth(srv.ShowMessages))
+			http.HandleFunc("/forwarding", srv.BasicAuth(srv.CallForwarding))
+			http.HandleFunc("/cdr", srv.BasicAuth(srv.CallDetailRecords))
 			http.HandleFunc("/updateconfig", srv.BasicAuth(srv.UpdateConfig))
 		} else {
 			if cfg.Debug {
 				fmt.Println("not protecting any of the web endpoints with basicAuth as not both user/pwd were set")
 			}
 			http.HandleFunc("/message", srv.SendMessage)
+			http.HandleFunc("/messages", srv.ShowMessages)
+			http.HandleFunc("/forwarding", srv.CallForwarding)
+			http.HandleFunc("/cdr", srv.CallDetailRecords)
 			http.HandleFunc("/updateconfig", srv.UpdateConfig)
 		}
 		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
@@ -464,8 +739,16 @@ func runServer(ctx context.Context, cfg *configuration.Config, cfgPath string, c
 }
 
 func runLocal(cfg *configuration.Config, client *http.Client) error {
-	if err := refreshSysinfo(cfg, client); err != nil {
-		return err
+	if cfg.SysInfoURL != "" {
+		// Routing data can still come from other sources.
+		if err := refreshSysinfo(cfg, client); err != nil {
+			fmt.Printf("error refreshing sysinfo: %s\n", err)
+		}
+	}
+	if cfg.RouteMetricsURL != "" || cfg.BabelSocket != "" {
+		if err := refreshRouteMetrics(cfg, client); err != nil {
+			fmt.Printf("error refreshing route metrics: %s\n", err)
+		}
 	}
 	if updatedFrom, err := refreshRecords(cfg, client); err == nil {
 		fmt.Printf("Updated phonebook records from %q\n", updatedFrom)
@@ -479,10 +762,36 @@ func runLocal(cfg *configuration.Config, client *http.Client) error {
 	return nil
 }
 
+// printLDAPPasswordHash reads a password from stdin and prints its hash to be
+// used in the LDAP accounts of the config.
+func printLDAPPasswordHash() error {
+	pw, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && pw == "" {
+		return err
+	}
+	pw = strings.TrimRight(pw, "\r\n")
+	if pw == "" {
+		return errors.New("empty password")
+	}
+	hashed, err := data.HashLDAPPassword(pw)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hashed)
+	return nil
+}
+
 func main() {
 	ctx := context.Background()
 	// Parse flags globally.
 	flag.Parse()
+	if *ldapHash {
+		if err := printLDAPPasswordHash(); err != nil {
+			fmt.Printf("unable to hash password: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	fmt.Printf("phonebook starting %q\n", Version)
 
 	records = &data.Records{
@@ -507,12 +816,18 @@ func main() {
 			os.Exit(1)
 		} else {
 			c.Reload = time.Duration(c.ReloadSeconds) * time.Second
+			c.SIPProbe = time.Duration(c.SIPProbeSeconds) * time.Second
 			cfg = c
 		}
 	} else {
 		cfg = &configuration.Config{
 			Sources:                     strings.Split(*sources, ","),
 			SysInfoURL:                  *sysInfoURL,
+			RouteSources:                strings.Split(*routeSrcs, ","),
+			OLSRFile:                    *olsrFile,
+			BabelHosts:                  *babelHosts,
+			RouteMetricsURL:             *routeMetrics,
+			BabelSocket:                 *babelSocket,
 			Server:                      *daemonize,
 			LDAPServer:                  *ldapServer,
 			SIPServer:                   *sipServer,
@@ -538,7 +853,29 @@ func main() {
 			LDAPPort:                    *ldapPort,
 			LDAPUser:                    *ldapUser,
 			LDAPPwd:                     *ldapPwd,
+			LDAPBaseDN:                  *ldapBaseDN,
+			LDAPSPort:                   *ldapsPort,
+			LDAPStartTLS:                *ldapTLS,
+			LDAPCert:                    *ldapCert,
+			LDAPKey:                     *ldapKey,
+			LDAPAnonymous:               ldapAnon,
 			SIPPort:                     *sipPort,
+			SIPMode:                     *sipMode,
+			SIPTransports:               strings.Split(*sipTrans, ","),
+			SIPMinExpires:               *sipMinExp,
+			SIPMaxExpires:               *sipMaxExp,
+			SIPAuth:                     *sipAuth,
+			SIPCredsFile:                *sipCreds,
+			SIPProbe:                    *sipProbe,
+			SIPGroupsFile:               *sipGroups,
+			SIPWorkers:                  *sipWorkers,
+			SIPRateLimit:                *sipRate,
+			SIPAllow:                    strings.Split(*sipAllow, ","),
+			SIPDeny:                     strings.Split(*sipDeny, ","),
+			SIPCDR:                      *sipCDR,
+			SIPPeers:                    strings.Split(*sipPeers, ","),
+			SIPPeerDiscovery:            *sipDisc,
+			SIPFederationKey:            *sipFedKey,
 		}
 	}
 	// Detect when flag is set to run as a server even when reading config.
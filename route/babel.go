@@ -0,0 +1,82 @@
+package route
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arednch/phonebook/data"
+)
+
+const (
+	babelTimeout = 5 * time.Second
+	// Cost of a perfect wireless link in Babel, used to scale metrics to ETX.
+	babelUnitCost = 256
+	// Metric of unreachable routes in Babel.
+	babelInfinity = 0xFFFF
+)
+
+// ReadBabelMetrics reads the installed routes from the local control socket of babeld.
+func ReadBabelMetrics(path string) ([]*data.RouteMetric, error) {
+	conn, err := net.DialTimeout("unix", path, babelTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(babelTimeout))
+
+	if _, err := io.WriteString(conn, "dump\nquit\n"); err != nil {
+		return nil, err
+	}
+	return parseBabelDump(conn)
+}
+
+// parseBabelDump parses the routes from the output of a babeld dump, e.g.:
+//
+//	add route 5615e6e0 prefix 10.1.2.8/29 from 0.0.0.0/0 installed yes id 02:11:22:ff:fe:33:44:55 metric 512 price 512 refmetric 256 via fe80::1 if wlan0
+func parseBabelDump(r io.Reader) ([]*data.RouteMetric, error) {
+	var metrics []*data.RouteMetric
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != "add" || fields[1] != "route" {
+			continue
+		}
+		kv := make(map[string]string)
+		for i := 3; i+1 < len(fields); i += 2 {
+			kv[fields[i]] = fields[i+1]
+		}
+		if kv["installed"] != "yes" {
+			continue
+		}
+		pfx, err := netip.ParsePrefix(kv["prefix"])
+		if err != nil {
+			continue
+		}
+		metric, err := strconv.Atoi(kv["metric"])
+		if err != nil || metric >= babelInfinity {
+			continue
+		}
+		addr := pfx.Addr()
+		bits := pfx.Bits()
+		if addr.Is4In6() {
+			addr = addr.Unmap()
+			bits -= 96
+		}
+		if bits < 0 {
+			continue
+		}
+		metrics = append(metrics, &data.RouteMetric{
+			Destination: addr.String(),
+			Genmask:     bits,
+			Gateway:     kv["via"],
+			ETX:         float64(metric) / babelUnitCost,
+			Interface:   kv["if"],
+		})
+	}
+	return metrics, scanner.Err()
+}
@@ -0,0 +1,74 @@
+package route
+
+import (
+	"bufio"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/arednch/phonebook/data"
+)
+
+// ReadFromHosts reads routing data from a file in hosts format (IP followed by
+// hostnames, comments start with #), as written by OLSR or for dnsmasq. When
+// the path is a folder, all files in it are read.
+func ReadFromHosts(path string) (map[string]*data.RouteEntry, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if fi.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		files = nil
+		for _, e := range entries {
+			if e.Type().IsRegular() {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+	}
+
+	d := map[string]*data.RouteEntry{}
+	for _, f := range files {
+		if err := readHostsFile(f, d); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func readHostsFile(path string, d map[string]*data.RouteEntry) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = strings.TrimSuffix(strings.ToLower(name), "."+data.AREDNDomain)
+			if filterNonPhones && !phoneHostnameRE.MatchString(name) {
+				continue
+			}
+			d[name] = &data.RouteEntry{
+				IP:       ip.String(),
+				Hostname: name,
+			}
+		}
+	}
+	return scanner.Err()
+}
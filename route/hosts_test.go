@@ -0,0 +1,59 @@
+package route
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/arednch/phonebook/data"
+)
+
+func TestReadFromHosts(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"olsr": "# comment\n10.0.0.1\t100 100.local.mesh # phone\n10.0.0.2 node-1\n",
+		"dtd":  "10.0.0.3 200.LOCAL.MESH\ninvalid 300\n10.0.0.4\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		path    string
+		want    map[string]*data.RouteEntry
+		wantErr bool
+	}{
+		{
+			name: "file",
+			path: filepath.Join(dir, "olsr"),
+			want: map[string]*data.RouteEntry{"100": {IP: "10.0.0.1", Hostname: "100"}},
+		},
+		{
+			name: "folder",
+			path: dir,
+			want: map[string]*data.RouteEntry{
+				"100": {IP: "10.0.0.1", Hostname: "100"},
+				"200": {IP: "10.0.0.3", Hostname: "200"},
+			},
+		},
+		{name: "missing", path: filepath.Join(dir, "missing"), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ReadFromHosts(tc.path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ReadFromHosts() error = %v, wantErr %t", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ReadFromHosts() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -1,13 +1,19 @@
 package route
 
 import (
+	"net/netip"
+	"net/url"
 	"regexp"
+	"strings"
 
 	"github.com/arednch/phonebook/data"
 )
 
 const (
 	filterNonPhones = true
+
+	// Services advertised by phonebook servers contain this in their name.
+	phonebookService = "phonebook"
 )
 
 var (
@@ -30,3 +36,75 @@ func ReadFromSysInfo(sysinfo *data.SysInfo) (map[string]*data.RouteEntry, error)
 
 	return d, nil
 }
+
+// ReadPeersFromSysInfo returns the hosts (with the port of their web server)
+// advertising a phonebook service on the mesh, i.e. other phonebook servers.
+func ReadPeersFromSysInfo(sysinfo *data.SysInfo) []string {
+	var peers []string
+	for _, svc := range sysinfo.Services {
+		if !strings.Contains(strings.ToLower(svc.Name), phonebookService) {
+			continue
+		}
+		u, err := url.Parse(svc.Link)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		peers = append(peers, u.Host)
+	}
+	return peers
+}
+
+// ApplyMetrics adds the link metrics of the most specific route covering each
+// host, i.e. the route to the node the host is attached to. Hosts without a
+// matching route keep unknown metrics.
+func ApplyMetrics(routes map[string]*data.RouteEntry, metrics []*data.RouteMetric) {
+	var pfxs []netip.Prefix
+	var ms []*data.RouteMetric
+	for _, m := range metrics {
+		ip, err := netip.ParseAddr(m.Destination)
+		if err != nil {
+			continue
+		}
+		pfx, err := ip.Unmap().Prefix(m.Genmask)
+		if err != nil {
+			continue
+		}
+		pfxs = append(pfxs, pfx)
+		ms = append(ms, m)
+	}
+
+	for _, r := range routes {
+		ip, err := netip.ParseAddr(r.IP)
+		if err != nil {
+			continue
+		}
+		ip = ip.Unmap()
+		var best *data.RouteMetric
+		bits := -1
+		for i, pfx := range pfxs {
+			if pfx.Contains(ip) && pfx.Bits() > bits {
+				best, bits = ms[i], pfx.Bits()
+			}
+		}
+		if best != nil {
+			r.Hops = best.Hops
+			r.ETX = best.ETX
+		}
+	}
+}
+
+// ApplyLinkInfo adds the link quality of direct neighbors (sysinfo link_info
+// only covers those) to the hosts which didn't get metrics from a route.
+// The number of hops is left unknown.
+func ApplyLinkInfo(routes map[string]*data.RouteEntry, links map[string]*data.LinkInfo) {
+	for _, r := range routes {
+		if r.ETX > 0 {
+			continue
+		}
+		l, ok := links[r.IP]
+		if !ok || l.ETX() == 0 {
+			continue
+		}
+		r.ETX = l.ETX()
+	}
+}
@@ -0,0 +1,113 @@
+package route
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/arednch/phonebook/data"
+)
+
+func TestReadPeersFromSysInfo(t *testing.T) {
+	sysinfo := &data.SysInfo{
+		Services: []*data.Service{
+			{Name: "Phonebook", Protocol: "http", Link: "http://node-1.local.mesh:8081/phonebook"},
+			{Name: "Chat", Protocol: "http", Link: "http://node-2.local.mesh:8080/chat"},
+			{Name: "phonebook (backup)", Protocol: "http", Link: "http://10.0.0.3/"},
+			{Name: "phonebook", Protocol: "http", Link: "/relative"},
+		},
+	}
+	want := []string{"node-1.local.mesh:8081", "10.0.0.3"}
+	if diff := cmp.Diff(want, ReadPeersFromSysInfo(sysinfo)); diff != "" {
+		t.Errorf("ReadPeersFromSysInfo() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestApplyMetrics(t *testing.T) {
+	metrics := []*data.RouteMetric{
+		{Destination: "10.0.0.0", Genmask: 8, Hops: 5, ETX: 9},
+		{Destination: "10.1.2.0", Genmask: 24, Hops: 2, ETX: 3.5},
+		{Destination: "10.1.2.8", Genmask: 29, Hops: 1, ETX: 1.5},
+		{Destination: "::ffff:10.2.0.0", Genmask: 16, Hops: 3, ETX: 4},
+		{Destination: "invalid", Genmask: 32, Hops: 1, ETX: 1},
+	}
+	for _, tc := range []struct {
+		name     string
+		ip       string
+		wantHops int
+		wantETX  float64
+	}{
+		{name: "most specific route", ip: "10.1.2.9", wantHops: 1, wantETX: 1.5},
+		{name: "less specific route", ip: "10.1.2.20", wantHops: 2, wantETX: 3.5},
+		{name: "default route of the mesh", ip: "10.9.9.9", wantHops: 5, wantETX: 9},
+		{name: "v4-mapped route", ip: "10.2.3.4", wantHops: 3, wantETX: 4},
+		{name: "v4-mapped host", ip: "::ffff:10.1.2.9", wantHops: 1, wantETX: 1.5},
+		{name: "no route", ip: "192.168.1.1"},
+		{name: "invalid IP", ip: "phone"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			routes := map[string]*data.RouteEntry{"100": {IP: tc.ip, Hostname: "100"}}
+			ApplyMetrics(routes, metrics)
+			if got := routes["100"]; got.Hops != tc.wantHops || got.ETX != tc.wantETX {
+				t.Errorf("ApplyMetrics() = hops %d, ETX %g, want hops %d, ETX %g", got.Hops, got.ETX, tc.wantHops, tc.wantETX)
+			}
+		})
+	}
+}
+
+func TestApplyLinkInfo(t *testing.T) {
+	links := map[string]*data.LinkInfo{
+		"10.0.0.1": {LinkQuality: 1, NeighborLinkQuality: 0.5},
+		"10.0.0.2": {LinkQuality: 1, NeighborLinkQuality: 1},
+		"10.0.0.3": {LinkQuality: 0, NeighborLinkQuality: 1},
+	}
+	for _, tc := range []struct {
+		name    string
+		route   *data.RouteEntry
+		wantETX float64
+	}{
+		{name: "neighbor", route: &data.RouteEntry{IP: "10.0.0.1"}, wantETX: 2},
+		{name: "metrics from route", route: &data.RouteEntry{IP: "10.0.0.2", Hops: 2, ETX: 3}, wantETX: 3},
+		{name: "unknown link quality", route: &data.RouteEntry{IP: "10.0.0.3"}},
+		{name: "not a neighbor", route: &data.RouteEntry{IP: "10.0.0.4"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hops := tc.route.Hops
+			ApplyLinkInfo(map[string]*data.RouteEntry{"100": tc.route}, links)
+			if tc.route.ETX != tc.wantETX {
+				t.Errorf("ApplyLinkInfo() ETX = %g, want %g", tc.route.ETX, tc.wantETX)
+			}
+			if tc.route.Hops != hops {
+				t.Errorf("ApplyLinkInfo() changed hops to %d", tc.route.Hops)
+			}
+		})
+	}
+}
+
+func TestParseBabelDump(t *testing.T) {
+	dump := strings.Join([]string{
+		"BABEL 1.0",
+		"version babeld-1.13.1",
+		"add interface wlan0 up true ipv6 fe80::1 ipv4 10.1.2.1",
+		"add neighbour 1 address fe80::2 if wlan0 reach ffff rxcost 256 txcost 256 cost 256",
+		"add route 1 prefix 10.1.2.8/29 from 0.0.0.0/0 installed yes id 02:11:22:ff:fe:33:44:55 metric 512 price 512 refmetric 256 via fe80::2 if wlan0",
+		"add route 2 prefix 10.1.3.0/24 from 0.0.0.0/0 installed no id 02:11:22:ff:fe:33:44:66 metric 768 price 768 refmetric 512 via fe80::3 if wlan0",
+		"add route 3 prefix 10.1.4.0/24 from 0.0.0.0/0 installed yes id 02:11:22:ff:fe:33:44:77 metric 65535 price 65535 refmetric 65535 via fe80::2 if wlan0",
+		"add route 4 prefix ::ffff:10.1.5.0/120 from ::/0 installed yes id 02:11:22:ff:fe:33:44:88 metric 384 price 384 refmetric 128 via fe80::4 if eth0",
+		"add route 5 prefix invalid from 0.0.0.0/0 installed yes metric 256 via fe80::2 if wlan0",
+		"add xroute 10.1.2.0/29-0.0.0.0/0 prefix 10.1.2.0/29 from 0.0.0.0/0 metric 0",
+		"ok",
+	}, "\n")
+	want := []*data.RouteMetric{
+		{Destination: "10.1.2.8", Genmask: 29, Gateway: "fe80::2", ETX: 2, Interface: "wlan0"},
+		{Destination: "10.1.5.0", Genmask: 24, Gateway: "fe80::4", ETX: 1.5, Interface: "eth0"},
+	}
+	got, err := parseBabelDump(strings.NewReader(dump))
+	if err != nil {
+		t.Fatalf("parseBabelDump() returned error: %s", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseBabelDump() mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,87 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/arednch/phonebook/data"
+)
+
+// Source provides routing data, i.e. the hosts currently reachable on the mesh.
+type Source interface {
+	Name() string
+	Read() (map[string]*data.RouteEntry, error)
+}
+
+// Read returns the routing data of the first source which provides any,
+// trying the sources in order. Returns the name of the source used.
+func Read(sources []Source) (map[string]*data.RouteEntry, string, error) {
+	var errs []error
+	for _, src := range sources {
+		d, err := src.Read()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", src.Name(), err))
+			continue
+		}
+		if len(d) == 0 {
+			errs = append(errs, fmt.Errorf("%s: no routes", src.Name()))
+			continue
+		}
+		return d, src.Name(), nil
+	}
+	if len(errs) == 0 {
+		return nil, "", errors.New("no route sources configured")
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// SysInfo reads routing data from the hosts in the AREDN sysinfo (refreshed elsewhere).
+type SysInfo struct {
+	RuntimeInfo *data.RuntimeInfo
+	// Sysinfo older than this is not used (0 accepts any age).
+	MaxAge time.Duration
+}
+
+func (s *SysInfo) Name() string {
+	return "sysinfo"
+}
+
+func (s *SysInfo) Read() (map[string]*data.RouteEntry, error) {
+	s.RuntimeInfo.Mu.RLock()
+	defer s.RuntimeInfo.Mu.RUnlock()
+	if s.RuntimeInfo.SysInfo == nil {
+		return nil, errors.New("sysinfo not available")
+	}
+	if s.MaxAge > 0 && time.Since(s.RuntimeInfo.Updated) > s.MaxAge {
+		return nil, fmt.Errorf("sysinfo outdated (updated %s)", s.RuntimeInfo.Updated.Format(time.RFC3339))
+	}
+	return ReadFromSysInfo(s.RuntimeInfo.SysInfo)
+}
+
+// OLSR reads routing data from the hosts file written by OLSR.
+type OLSR struct {
+	Path string
+}
+
+func (s *OLSR) Name() string {
+	return "olsr"
+}
+
+func (s *OLSR) Read() (map[string]*data.RouteEntry, error) {
+	return ReadFromHosts(s.Path)
+}
+
+// Babel reads routing data from the hosts files dnsmasq is fed with on nodes
+// using Babel. The path is either a single file or a folder of hosts files.
+type Babel struct {
+	Path string
+}
+
+func (s *Babel) Name() string {
+	return "babel"
+}
+
+func (s *Babel) Read() (map[string]*data.RouteEntry, error) {
+	return ReadFromHosts(s.Path)
+}
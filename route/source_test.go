@@ -0,0 +1,111 @@
+package route
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/arednch/phonebook/data"
+)
+
+// staticSource returns fixed routing data.
+type staticSource struct {
+	name   string
+	routes map[string]*data.RouteEntry
+	err    error
+}
+
+func (s *staticSource) Name() string {
+	return s.name
+}
+
+func (s *staticSource) Read() (map[string]*data.RouteEntry, error) {
+	return s.routes, s.err
+}
+
+func TestRead(t *testing.T) {
+	routes := map[string]*data.RouteEntry{
+		"100": {IP: "10.0.0.1", Hostname: "100"},
+	}
+	failing := &staticSource{name: "failing", err: errors.New("unavailable")}
+	empty := &staticSource{name: "empty", routes: map[string]*data.RouteEntry{}}
+	working := &staticSource{name: "working", routes: routes}
+	other := &staticSource{name: "other", routes: map[string]*data.RouteEntry{"200": {IP: "10.0.0.2", Hostname: "200"}}}
+
+	for _, tc := range []struct {
+		name       string
+		sources    []Source
+		want       map[string]*data.RouteEntry
+		wantSource string
+		wantErr    bool
+	}{
+		{name: "first source", sources: []Source{working, other}, want: routes, wantSource: "working"},
+		{name: "fallback after error", sources: []Source{failing, working}, want: routes, wantSource: "working"},
+		{name: "fallback after no routes", sources: []Source{empty, working}, want: routes, wantSource: "working"},
+		{name: "all failing", sources: []Source{failing, empty}, wantErr: true},
+		{name: "no sources", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, src, err := Read(tc.sources)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Read() error = %v, wantErr %t", err, tc.wantErr)
+			}
+			if src != tc.wantSource {
+				t.Errorf("Read() source = %q, want %q", src, tc.wantSource)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Read() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSysInfoSource(t *testing.T) {
+	sysinfo := &data.SysInfo{
+		Hosts: []*data.Host{
+			{Name: "100", IP: "10.0.0.1"},
+			{Name: "node-1", IP: "10.0.0.2"},
+		},
+	}
+	for _, tc := range []struct {
+		name    string
+		sysinfo *data.SysInfo
+		updated time.Time
+		maxAge  time.Duration
+		want    map[string]*data.RouteEntry
+		wantErr bool
+	}{
+		{
+			name:    "phones only",
+			sysinfo: sysinfo,
+			updated: time.Now(),
+			maxAge:  time.Hour,
+			want:    map[string]*data.RouteEntry{"100": {IP: "10.0.0.1", Hostname: "100"}},
+		},
+		{
+			name:    "any age",
+			sysinfo: sysinfo,
+			updated: time.Now().Add(-24 * time.Hour),
+			want:    map[string]*data.RouteEntry{"100": {IP: "10.0.0.1", Hostname: "100"}},
+		},
+		{name: "outdated", sysinfo: sysinfo, updated: time.Now().Add(-2 * time.Hour), maxAge: time.Hour, wantErr: true},
+		{name: "not available", updated: time.Now(), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := &SysInfo{
+				RuntimeInfo: &data.RuntimeInfo{Mu: &sync.RWMutex{}, Updated: tc.updated, SysInfo: tc.sysinfo},
+				MaxAge:      tc.maxAge,
+			}
+			got, err := src.Read()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Read() error = %v, wantErr %t", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Read() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arednch/phonebook/data"
+)
+
+const (
+	// Maximum number of call detail records shown on the web page (downloads are complete).
+	maxCDRShown = 500
+
+	cdrTimeLayout = "2006-01-02T15:04" // as used by datetime-local inputs
+)
+
+// parseCDRTime accepts a date (e.g. 2024-01-31) or a date with time of day (e.g. 2024-01-31T18:00).
+func parseCDRTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation(cdrTimeLayout, v, time.Local); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(time.DateOnly, v, time.Local)
+}
+
+// CallDetailRecords shows the recorded calls and messages, newest first. Records can be
+// filtered by method, from, to, status and time (since/until) and downloaded with format=csv or format=json.
+func (s *Server) CallDetailRecords(w http.ResponseWriter, r *http.Request) {
+	d := data.WebCDR{
+		WebDefault: *s.prepareDefaultData("Call Detail Records", false),
+		Since:      strings.TrimSpace(r.FormValue("since")),
+		Until:      strings.TrimSpace(r.FormValue("until")),
+		Filter: data.CDRFilter{
+			Method: strings.ToUpper(strings.TrimSpace(r.FormValue("method"))),
+			From:   strings.TrimSpace(r.FormValue("from")),
+			To:     strings.TrimSpace(r.FormValue("to")),
+		},
+	}
+
+	var errs []string
+	if v := strings.TrimSpace(r.FormValue("status")); v != "" {
+		status, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("invalid status: %q", v))
+		}
+		d.Filter.Status = status
+	}
+	var err error
+	if d.Filter.Since, err = parseCDRTime(d.Since); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid since time: %q", d.Since))
+	}
+	if d.Filter.Until, err = parseCDRTime(d.Until); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid until time: %q", d.Until))
+	}
+
+	path := s.Config.GetCDRPath()
+	var cdrs []*data.CDR
+	switch {
+	case len(errs) > 0:
+		d.Message = strings.Join(errs, ", ")
+	case path == "":
+		d.Message = "call detail records are not enabled (requires the SIP server, sip_cdr and a cache path)"
+	default:
+		all, err := data.ReadCDRs(path)
+		if err != nil {
+			if s.Config.Debug {
+				fmt.Printf("/cdr: unable to read call detail records from %q: %s\n", path, err)
+			}
+			d.Message = "unable to read call detail records"
+			break
+		}
+		for _, c := range all {
+			if d.Filter.Matches(c) {
+				cdrs = append(cdrs, c)
+			}
+		}
+		slices.Reverse(cdrs) // newest first
+	}
+
+	format := strings.ToLower(r.FormValue("format"))
+	if d.Message != "" && format != "" {
+		http.Error(w, d.Message, http.StatusBadRequest)
+		return
+	}
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(cdrs, "", "  ")
+		if err != nil {
+			http.Error(w, "unable to marshal call detail records", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="phonebook_cdr.json"`)
+		w.Write(b)
+		return
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="phonebook_cdr.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write((&data.CDR{}).CSVHeader())
+		for _, c := range cdrs {
+			cw.Write(c.CSVRecord())
+		}
+		cw.Flush()
+		return
+	}
+
+	d.Total = len(cdrs)
+	if len(cdrs) > maxCDRShown {
+		cdrs = cdrs[:maxCDRShown]
+		d.Truncated = true
+	}
+	d.Records = cdrs
+	if err := s.Tmpls.ExecuteTemplate(w, "cdr.html", d); err != nil {
+		http.Error(w, "unable to write response", http.StatusInternalServerError)
+	}
+}
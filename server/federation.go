@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/arednch/phonebook/data"
+)
+
+// Registrations exports the locally registered phones to other phonebook
+// servers (federation). Requests and responses are signed with the shared
+// federation key, which itself is never sent.
+func (s *Server) Registrations(w http.ResponseWriter, r *http.Request) {
+	if s.Config.SIPFederationKey == "" || s.RegisterCache == nil {
+		http.NotFound(w, r)
+		return
+	}
+	nonce, err := data.CheckFederationAuthorization(s.Config.SIPFederationKey, r.Header.Get("Authorization"), time.Now())
+	if err == nil {
+		// Signed requests are valid within the allowed skew in both directions.
+		if _, seen := s.federationNonces.GetOrSet(nonce, func() bool { return true }, 2*data.FederationMaxSkew); seen {
+			err = errors.New("nonce already used")
+		}
+	}
+	if err != nil {
+		if s.Config.Debug {
+			fmt.Printf("Federation: refusing request from %s: %s\n", r.RemoteAddr, err)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	regs := &data.FederatedRegistrations{
+		SIPPort:       s.Config.SIPPort,
+		Registrations: []*data.FederatedRegistration{},
+	}
+	for _, e := range s.RegisterCache.Snapshot() {
+		regs.Registrations = append(regs.Registrations, &data.FederatedRegistration{
+			Number:  e.Key,
+			UA:      e.Value.UA,
+			Expires: e.Expiry,
+		})
+	}
+	slices.SortFunc(regs.Registrations, func(a, b *data.FederatedRegistration) int {
+		return strings.Compare(a.Number, b.Number)
+	})
+
+	body, err := json.Marshal(regs)
+	if err != nil {
+		http.Error(w, "unable to write response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(data.FederationSignatureHeader, data.FederationSignature(s.Config.SIPFederationKey, nonce, body))
+	w.Write(body)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/arednch/phonebook/data"
+)
+
+// CallForwarding lists the call forwarding rules and allows to add (action=add)
+// and delete (action=delete) them. Rules are returned as JSON with format=json.
+func (s *Server) CallForwarding(w http.ResponseWriter, r *http.Request) {
+	d := data.WebForwarding{
+		WebDefault: *s.prepareDefaultData("Call Forwarding", false),
+		Success:    true,
+	}
+	for _, c := range data.ForwardConditions {
+		// Busy is only seen when calls pass through the SIP server.
+		if c != data.ForwardBusy || s.Config.IsSIPProxy() {
+			d.Conditions = append(d.Conditions, c)
+		}
+	}
+	if s.Forwarding == nil {
+		d.Success = false
+		d.Message = "SIP server not enabled"
+		if err := s.Tmpls.ExecuteTemplate(w, "forwarding.html", d); err != nil {
+			http.Error(w, "unable to write response", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	action := strings.ToLower(strings.TrimSpace(r.FormValue("action")))
+	switch action {
+	case "":
+	case "add":
+		rule := &data.ForwardingRule{
+			Number:    strings.TrimSpace(r.FormValue("number")),
+			Condition: strings.ToLower(strings.TrimSpace(r.FormValue("condition"))),
+			Target:    strings.TrimSpace(r.FormValue("target")),
+			Start:     strings.TrimSpace(r.FormValue("start")),
+			End:       strings.TrimSpace(r.FormValue("end")),
+		}
+		var err error
+		if s.PrepareRule != nil {
+			err = s.PrepareRule(rule)
+		}
+		if err == nil {
+			err = rule.Validate()
+		}
+		if err != nil {
+			d.Success = false
+			d.Message = fmt.Sprintf("invalid rule: %s", err)
+			break
+		}
+		b := make([]byte, 8)
+		rand.Read(b)
+		rule.ID = hex.EncodeToString(b)
+		d.Success, d.Message = s.updateForwarding(func(f *data.Forwarding) bool {
+			f.Rules = append(f.Rules, rule)
+			return true
+		})
+	case "delete":
+		id := strings.TrimSpace(r.FormValue("id"))
+		d.Success, d.Message = s.updateForwarding(func(f *data.Forwarding) bool {
+			for i, rule := range f.Rules {
+				if rule.ID == id {
+					f.Rules = append(f.Rules[:i], f.Rules[i+1:]...)
+					return true
+				}
+			}
+			return false
+		})
+	default:
+		d.Success = false
+		d.Message = "'action' must be one of: [add,delete]"
+	}
+	if s.Config.Debug && !d.Success {
+		fmt.Printf("/forwarding: %s\n", d.Message)
+	}
+
+	s.Forwarding.Mu.RLock()
+	d.Rules = append(d.Rules, s.Forwarding.Rules...)
+	s.Forwarding.Mu.RUnlock()
+
+	if strings.ToLower(r.FormValue("format")) == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if !d.Success {
+			http.Error(w, d.Message, http.StatusBadRequest)
+			return
+		}
+		b, err := json.MarshalIndent(d.Rules, "", "  ")
+		if err != nil {
+			http.Error(w, "unable to marshal rules", http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+		return
+	}
+	if err := s.Tmpls.ExecuteTemplate(w, "forwarding.html", d); err != nil {
+		http.Error(w, "unable to write response", http.StatusInternalServerError)
+	}
+}
+
+// updateForwarding applies a change to the rules and persists them.
+func (s *Server) updateForwarding(change func(f *data.Forwarding) bool) (bool, string) {
+	s.Forwarding.Mu.Lock()
+	defer s.Forwarding.Mu.Unlock()
+	if !change(s.Forwarding) {
+		return false, "rule not found"
+	}
+	path := s.Config.GetForwardingPath()
+	if path == "" {
+		return true, "rules updated (not persisted as no cache path is set)"
+	}
+	if err := s.Forwarding.SaveLocked(path); err != nil {
+		if s.Config.Debug {
+			fmt.Printf("/forwarding: unable to persist rules to %q: %s\n", path, err)
+		}
+		return true, "rules updated but unable to persist them"
+	}
+	return true, "rules updated"
+}
@@ -31,11 +31,8 @@ func (s *Server) Index(w http.ResponseWriter, r *http.Request) {
 
 	recs := make(map[string]string)
 	for _, e := range s.Records.Entries {
-		var pfx string
-		if s.Config.IndicateActive && e.Route != nil {
-			pfx = s.Config.ActivePfx
-		}
-		recs[e.DisplayName(pfx)] = e.PhoneNumber
+		pfx, label := e.ActiveMarkers(s.Config.IndicateActive, s.Config.ActivePfx)
+		recs[e.DisplayName(pfx)+label] = e.PhoneNumber
 	}
 
 	data := data.WebIndex{
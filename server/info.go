@@ -29,6 +29,17 @@ func (s *Server) Info(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if s.Federated != nil {
+		info.Federated = make(map[string]string)
+		for _, e := range s.Federated.Snapshot() {
+			info.Federated[e.Key] = e.Value.Home
+		}
+	}
+
+	if s.SIPStats != nil {
+		info.SIP = s.SIPStats.Snapshot()
+	}
+
 	if s.RuntimeInfo != nil && s.RuntimeInfo.SysInfo != nil {
 		s.RuntimeInfo.Mu.RLock()
 		defer s.RuntimeInfo.Mu.RUnlock()
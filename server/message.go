@@ -14,6 +14,15 @@ func (s *Server) SendMessage(w http.ResponseWriter, r *http.Request) {
 		Success:    true,
 	}
 
+	if s.DeliverMessage == nil {
+		d.Success = false
+		d.Message = "SIP server not enabled"
+		if err := s.Tmpls.ExecuteTemplate(w, "message.html", d); err != nil {
+			http.Error(w, "unable to write response", http.StatusInternalServerError)
+		}
+		return
+	}
+
 	from := r.FormValue("from")
 	from = strings.ToLower(strings.TrimSpace(from))
 	if from == "" {
@@ -29,7 +38,6 @@ func (s *Server) SendMessage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.Records.Mu.RLock()
-	defer s.Records.Mu.RUnlock()
 
 	if checkExistenceBeforeSending {
 		if _, ok := s.RegisterCache.Get(from); !ok {
@@ -38,6 +46,7 @@ func (s *Server) SendMessage(w http.ResponseWriter, r *http.Request) {
 			}
 			d.Success = false
 			d.Message = "'from' phone number is not locally registered"
+			s.Records.Mu.RUnlock()
 			if err := s.Tmpls.ExecuteTemplate(w, "message.html", d); err != nil {
 				http.Error(w, "unable to write response", http.StatusInternalServerError)
 			}
@@ -53,6 +62,7 @@ func (s *Server) SendMessage(w http.ResponseWriter, r *http.Request) {
 		}
 		d.Success = false
 		d.Message = "'to' not specified"
+		s.Records.Mu.RUnlock()
 		if err := s.Tmpls.ExecuteTemplate(w, "message.html", d); err != nil {
 			http.Error(w, "unable to write response", http.StatusInternalServerError)
 		}
@@ -73,6 +83,7 @@ func (s *Server) SendMessage(w http.ResponseWriter, r *http.Request) {
 			}
 			d.Success = false
 			d.Message = "destination specified not found in phonebook"
+			s.Records.Mu.RUnlock()
 			if err := s.Tmpls.ExecuteTemplate(w, "message.html", d); err != nil {
 				http.Error(w, "unable to write response", http.StatusInternalServerError)
 			}
@@ -80,14 +91,14 @@ func (s *Server) SendMessage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	msg := r.FormValue("msg")
-	msg = strings.ToLower(strings.TrimSpace(msg))
-	if to == "" {
+	msg := strings.TrimSpace(r.FormValue("msg"))
+	if msg == "" {
 		if s.Config.Debug {
-			fmt.Printf("/message: 'msg' not specified: %s\n", to)
+			fmt.Println("/message: 'msg' not specified")
 		}
 		d.Success = false
 		d.Message = "'msg' not specified"
+		s.Records.Mu.RUnlock()
 		if err := s.Tmpls.ExecuteTemplate(w, "message.html", d); err != nil {
 			http.Error(w, "unable to write response", http.StatusInternalServerError)
 		}
@@ -104,45 +115,42 @@ func (s *Server) SendMessage(w http.ResponseWriter, r *http.Request) {
 			te = e
 		}
 	}
+	// Delivery looks up the records itself.
+	s.Records.Mu.RUnlock()
 
 	d.From = fmt.Sprintf("%s, %s", fe.DisplayName(""), from)
 	d.To = fmt.Sprintf("%s, %s", te.DisplayName(""), to)
 	d.Message = msg
-	t := &data.SIPAddress{
-		DisplayName: te.DisplayName(""),
-		URI: &data.SIPURI{
-			User: to,
-			Host: te.PhoneFQDN(),
-		},
-	}
-	f := &data.SIPAddress{
-		DisplayName: te.DisplayName(""),
-		URI: &data.SIPURI{
-			User: from,
-			Host: fe.PhoneFQDN(),
-		},
-	}
-	hdrs := []*data.SIPHeader{
-		{
-			Name:  "Content-Type",
-			Value: "text/plain",
-		},
+	m := &data.Message{
+		From:        from,
+		FromName:    fe.DisplayName(""),
+		FromHost:    fe.PhoneFQDN(),
+		To:          to,
+		ContentType: "text/plain",
+		Body:        msg,
 	}
-	req := data.NewSIPRequest("MESSAGE", f, t, 1, hdrs, []byte(msg))
-	if resp, err := s.SendSIPMessage(req); err != nil {
+	if err := s.DeliverMessage(m); err != nil {
 		if s.Config.Debug {
-			fmt.Printf("/message: message could not be sent: %s\n", err)
+			fmt.Printf("/message: message could not be delivered yet: %s\n", err)
 		}
-		d.Success = false
-		d.Message = "message could not be sent"
-	} else if resp.StatusCode != http.StatusOK {
-		if s.Config.Debug {
-			fmt.Printf("/message: message response not successful (%d)\n", resp.StatusCode)
-		}
-		d.Success = false
-		d.Message = fmt.Sprintf("message sent but response not ok (%d)", resp.StatusCode)
+		d.Queued = true
 	}
 	if err := s.Tmpls.ExecuteTemplate(w, "message.html", d); err != nil {
 		http.Error(w, "unable to write response", http.StatusInternalServerError)
 	}
 }
+
+func (s *Server) ShowMessages(w http.ResponseWriter, r *http.Request) {
+	d := data.WebMessages{
+		WebDefault: *s.prepareDefaultData("Messages", false),
+	}
+	if s.Messages != nil {
+		s.Messages.Mu.RLock()
+		d.Pending = append(d.Pending, s.Messages.Pending...)
+		d.History = append(d.History, s.Messages.History...)
+		s.Messages.Mu.RUnlock()
+	}
+	if err := s.Tmpls.ExecuteTemplate(w, "messages.html", d); err != nil {
+		http.Error(w, "unable to write response", http.StatusInternalServerError)
+	}
+}
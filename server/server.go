@@ -18,12 +18,14 @@ const (
 )
 
 type ReloadFunc func(cfg *configuration.Config, client *http.Client) (string, error)
-type SendSIPMessage func(*data.SIPRequest) (*data.SIPResponse, error)
+type DeliverMessage func(*data.Message) error
+type PrepareForwardingRule func(*data.ForwardingRule) error
 
 func NewServer(
 	cfg *configuration.Config, cfgPath string, version *data.Version, records *data.Records, runtimeInfo *data.RuntimeInfo,
-	exporters map[string]exporter.Exporter, updates *data.Updates, refreshRecords ReloadFunc, sendSIPMessage SendSIPMessage,
-	registerCache *data.TTLCache[string, *data.SIPClient], tmpls *template.Template, client *http.Client) *Server {
+	exporters map[string]exporter.Exporter, updates *data.Updates, refreshRecords ReloadFunc, deliverMessage DeliverMessage, prepareForwardingRule PrepareForwardingRule,
+	registerCache *data.TTLCache[string, *data.SIPClient], messages *data.Messages, forwarding *data.Forwarding, sipStats *data.SIPStats,
+	federated *data.TTLCache[string, *data.FederatedRegistration], tmpls *template.Template, client *http.Client) *Server {
 	return &Server{
 		Version:        version,
 		Config:         cfg,
@@ -33,10 +35,17 @@ func NewServer(
 		Updates:        updates,
 		Exporters:      exporters,
 		RegisterCache:  registerCache,
+		Messages:       messages,
+		Forwarding:     forwarding,
+		SIPStats:       sipStats,
+		Federated:      federated,
 		ReloadFn:       refreshRecords,
-		SendSIPMessage: sendSIPMessage,
+		DeliverMessage: deliverMessage,
+		PrepareRule:    prepareForwardingRule,
 		Tmpls:          tmpls,
 		Client:         client,
+
+		federationNonces: data.NewTTL[string, bool](),
 	}
 }
 
@@ -51,11 +60,20 @@ type Server struct {
 	Updates       *data.Updates
 	Exporters     map[string]exporter.Exporter
 	RegisterCache *data.TTLCache[string, *data.SIPClient]
+	Messages      *data.Messages
+	Forwarding    *data.Forwarding
+	SIPStats      *data.SIPStats
+	Federated     *data.TTLCache[string, *data.FederatedRegistration]
 
 	ReloadFn       ReloadFunc
-	SendSIPMessage SendSIPMessage
+	DeliverMessage DeliverMessage
+	// Normalizes and checks call forwarding rules before they're added.
+	PrepareRule PrepareForwardingRule
 
 	Tmpls *template.Template
+
+	// Nonces of federation requests seen recently (to refuse replays).
+	federationNonces *data.TTLCache[string, bool]
 }
 
 func (s *Server) BasicAuth(next http.HandlerFunc) http.HandlerFunc {
@@ -0,0 +1,248 @@
+package sip
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arednch/phonebook/configuration"
+	"github.com/arednch/phonebook/data"
+)
+
+const (
+	// Realm used in digest challenges.
+	authRealm = data.AREDNDomain
+	// Time after which a nonce is no longer accepted and clients need to re-authenticate.
+	nonceExpiration = 5 * time.Minute
+
+	algorithmMD5    = "MD5"
+	algorithmSHA256 = "SHA-256"
+)
+
+var (
+	// Offered algorithms in order of preference.
+	// https://datatracker.ietf.org/doc/html/rfc8760#section-2.4
+	algorithms = []string{
+		algorithmSHA256,
+		algorithmMD5,
+	}
+
+	errStaleNonce   = errors.New("stale nonce")
+	errInvalidNonce = errors.New("invalid nonce count")
+	errReplay       = errors.New("nonce count not increasing")
+)
+
+// requiresAuth returns true when the request needs to be authenticated given the config.
+func (s *Server) requiresAuth(req *data.SIPRequest) bool {
+	switch strings.ToLower(s.Config.SIPAuth) {
+	case configuration.SIPAuthRegister:
+		return req.Method == "REGISTER"
+	case configuration.SIPAuthAll:
+		// ACK and CANCEL can't be challenged.
+		// https://datatracker.ietf.org/doc/html/rfc3261#section-22.1
+		return req.Method != "ACK" && req.Method != "CANCEL"
+	default:
+		return false
+	}
+}
+
+// authenticate checks the credentials of a request. A response is returned if
+// the request is not (or not correctly) authenticated and must not be processed.
+func (s *Server) authenticate(req *data.SIPRequest) *data.SIPResponse {
+	if !s.requiresAuth(req) {
+		return nil
+	}
+
+	// REGISTER requests are authenticated for the address of record, all other
+	// requests for the caller.
+	identity := req.From()
+	if req.Method == "REGISTER" {
+		identity = req.To()
+	}
+	if identity == nil || identity.URI == nil {
+		return data.NewSIPResponseFromRequest(req, http.StatusBadRequest, "Bad Request")
+	}
+	cred, ok := s.Credentials[identity.URI.User]
+	if !ok {
+		return nil // extensions without credentials don't need to authenticate
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc3261#section-22.3
+	authHdr := "Proxy-Authorization"
+	if req.Method == "REGISTER" {
+		authHdr = "Authorization"
+	}
+	var stale bool
+	for _, hdr := range req.FindHeaders(authHdr) {
+		params, ok := parseDigest(hdr.Value)
+		if !ok || params["realm"] != authRealm {
+			continue
+		}
+		if params["username"] != cred.User {
+			if s.Config.Debug {
+				fmt.Printf("SIP/Auth: username %q doesn't match %q\n", params["username"], cred.User)
+			}
+			return data.NewSIPResponseFromRequest(req, http.StatusForbidden, "Forbidden")
+		}
+		if err := s.checkNonce(params); errors.Is(err, errStaleNonce) {
+			stale = true
+			continue
+		} else if err != nil {
+			if s.Config.Debug {
+				fmt.Printf("SIP/Auth: invalid nonce from %s: %s\n", cred.User, err)
+			}
+			continue
+		}
+		if validDigest(req, cred.Password, params) {
+			return nil
+		}
+		if s.Config.Debug {
+			fmt.Printf("SIP/Auth: invalid credentials for %s\n", cred.User)
+		}
+		return data.NewSIPResponseFromRequest(req, http.StatusForbidden, "Forbidden")
+	}
+
+	return s.challenge(req, stale)
+}
+
+// challenge creates a 401 (REGISTER) or 407 (all others) response with a fresh nonce.
+func (s *Server) challenge(req *data.SIPRequest, stale bool) *data.SIPResponse {
+	nonce := generateNonce()
+	s.nonces.Set(nonce, 0, nonceExpiration)
+
+	resp := data.NewSIPResponseFromRequest(req, http.StatusProxyAuthRequired, "Proxy Authentication Required")
+	hdr := "Proxy-Authenticate"
+	if req.Method == "REGISTER" {
+		resp = data.NewSIPResponseFromRequest(req, http.StatusUnauthorized, "Unauthorized")
+		hdr = "WWW-Authenticate"
+	}
+	for _, alg := range algorithms {
+		v := fmt.Sprintf(`Digest realm="%s", nonce="%s", algorithm=%s, qop="auth"`, authRealm, nonce, alg)
+		if stale {
+			v += ", stale=true"
+		}
+		resp.AddHeader(hdr, v)
+	}
+	return resp
+}
+
+// checkNonce verifies the nonce was issued by us and the nonce count increases
+// to protect against replays.
+func (s *Server) checkNonce(params map[string]string) error {
+	s.nonceMu.Lock()
+	defer s.nonceMu.Unlock()
+
+	nonce := params["nonce"]
+	last, _, ok := s.nonces.GetWithExpiry(nonce)
+	if !ok {
+		// We can't tell apart expired and unknown nonces, so clients are asked to retry.
+		return errStaleNonce
+	}
+	if _, ok := params["qop"]; !ok {
+		return nil // no nonce count without qop (RFC 2069 compatibility)
+	}
+	nc, err := strconv.ParseUint(params["nc"], 16, 32)
+	if err != nil {
+		return errInvalidNonce
+	}
+	if uint32(nc) <= last {
+		return errReplay
+	}
+	s.nonces.Set(nonce, uint32(nc), nonceExpiration)
+	return nil
+}
+
+// validDigest calculates the expected digest response and compares it to the
+// one provided. The digest needs to be for the Request-URI of the request.
+// https://datatracker.ietf.org/doc/html/rfc2617#section-3.2.2
+func validDigest(req *data.SIPRequest, password string, params map[string]string) bool {
+	// https://datatracker.ietf.org/doc/html/rfc2617#section-3.2.2.5
+	if !sameURI(params["uri"], req) {
+		return false
+	}
+
+	var h func() hash.Hash
+	switch strings.ToUpper(params["algorithm"]) {
+	case "", algorithmMD5:
+		h = md5.New
+	case algorithmSHA256:
+		h = sha256.New
+	default:
+		return false
+	}
+	digest := func(parts ...string) string {
+		d := h()
+		d.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	ha1 := digest(params["username"], params["realm"], password)
+	ha2 := digest(req.Method, params["uri"])
+	var expected string
+	switch params["qop"] {
+	case "":
+		expected = digest(ha1, params["nonce"], ha2)
+	case "auth":
+		expected = digest(ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2)
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) == 1
+}
+
+// sameURI checks if the digest uri designates the Request-URI, allowing for
+// differences in the case of the host.
+func sameURI(uri string, req *data.SIPRequest) bool {
+	if uri == req.URI {
+		return true
+	}
+	a, b := (&data.SIPRequest{URI: uri}).RequestURI(), req.RequestURI()
+	if uri == "" || a == nil || b == nil {
+		return false
+	}
+	return a.User == b.User && strings.EqualFold(a.Host, b.Host) && a.Port == b.Port
+}
+
+// parseDigest parses the parameters of a digest Authorization header.
+func parseDigest(value string) (map[string]string, bool) {
+	scheme, rest, ok := strings.Cut(strings.TrimSpace(value), " ")
+	if !ok || !strings.EqualFold(scheme, "digest") {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	var quoted bool
+	var start int
+	rest += ","
+	for i, c := range rest {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if quoted {
+				continue
+			}
+			k, v, ok := strings.Cut(rest[start:i], "=")
+			if ok {
+				params[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(v), `"`)
+			}
+			start = i + 1
+		}
+	}
+	return params, true
+}
+
+func generateNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,217 @@
+package sip
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/arednch/phonebook/data"
+)
+
+func TestParseDigest(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		value  string
+		want   map[string]string
+		wantOK bool
+	}{
+		{
+			name:  "quoted and unquoted",
+			value: `Digest username="100", realm="local.mesh", nonce="abc", uri="sip:local.mesh", response="def", algorithm=MD5, qop=auth, nc=00000001, cnonce="xyz"`,
+			want: map[string]string{
+				"username":  "100",
+				"realm":     "local.mesh",
+				"nonce":     "abc",
+				"uri":       "sip:local.mesh",
+				"response":  "def",
+				"algorithm": "MD5",
+				"qop":       "auth",
+				"nc":        "00000001",
+				"cnonce":    "xyz",
+			},
+			wantOK: true,
+		},
+		{
+			name:   "comma in quoted value and key case",
+			value:  ` digest Username="a,b" ,Realm = "local.mesh"`,
+			want:   map[string]string{"username": "a,b", "realm": "local.mesh"},
+			wantOK: true,
+		},
+		{name: "other scheme", value: `Basic YWxhZGRpbjpvcGVuc2VzYW1l`},
+		{name: "scheme only", value: "Digest"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := parseDigest(tc.value)
+			if ok != tc.wantOK {
+				t.Fatalf("parseDigest() ok = %t, want %t", ok, tc.wantOK)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("parseDigest() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// md5Response calculates the digest response (MD5, qop=auth) for the params.
+func md5Response(method, password string, params map[string]string) string {
+	h := func(parts ...string) string {
+		sum := md5.Sum([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := h(params["username"], params["realm"], password)
+	ha2 := h(method, params["uri"])
+	return h(ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2)
+}
+
+func TestValidDigest(t *testing.T) {
+	sipParams := func(uri string) map[string]string {
+		params := map[string]string{
+			"username": "100",
+			"realm":    authRealm,
+			"nonce":    "0123456789abcdef",
+			"uri":      uri,
+			"qop":      "auth",
+			"nc":       "00000001",
+			"cnonce":   "fedcba",
+		}
+		params["response"] = md5Response("INVITE", "secret", params)
+		return params
+	}
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		uri      string // Request-URI
+		password string
+		params   map[string]string
+		want     bool
+	}{
+		{
+			// https://datatracker.ietf.org/doc/html/rfc2617#section-3.5
+			name:     "RFC 2617 example",
+			method:   "GET",
+			uri:      "/dir/index.html",
+			password: "Circle Of Life",
+			params: map[string]string{
+				"username": "Mufasa",
+				"realm":    "testrealm@host.com",
+				"nonce":    "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+				"uri":      "/dir/index.html",
+				"qop":      "auth",
+				"nc":       "00000001",
+				"cnonce":   "0a4f113b",
+				"response": "6629fae49393a05397450978507c4ef1",
+			},
+			want: true,
+		},
+		{
+			// https://datatracker.ietf.org/doc/html/rfc7616#section-3.9.1
+			name:     "RFC 7616 SHA-256 example",
+			method:   "GET",
+			uri:      "/dir/index.html",
+			password: "Circle of Life",
+			params: map[string]string{
+				"username":  "Mufasa",
+				"realm":     "http-auth@example.org",
+				"nonce":     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+				"uri":       "/dir/index.html",
+				"algorithm": "SHA-256",
+				"qop":       "auth",
+				"nc":        "00000001",
+				"cnonce":    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+				"response":  "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+			},
+			want: true,
+		},
+		{
+			name:     "without qop",
+			method:   "GET",
+			uri:      "/dir/index.html",
+			password: "Circle Of Life",
+			params: map[string]string{
+				"username": "Mufasa",
+				"realm":    "testrealm@host.com",
+				"nonce":    "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+				"uri":      "/dir/index.html",
+				"response": "670fd8c2df070c60b045671b8b24ff02",
+			},
+			want: true,
+		},
+		{
+			name:     "wrong password",
+			method:   "GET",
+			uri:      "/dir/index.html",
+			password: "Circle of Life",
+			params: map[string]string{
+				"username": "Mufasa",
+				"realm":    "testrealm@host.com",
+				"nonce":    "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+				"uri":      "/dir/index.html",
+				"response": "670fd8c2df070c60b045671b8b24ff02",
+			},
+		},
+		{name: "same URI", method: "INVITE", uri: "sip:200@local.mesh", password: "secret", params: sipParams("sip:200@local.mesh"), want: true},
+		{name: "host case", method: "INVITE", uri: "sip:200@local.mesh", password: "secret", params: sipParams("sip:200@LOCAL.mesh"), want: true},
+		{name: "other user", method: "INVITE", uri: "sip:200@local.mesh", password: "secret", params: sipParams("sip:300@local.mesh")},
+		{name: "other port", method: "INVITE", uri: "sip:200@local.mesh", password: "secret", params: sipParams("sip:200@local.mesh:5070")},
+		{name: "empty uri", method: "INVITE", uri: "sip:200@local.mesh", password: "secret", params: sipParams("")},
+		{name: "other method", method: "BYE", uri: "sip:200@local.mesh", password: "secret", params: sipParams("sip:200@local.mesh")},
+		{
+			name:     "unknown algorithm",
+			method:   "INVITE",
+			uri:      "sip:200@local.mesh",
+			password: "secret",
+			params: func() map[string]string {
+				p := sipParams("sip:200@local.mesh")
+				p["algorithm"] = "SHA-512-256"
+				return p
+			}(),
+		},
+		{
+			name:     "unsupported qop",
+			method:   "INVITE",
+			uri:      "sip:200@local.mesh",
+			password: "secret",
+			params: func() map[string]string {
+				p := sipParams("sip:200@local.mesh")
+				p["qop"] = "auth-int"
+				return p
+			}(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &data.SIPRequest{Method: tc.method, URI: tc.uri}
+			if got := validDigest(req, tc.password, tc.params); got != tc.want {
+				t.Errorf("validDigest() = %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckNonce(t *testing.T) {
+	s := &Server{nonces: data.NewTTL[string, uint32]()}
+	s.nonces.Set("issued", 0, nonceExpiration)
+
+	// Steps are run in order against the same nonces.
+	for _, tc := range []struct {
+		name   string
+		params map[string]string
+		want   error
+	}{
+		{name: "first", params: map[string]string{"nonce": "issued", "qop": "auth", "nc": "00000001"}},
+		{name: "replayed", params: map[string]string{"nonce": "issued", "qop": "auth", "nc": "00000001"}, want: errReplay},
+		{name: "skipped", params: map[string]string{"nonce": "issued", "qop": "auth", "nc": "0000000a"}},
+		{name: "lower", params: map[string]string{"nonce": "issued", "qop": "auth", "nc": "00000009"}, want: errReplay},
+		{name: "invalid", params: map[string]string{"nonce": "issued", "qop": "auth", "nc": "xyz"}, want: errInvalidNonce},
+		{name: "without qop", params: map[string]string{"nonce": "issued"}},
+		{name: "unknown", params: map[string]string{"nonce": "unknown", "qop": "auth", "nc": "00000001"}, want: errStaleNonce},
+	} {
+		if err := s.checkNonce(tc.params); !errors.Is(err, tc.want) {
+			t.Errorf("%s: checkNonce() = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package sip
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arednch/phonebook/data"
+)
+
+const (
+	// Time to keep track of a call without seeing its BYE (e.g. it was lost).
+	callTimeout = 4 * time.Hour
+)
+
+// call is a dialog created by an INVITE forwarded in proxy mode, tracked for
+// subscriptions to the "dialog" event package.
+type call struct {
+	ID     string // Call-ID
+	Caller string // normalized numbers of the parties
+	Callee []string
+
+	mu    sync.Mutex
+	state string // trying, early, confirmed or terminated once ended
+}
+
+func (c *call) State() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Parties returns the numbers of all phones involved in the call.
+func (c *call) Parties() []string {
+	return append([]string{c.Caller}, c.Callee...)
+}
+
+// trackCall starts tracking an initial INVITE forwarded to its destination.
+// The callee is known by the number dialed and the one it was routed to
+// (e.g. a hunt group member).
+func (s *Server) trackCall(req, fwd *data.SIPRequest) {
+	callIDs := req.HeaderValues("Call-ID")
+	from, ruri := req.From(), req.RequestURI()
+	if len(callIDs) == 0 || from == nil || ruri == nil {
+		return
+	}
+	c := &call{
+		ID:     callIDs[0],
+		Caller: s.normalizeNumber(from.URI.User),
+		Callee: []string{s.normalizeNumber(ruri.User)},
+		state:  data.DialogTrying,
+	}
+	if target := fwd.RequestURI(); target != nil && !slices.Contains(c.Callee, target.User) {
+		c.Callee = append(c.Callee, target.User)
+	}
+	s.calls.Set(c.ID, c, callTimeout)
+	s.notifyCall(c)
+}
+
+// updateCall updates the state of a call from a response to its INVITE.
+// https://datatracker.ietf.org/doc/html/rfc4235#section-3.7.1
+func (s *Server) updateCall(resp *data.SIPResponse) {
+	callIDs := resp.HeaderValues("Call-ID")
+	if len(callIDs) == 0 || resp.StatusCode == http.StatusContinue {
+		return
+	}
+	c, ok := s.calls.Get(callIDs[0])
+	if !ok {
+		return
+	}
+	var state string
+	switch {
+	case resp.StatusCode < 200:
+		state = data.DialogEarly
+	case resp.StatusCode < 300:
+		state = data.DialogConfirmed
+	case c.State() == data.DialogConfirmed:
+		return // failed re-INVITE, the call goes on
+	default:
+		s.endCall(c.ID)
+		return
+	}
+	c.mu.Lock()
+	changed := c.state != state
+	c.state = state
+	c.mu.Unlock()
+	if changed {
+		s.notifyCall(c)
+	}
+}
+
+// endCall stops tracking a call (e.g. on BYE or a failure response).
+func (s *Server) endCall(callID string) {
+	if c, ok := s.calls.Pop(callID); ok {
+		c.mu.Lock()
+		c.state = data.DialogTerminated
+		c.mu.Unlock()
+		s.notifyCall(c)
+	}
+}
+
+func (s *Server) notifyCall(c *call) {
+	if s.Config.Debug {
+		fmt.Printf("SIP/Dialog: call %s from %s to %s: %s\n", c.ID, c.Caller, strings.Join(c.Callee, "/"), c.State())
+	}
+	for _, user := range c.Parties() {
+		go s.notifyPresence(user)
+	}
+}
+
+// dialogState returns the dialogs of a phone. In proxy mode, these are the
+// calls passing through the server. Otherwise (or without calls) the phone is
+// reported idle when it's available and with a terminated dialog if not.
+func (s *Server) dialogState(user string) []*data.DialogInfoDialog {
+	var dialogs []*data.DialogInfoDialog
+	if s.calls != nil {
+		for _, e := range s.calls.Snapshot() {
+			c := e.Value
+			direction := "recipient"
+			switch {
+			case c.Caller == user:
+				direction = "initiator"
+			case !slices.Contains(c.Callee, user):
+				continue
+			}
+			dialogs = append(dialogs, &data.DialogInfoDialog{
+				ID:        c.ID,
+				CallID:    c.ID,
+				Direction: direction,
+				State:     c.State(),
+			})
+		}
+		slices.SortFunc(dialogs, func(a, b *data.DialogInfoDialog) int {
+			return strings.Compare(a.ID, b.ID)
+		})
+	}
+	if len(dialogs) > 0 {
+		return dialogs
+	}
+	if state, _ := s.presenceState(user); state == data.PresenceOpen {
+		return nil
+	}
+	return []*data.DialogInfoDialog{{ID: user, State: data.DialogTerminated}}
+}
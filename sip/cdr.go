@@ -0,0 +1,95 @@
+package sip
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/arednch/phonebook/data"
+)
+
+const (
+	// Size after which the call detail records file is rotated.
+	cdrMaxSize = 1 << 20 // 1 MiB
+)
+
+// recordTransaction records the final response to an INVITE or MESSAGE request.
+func (s *Server) recordTransaction(req *data.SIPRequest, resp *data.SIPResponse, destination string) {
+	if s.Config.GetCDRPath() == "" || resp.StatusCode < 200 {
+		return
+	}
+	if req.Method != "INVITE" && req.Method != "MESSAGE" {
+		return
+	}
+	if req.Method == "MESSAGE" && resp.StatusCode == http.StatusAccepted {
+		return // queued, recorded once delivered, failed or expired (see deliveryRecord)
+	}
+
+	var callID string
+	if ids := req.HeaderValues("Call-ID"); len(ids) > 0 {
+		callID = ids[0]
+	}
+
+	c := &data.CDR{
+		Time:        time.Now(),
+		Method:      req.Method,
+		CallID:      callID,
+		Destination: destination,
+		StatusCode:  resp.StatusCode,
+		Reason:      resp.StatusMessage,
+	}
+	if from := req.From(); from != nil && from.URI != nil {
+		c.From = from.URI.String()
+	}
+	if to := req.To(); to != nil && to.URI != nil {
+		c.To = to.URI.String()
+	}
+	s.recordCDR(c)
+}
+
+// deliveryRecord creates the record of the outcome of delivering a queued
+// message. Addresses are written as SIP URIs like in recordTransaction.
+func deliveryRecord(m *data.Message, to *data.SIPAddress, resp *data.SIPResponse) *data.CDR {
+	toHost := m.ToHost
+	if toHost == "" {
+		toHost = (&data.Entry{PhoneNumber: m.To}).PhoneFQDN()
+	}
+	c := &data.CDR{
+		Time:   time.Now(),
+		Method: "MESSAGE",
+		CallID: m.CallID,
+		From:   (&data.SIPURI{User: m.From, Host: m.FromHost}).String(),
+		To:     (&data.SIPURI{User: m.To, Host: toHost}).String(),
+		Reason: m.Status,
+	}
+	if to != nil && to.URI != nil {
+		c.Destination = to.URI.String()
+	}
+	if resp != nil {
+		c.StatusCode = resp.StatusCode
+		c.Reason = fmt.Sprintf("%s (%s)", resp.StatusMessage, m.Status)
+	}
+	return c
+}
+
+// redirectTarget returns the first contact of a redirect response.
+func redirectTarget(resp *data.SIPResponse) string {
+	for _, v := range resp.HeaderValues("Contact") {
+		addr := &data.SIPAddress{}
+		if err := addr.Parse(v); err == nil && addr.URI != nil {
+			return addr.URI.String()
+		}
+	}
+	return ""
+}
+
+// recordCDR appends the record to the call detail records file (if enabled).
+func (s *Server) recordCDR(c *data.CDR) {
+	path := s.Config.GetCDRPath()
+	if path == "" {
+		return
+	}
+	if err := data.AppendCDR(path, c, cdrMaxSize); err != nil {
+		fmt.Printf("SIP/CDR: unable to write call detail record to %q: %s\n", path, err)
+	}
+}
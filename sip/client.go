@@ -0,0 +1,133 @@
+package sip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/arednch/phonebook/data"
+)
+
+const (
+	// Client transaction timers for requests sent (or forwarded) by us.
+	// https://datatracker.ietf.org/doc/html/rfc3261#section-17.1
+	timerT1 = 500 * time.Millisecond
+	timerT2 = 4 * time.Second
+	timerB  = 64 * timerT1 // wait for a response to an INVITE
+	timerF  = 64 * timerT1 // wait for the final response to a non-INVITE request
+)
+
+// clientTransaction is a non-INVITE request sent by us waiting for its final response.
+type clientTransaction struct {
+	responses chan *data.SIPResponse
+}
+
+// findContact looks up where requests to the given phone number should be sent
+// to. Contrary to findDestination, locally registered clients take precedence
+// as their contact is more specific (port, transport) than the phonebook entry.
+func (s *Server) findContact(user string) *data.SIPAddress {
+	if reg, ok := s.RegisterCache.Get(user); ok {
+		addr := reg.Address.Clone()
+		addr.Params = make(map[string]string)
+		return addr
+	}
+	return s.findDestination(user)
+}
+
+// sendRequest sends a non-INVITE request to the URI and waits for the final
+// response. Over UDP the request is retransmitted until a response arrives.
+// A 408 response is returned when no final response is received in time.
+// https://datatracker.ietf.org/doc/html/rfc3261#section-17.1.2
+func (s *Server) sendRequest(req *data.SIPRequest, uri *data.SIPURI) (*data.SIPResponse, error) {
+	s.init()
+
+	port := uri.Port
+	if port == 0 {
+		port = expectedPhoneSIPPort
+	}
+	dst, err := net.ResolveUDPAddr("udp", net.JoinHostPort(uri.Host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("error resolving the destination address: %s", err)
+	}
+	out, err := s.outbound(dst, uri.Params["transport"])
+	if err != nil {
+		return nil, fmt.Errorf("error connecting: %s", err)
+	}
+	local, err := localAddrFor(dst)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine local address: %s", err)
+	}
+
+	branch := data.GenerateBranch()
+	via := &data.SIPVia{
+		Transport: out.Transport(),
+		Host:      local.String(),
+		Port:      s.Config.SIPPort,
+		Params:    map[string]string{"branch": branch, "rport": ""},
+	}
+	req.RemoveHeaders("Via")
+	req.PushHeaderValue("Via", via.String())
+
+	tx := &clientTransaction{
+		responses: make(chan *data.SIPResponse, 1),
+	}
+	s.clientTxs.Set(branch, tx, timerF)
+	defer s.clientTxs.Remove(branch)
+
+	b := req.Serialize(true)
+	if s.Config.Debug {
+		fmt.Printf("SIP/Request (%d bytes) to %s:\n%s\n", len(b), dst, string(b))
+	}
+	if _, err := out.WriteTo(b, dst); err != nil {
+		return nil, fmt.Errorf("error sending request: %s", err)
+	}
+
+	// Timer E (retransmissions) only applies to unreliable transports.
+	interval := timerT1
+	retransmit := time.NewTimer(interval)
+	defer retransmit.Stop()
+	if out.Transport() != "UDP" {
+		retransmit.Stop()
+	}
+	timeout := time.NewTimer(timerF)
+	defer timeout.Stop()
+	for {
+		select {
+		case resp := <-tx.responses:
+			if resp.StatusCode >= 200 {
+				return resp, nil
+			}
+			// Provisional responses stop retransmissions from speeding up.
+			interval = timerT2
+		case <-retransmit.C:
+			if _, err := out.WriteTo(b, dst); err != nil && s.Config.Debug {
+				fmt.Printf("SIP/Request: unable to retransmit: %s\n", err)
+			}
+			interval = min(2*interval, timerT2)
+			retransmit.Reset(interval)
+		case <-timeout.C:
+			return data.NewSIPResponseFromRequest(req, http.StatusRequestTimeout, "Request Timeout"), nil
+		}
+	}
+}
+
+// clientResponse passes a response on to the request it belongs to. Returns
+// false when it doesn't belong to any request sent by us.
+func (s *Server) clientResponse(resp *data.SIPResponse) bool {
+	via := resp.TopVia()
+	if via == nil {
+		return false
+	}
+	tx, ok := s.clientTxs.Get(via.Branch())
+	if !ok {
+		return false
+	}
+	// Retransmitted responses are dropped if the previous one wasn't picked up yet.
+	select {
+	case tx.responses <- resp:
+	default:
+	}
+	return true
+}
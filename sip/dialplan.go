@@ -0,0 +1,76 @@
+package sip
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Visual separators which are ignored in dialed numbers.
+	// https://datatracker.ietf.org/doc/html/rfc3966#section-5.1.1
+	numberSeparators = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+)
+
+// compileDialPlan prepares the regular expressions of the dial plan. They are
+// validated along with the config.
+func (s *Server) compileDialPlan() {
+	if s.Config.SIPDialPlan == nil {
+		return
+	}
+	for _, r := range s.Config.SIPDialPlan.Rewrites {
+		s.rewrites = append(s.rewrites, regexp.MustCompile(r.Match))
+	}
+}
+
+// normalizeNumber applies the dial plan to a dialed number so it can be looked up:
+// separators are removed, short codes and prefixes replaced, rewrites applied
+// and finally the country prefix (incl. international forms) is stripped.
+func (s *Server) normalizeNumber(dialed string) string {
+	number := dialed
+	var steps []string
+	apply := func(step, n string) {
+		if n == number {
+			return
+		}
+		steps = append(steps, fmt.Sprintf("%s (%s)", n, step))
+		number = n
+	}
+
+	apply("separators", numberSeparators.Replace(number))
+	if dp := s.Config.SIPDialPlan; dp != nil {
+		if n, ok := dp.ShortCodes[number]; ok {
+			apply("short code", n)
+		}
+		for _, p := range dp.Prefixes {
+			if strings.HasPrefix(number, p.Prefix) && (p.Length == 0 || len(number) == p.Length) {
+				apply("prefix", p.Replace+strings.TrimPrefix(number, p.Prefix))
+				break
+			}
+		}
+		for i, re := range s.rewrites {
+			apply("rewrite "+re.String(), re.ReplaceAllString(number, dp.Rewrites[i].Replace))
+		}
+	}
+	apply("country prefix", s.localNumber(number))
+
+	if s.Config.Debug && len(steps) > 0 {
+		fmt.Printf("SIP/DialPlan: normalized %s to %s\n", dialed, strings.Join(steps, " -> "))
+	}
+	return number
+}
+
+// localNumber strips the country prefix from numbers in international
+// (+41..., 0041...) or global (041...) format.
+func (s *Server) localNumber(number string) string {
+	cc := strings.TrimLeft(s.Config.CountryPrefix, "0")
+	if cc == "" {
+		return number
+	}
+	for _, pfx := range []string{"+" + cc, "00" + cc} {
+		if strings.HasPrefix(number, pfx) {
+			return strings.TrimPrefix(number, pfx)
+		}
+	}
+	return s.Config.GetLocalNumber(number)
+}
@@ -0,0 +1,60 @@
+package sip
+
+import (
+	"testing"
+
+	"github.com/arednch/phonebook/configuration"
+	"github.com/arednch/phonebook/data"
+)
+
+func TestNormalizeNumber(t *testing.T) {
+	dp := &data.DialPlan{
+		ShortCodes: map[string]string{
+			"1": "800030",
+			"2": "9123456",
+		},
+		Prefixes: []*data.DialPlanPrefix{
+			{Prefix: "9", Length: 7},
+			{Prefix: "91", Replace: "7"},
+			{Replace: "8", Length: 5},
+		},
+		Rewrites: []*data.DialPlanRewrite{
+			{Match: `^\*(\d+)$`, Replace: "$1"},
+			{Match: `^(\d{3})$`, Replace: "55$1"},
+		},
+	}
+	for _, tc := range []struct {
+		name     string
+		dialPlan *data.DialPlan
+		dialed   string
+		want     string
+	}{
+		{name: "local number", dialed: "123456", want: "123456"},
+		{name: "separators", dialed: "(12) 34-5.6", want: "123456"},
+		{name: "country prefix", dialed: "041123456", want: "123456"},
+		{name: "international country prefix", dialed: "+41123456", want: "123456"},
+		{name: "international country prefix with zeros", dialed: "0041123456", want: "123456"},
+		{name: "international country prefix with separators", dialed: "+41 12 34 56", want: "123456"},
+		{name: "other country", dialed: "+49123456", want: "+49123456"},
+		{name: "global number of other country", dialed: "049123456", want: "049123456"},
+		{name: "without dial plan", dialed: "1", want: "1"},
+		{name: "short code", dialPlan: dp, dialed: "1", want: "800030"},
+		{name: "short code before prefixes", dialPlan: dp, dialed: "2", want: "123456"},
+		{name: "prefix stripped", dialPlan: dp, dialed: "9123456", want: "123456"},
+		{name: "first matching prefix", dialPlan: dp, dialed: "912345", want: "72345"},
+		{name: "prefix added", dialPlan: dp, dialed: "12345", want: "812345"},
+		{name: "rewrites in order", dialPlan: dp, dialed: "*123", want: "55123"},
+		{name: "country prefix after rewrites", dialPlan: dp, dialed: "*041123456", want: "123456"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{Config: &configuration.Config{
+				CountryPrefix: "041",
+				SIPDialPlan:   tc.dialPlan,
+			}}
+			s.compileDialPlan()
+			if got := s.normalizeNumber(tc.dialed); got != tc.want {
+				t.Errorf("normalizeNumber(%q) = %q, want %q", tc.dialed, got, tc.want)
+			}
+		})
+	}
+}
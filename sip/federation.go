@@ -0,0 +1,184 @@
+package sip
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arednch/phonebook/data"
+)
+
+const (
+	// Interval in which peers are polled for their registrations.
+	federationInterval = time.Minute
+	// Registrations learned from peers are dropped when not seen again in time.
+	federationTTL = 3 * federationInterval
+	// Number of peers polled in parallel.
+	federationWorkers = 8
+	// Peers which can't be polled are skipped for a while.
+	federationBackoff = time.Hour
+	// Upper bound of the registrations read from a peer.
+	federationMaxResponse = 1 << 20
+)
+
+// RunFederation periodically polls other phonebook servers (configured peers
+// plus the ones discovered) for the phones registered with them, so calls to
+// those phones can be handed over to their home node.
+func (s *Server) RunFederation(client *http.Client, discover func() []string) {
+	s.init()
+	for {
+		peers := slices.Clone(s.Config.SIPPeers)
+		if discover != nil && s.Config.SIPPeerDiscovery {
+			peers = append(peers, discover()...)
+		}
+		s.pollPeers(client, peers)
+		time.Sleep(federationInterval)
+	}
+}
+
+func (s *Server) pollPeers(client *http.Client, peers []string) {
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for range min(federationWorkers, len(peers)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for peer := range queue {
+				if _, ok := s.unreachablePeers.Get(peer); ok {
+					continue
+				}
+				n, err := s.pollPeer(client, peer)
+				if err != nil {
+					s.unreachablePeers.Set(peer, true, federationBackoff)
+					if s.Config.Debug {
+						fmt.Printf("SIP/Federation: unable to poll %s: %s\n", peer, err)
+					}
+					continue
+				}
+				if s.Config.Debug && n > 0 {
+					fmt.Printf("SIP/Federation: %d phones registered with %s\n", n, peer)
+				}
+			}
+		}()
+	}
+	seen := make(map[string]bool)
+	for _, peer := range peers {
+		peer = strings.TrimSpace(peer)
+		if peer == "" || seen[peer] {
+			continue
+		}
+		seen[peer] = true
+		queue <- peer
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// pollPeer fetches the registrations of a peer and returns how many were learned.
+func (s *Server) pollPeer(client *http.Client, peer string) (int, error) {
+	u, err := peerURL(peer, s.Config.Port)
+	if err != nil {
+		return 0, err
+	}
+	home := u.Hostname()
+	if s.LocalIdentities[strings.ToLower(home)] {
+		return 0, nil // that's us
+	}
+	// Short hostnames (e.g. from sysinfo) need the mesh domain to be reachable by phones.
+	if !strings.Contains(home, ".") && !strings.Contains(home, ":") {
+		home = fmt.Sprintf("%s.%s", home, data.AREDNDomain)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	// The key itself is never sent: requests and responses are signed with it
+	// so only peers knowing it can read or announce registrations.
+	nonce := generateNonce()
+	req.Header.Set("Authorization", data.FederationAuthorization(s.Config.SIPFederationKey, nonce, time.Now()))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, federationMaxResponse))
+	if err != nil {
+		return 0, fmt.Errorf("unable to read registrations: %s", err)
+	}
+	sig := resp.Header.Get(data.FederationSignatureHeader)
+	if !hmac.Equal([]byte(sig), []byte(data.FederationSignature(s.Config.SIPFederationKey, nonce, body))) {
+		return 0, errors.New("invalid signature of registrations")
+	}
+	var regs data.FederatedRegistrations
+	if err := json.Unmarshal(body, &regs); err != nil {
+		return 0, fmt.Errorf("unable to read registrations: %s", err)
+	}
+
+	var n int
+	for _, r := range regs.Registrations {
+		ttl := min(time.Until(r.Expires), federationTTL)
+		if r.Number == "" || ttl <= 0 {
+			continue
+		}
+		r.Home = home
+		r.SIPPort = regs.SIPPort
+		s.Federated.Set(r.Number, r, ttl)
+		n++
+	}
+	return n, nil
+}
+
+// peerURL returns the URL of the registrations exported by a peer. Peers are
+// either hostnames (optionally with a port) or URLs.
+func peerURL(peer string, port int) (*url.URL, error) {
+	if !strings.Contains(peer, "://") {
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			peer = net.JoinHostPort(peer, strconv.Itoa(port))
+		}
+		peer = "http://" + peer
+	}
+	u, err := url.Parse(peer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer %q: %s", peer, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid peer %q: no host", peer)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = data.FederationPath
+	}
+	return u, nil
+}
+
+// findFederated looks up the home node of a phone registered with another phonebook server.
+func (s *Server) findFederated(user string) *data.SIPAddress {
+	if s.Federated == nil {
+		return nil
+	}
+	r, ok := s.Federated.Get(user)
+	if !ok {
+		return nil
+	}
+	return &data.SIPAddress{
+		URI: &data.SIPURI{
+			User: r.Number,
+			Host: r.Home,
+			Port: r.SIPPort,
+		},
+		Params: make(map[string]string),
+	}
+}
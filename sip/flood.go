@@ -0,0 +1,204 @@
+package sip
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/arednch/phonebook/configuration"
+	"github.com/arednch/phonebook/data"
+)
+
+const (
+	// Messages queued per worker before further ones are dropped.
+	workerQueueSize = 64
+
+	// Sources of which more than floodBanDrops messages were dropped within
+	// floodWindow (e.g. retry storms) are banned for floodBanDuration.
+	floodWindow      = 10 * time.Second
+	floodBanDrops    = 100
+	floodBanDuration = 5 * time.Minute
+
+	// Rate limit state of sources is forgotten after being idle for this long.
+	floodSourceTTL = time.Minute
+)
+
+// packet is a message received from the network waiting to be handled.
+type packet struct {
+	conn sender
+	addr net.Addr
+	buf  []byte
+}
+
+// floodSource is the rate limit state of a single source (token bucket).
+type floodSource struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	drops  int       // messages dropped in the current window
+	window time.Time // start of the current window
+}
+
+// sourceIP returns the IP of a network address (IPv4 mapped IPv6 addresses are unmapped).
+func sourceIP(addr net.Addr) netip.Addr {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
+
+// initFlood sets up the ACLs and starts the workers handling received messages.
+func (s *Server) initFlood() {
+	if s.Stats == nil {
+		s.Stats = &data.SIPStats{Mu: &sync.RWMutex{}}
+	}
+	s.Stats.Mu.Lock()
+	if s.Stats.Bans == nil {
+		s.Stats.Bans = make(map[string]time.Time)
+	}
+	s.Stats.Mu.Unlock()
+	// The config has been validated already.
+	s.allow, _ = configuration.ParseSIPACL(s.Config.SIPAllow)
+	s.deny, _ = configuration.ParseSIPACL(s.Config.SIPDeny)
+	s.sources = data.NewTTL[netip.Addr, *floodSource]()
+	go s.sweepBans()
+
+	workers := s.Config.GetSIPWorkers()
+	s.packets = make(chan *packet, workers*workerQueueSize)
+	for range workers {
+		go func() {
+			for p := range s.packets {
+				s.handlePacket(p.conn, p.addr, p.buf)
+			}
+		}()
+	}
+}
+
+// dispatch queues a received message for the workers unless its source is
+// blocked, exceeds the rate limit or all workers are busy.
+func (s *Server) dispatch(conn sender, addr net.Addr, buf []byte) {
+	ip := sourceIP(addr)
+	if !s.admit(ip) {
+		return
+	}
+	select {
+	case s.packets <- &packet{conn: conn, addr: addr, buf: buf}:
+	default:
+		s.countDrop(&s.Stats.Overloaded)
+		if s.Config.Debug {
+			fmt.Printf("SIP: dropping message from %s: all workers busy\n", addr)
+		}
+	}
+}
+
+// blocked checks whether the source isn't allowed by the ACLs or currently banned.
+func (s *Server) blocked(ip netip.Addr) bool {
+	if !s.aclAllows(ip) {
+		s.countDrop(&s.Stats.Denied)
+		return true
+	}
+	s.Stats.Mu.Lock()
+	defer s.Stats.Mu.Unlock()
+	until, ok := s.Stats.Bans[ip.String()]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(s.Stats.Bans, ip.String())
+		return false
+	}
+	s.Stats.Banned++
+	return true
+}
+
+// sweepBans periodically removes expired bans, also of sources which never
+// come back.
+func (s *Server) sweepBans() {
+	for range time.Tick(floodBanDuration) {
+		now := time.Now()
+		s.Stats.Mu.Lock()
+		for ip, until := range s.Stats.Bans {
+			if now.After(until) {
+				delete(s.Stats.Bans, ip)
+			}
+		}
+		s.Stats.Mu.Unlock()
+	}
+}
+
+// aclAllows checks the source against the deny and allow lists. Denied
+// sources take precedence and when there is an allow list, only sources in it
+// are allowed.
+func (s *Server) aclAllows(ip netip.Addr) bool {
+	for _, pfx := range s.deny {
+		if pfx.Contains(ip) {
+			return false
+		}
+	}
+	if len(s.allow) == 0 {
+		return true
+	}
+	for _, pfx := range s.allow {
+		if pfx.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit checks whether a message from the source is accepted and bans
+// sources which keep exceeding the rate limit.
+func (s *Server) admit(ip netip.Addr) bool {
+	if s.blocked(ip) {
+		return false
+	}
+
+	rate := float64(s.Config.GetSIPRateLimit())
+	// Every message refreshes the state, so it's only dropped once the source
+	// has been idle for floodSourceTTL.
+	src, _ := s.sources.GetOrSet(ip, func() *floodSource {
+		return &floodSource{tokens: 2 * rate} // allow bursts of up to two seconds
+	}, floodSourceTTL)
+
+	src.mu.Lock()
+	now := time.Now()
+	if !src.last.IsZero() {
+		src.tokens = min(src.tokens+now.Sub(src.last).Seconds()*rate, 2*rate)
+	}
+	src.last = now
+	if src.tokens >= 1 {
+		src.tokens--
+		src.mu.Unlock()
+		return true
+	}
+	if now.Sub(src.window) > floodWindow {
+		src.window = now
+		src.drops = 0
+	}
+	src.drops++
+	ban := src.drops > floodBanDrops
+	if ban {
+		src.drops = 0
+	}
+	src.mu.Unlock()
+
+	s.Stats.Mu.Lock()
+	s.Stats.RateLimited++
+	if ban {
+		s.Stats.Bans[ip.String()] = now.Add(floodBanDuration)
+	}
+	s.Stats.Mu.Unlock()
+	if ban && s.Config.Debug {
+		fmt.Printf("SIP: banning %s for %s (exceeding %d messages per second)\n", ip, floodBanDuration, int(rate))
+	}
+	return false
+}
+
+func (s *Server) countDrop(counter *uint64) {
+	s.Stats.Mu.Lock()
+	defer s.Stats.Mu.Unlock()
+	*counter++
+}
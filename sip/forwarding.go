@@ -0,0 +1,135 @@
+package sip
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/arednch/phonebook/configuration"
+	"github.com/arednch/phonebook/data"
+)
+
+// Diversion reasons.
+// https://datatracker.ietf.org/doc/html/rfc5806#section-4
+const (
+	diversionUnconditional = "unconditional"
+	diversionTimeOfDay     = "time-of-day"
+	diversionUnavailable   = "unavailable"
+	diversionUserBusy      = "user-busy"
+
+	statusBusyHere       = 486
+	statusBusyEverywhere = 600
+)
+
+// PrepareForwardingRule applies the dial plan to the number and target of a
+// rule so they match the dialed numbers, and checks whether the rule can apply.
+func (s *Server) PrepareForwardingRule(r *data.ForwardingRule) error {
+	s.init()
+	r.Number = s.normalizeNumber(r.Number)
+	r.Target = s.normalizeNumber(r.Target)
+	if r.Condition == data.ForwardBusy && !s.Config.IsSIPProxy() {
+		// Calls don't pass through us in redirect mode, so busy is never seen.
+		return fmt.Errorf("condition %q requires SIP mode %q", data.ForwardBusy, configuration.SIPModeProxy)
+	}
+	return nil
+}
+
+// forwardingRule returns the rule (along with the diversion reason) which
+// applies to a call to the number before looking up its destination.
+func (s *Server) forwardingRule(number string) (*data.ForwardingRule, string) {
+	if s.Forwarding == nil {
+		return nil, ""
+	}
+	now := time.Now()
+	if rule := s.Forwarding.Find(number, data.ForwardAlways, now); rule != nil {
+		if rule.IsTimed() {
+			return rule, diversionTimeOfDay
+		}
+		return rule, diversionUnconditional
+	}
+	if rule := s.Forwarding.Find(number, data.ForwardUnreachable, now); rule != nil && !s.isAvailable(number) {
+		return rule, diversionUnavailable
+	}
+	return nil, ""
+}
+
+// forwardTarget returns the contacts calls are forwarded to. Rules of the
+// target aren't applied again to avoid forwarding loops.
+func (s *Server) forwardTarget(rule *data.ForwardingRule) []*data.SIPAddress {
+	if g, ok := s.Groups[rule.Target]; ok {
+		return s.groupContacts(g)
+	}
+	if dst := s.findDestination(rule.Target); dst != nil {
+		return []*data.SIPAddress{dst}
+	}
+	return nil
+}
+
+// forwardResponse redirects a call according to the forwarding rule.
+func (s *Server) forwardResponse(req *data.SIPRequest, rule *data.ForwardingRule, reason string) *data.SIPResponse {
+	contacts := s.forwardTarget(rule)
+	if len(contacts) == 0 {
+		if s.Config.Debug {
+			fmt.Printf("  - Couldn't find forwarding destination %s for %s\n", rule.Target, rule.Number)
+		}
+		return data.NewSIPResponseFromRequest(req, http.StatusNotFound, "Not Found")
+	}
+	if s.Config.Debug {
+		fmt.Printf("  - Forwarding call to %s to %s (%s)\n", rule.Number, rule.Target, reason)
+	}
+
+	return redirectResponse(req, contacts, reason)
+}
+
+// redirectResponse redirects a request to the contacts on behalf of the
+// original destination which is indicated in the Diversion header. Requests
+// without a (valid) To header are rejected.
+// https://datatracker.ietf.org/doc/html/rfc5806
+func redirectResponse(req *data.SIPRequest, contacts []*data.SIPAddress, reason string) *data.SIPResponse {
+	to := req.To()
+	if to == nil || to.URI == nil {
+		return data.NewSIPResponseFromRequest(req, http.StatusBadRequest, "Bad Request")
+	}
+	resp := data.NewSIPResponseFromRequest(req, http.StatusFound, "Moved Temporarily")
+	for _, c := range contacts {
+		resp.AddHeader("Contact", c.String())
+	}
+	diversion := to.Clone()
+	diversion.Params = map[string]string{"reason": reason}
+	resp.AddHeader("Diversion", diversion.String())
+	return resp
+}
+
+// forwardBusy turns a busy response to a forwarded INVITE into a redirect
+// if there's a rule to forward calls to the callee when busy.
+func (s *Server) forwardBusy(inv *data.SIPRequest, resp *data.SIPResponse) {
+	if s.Forwarding == nil || (resp.StatusCode != statusBusyHere && resp.StatusCode != statusBusyEverywhere) {
+		return
+	}
+	to := inv.To()
+	if to == nil || to.URI == nil {
+		return
+	}
+	rule := s.Forwarding.Find(s.normalizeNumber(to.URI.User), data.ForwardBusy, time.Now())
+	if rule == nil {
+		return
+	}
+	contacts := s.forwardTarget(rule)
+	if len(contacts) == 0 {
+		return
+	}
+	if s.Config.Debug {
+		fmt.Printf("  - Forwarding busy call to %s to %s\n", rule.Number, rule.Target)
+	}
+
+	resp.StatusCode = http.StatusFound
+	resp.StatusMessage = "Moved Temporarily"
+	resp.Body = nil
+	resp.RemoveHeaders("Content-Type")
+	for _, c := range contacts {
+		resp.AddHeader("Contact", c.String())
+	}
+	diversion := to.Clone()
+	diversion.Params = map[string]string{"reason": diversionUserBusy}
+	resp.AddHeader("Diversion", diversion.String())
+}
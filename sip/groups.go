@@ -0,0 +1,85 @@
+package sip
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/arednch/phonebook/data"
+)
+
+// PrepareHuntGroup applies the dial plan to the number and the members of a
+// hunt group so they match the dialed and registered numbers.
+func (s *Server) PrepareHuntGroup(g *data.HuntGroup) {
+	s.init()
+	g.Number = s.normalizeNumber(g.Number)
+	for _, m := range g.Members {
+		m.Number = s.normalizeNumber(m.Number)
+	}
+}
+
+// isAvailable checks whether the phone is registered locally or with a peer
+// (federation), or active.
+func (s *Server) isAvailable(number string) bool {
+	if _, ok := s.RegisterCache.Get(number); ok {
+		return true
+	}
+	if s.findFederated(number) != nil {
+		return true
+	}
+	s.Records.Mu.RLock()
+	defer s.Records.Mu.RUnlock()
+	for _, e := range s.Records.Entries {
+		// Numbers in the phonebook may include the country prefix.
+		if (e.PhoneNumber == number || s.Config.GetLocalNumber(e.PhoneNumber) == number) && e.IsActive() {
+			return true
+		}
+	}
+	return false
+}
+
+// groupContacts returns the addresses of all available members of the hunt
+// group along with their q-value, ordered by priority.
+func (s *Server) groupContacts(g *data.HuntGroup) []*data.SIPAddress {
+	members := slices.Clone(g.Members)
+	slices.SortStableFunc(members, func(a, b *data.HuntGroupMember) int {
+		switch {
+		case a.Q() > b.Q():
+			return -1
+		case a.Q() < b.Q():
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	var contacts []*data.SIPAddress
+	for _, m := range members {
+		if !s.isAvailable(m.Number) {
+			continue
+		}
+		addr := s.findDestination(m.Number)
+		if addr == nil {
+			continue
+		}
+		addr.Params["q"] = strconv.FormatFloat(m.Q(), 'f', -1, 64)
+		contacts = append(contacts, addr)
+	}
+	return contacts
+}
+
+// groupResponse redirects a call to a hunt group to all of its available members.
+// https://datatracker.ietf.org/doc/html/rfc3261#section-8.1.3.4
+func (s *Server) groupResponse(req *data.SIPRequest, g *data.HuntGroup) *data.SIPResponse {
+	contacts := s.groupContacts(g)
+	if len(contacts) == 0 {
+		if s.Config.Debug {
+			fmt.Printf("  - No member of hunt group %s available\n", g.Number)
+		}
+		return data.NewSIPResponseFromRequest(req, statusTemporarilyUnavailable, "Temporarily Unavailable")
+	}
+	if s.Config.Debug {
+		fmt.Printf("  - Redirecting call to hunt group %s to %d members\n", g.Number, len(contacts))
+	}
+	return redirectResponse(req, contacts, diversionUnconditional)
+}
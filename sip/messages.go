@@ -0,0 +1,290 @@
+package sip
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/arednch/phonebook/data"
+)
+
+const (
+	// Interval in which the queue is checked for messages due for a retry.
+	messageQueueInterval = 30 * time.Second
+	// Backoff between delivery attempts, doubled with every attempt.
+	messageBackoffMin = 30 * time.Second
+	messageBackoffMax = time.Hour
+	// Messages not delivered within this time are given up on.
+	messageMaxAge = 24 * time.Hour
+	// Number of handled messages to keep for display.
+	messageHistorySize = 50
+)
+
+var (
+	errUnknownRecipient = errors.New("recipient not found in phonebook or registered phones")
+)
+
+// newMessageFromRequest converts a received SIP MESSAGE to a message which can be queued.
+func newMessageFromRequest(req *data.SIPRequest) *data.Message {
+	from, to := req.From(), req.To()
+	if from == nil || from.URI == nil || to == nil || to.URI == nil {
+		return nil
+	}
+	m := &data.Message{
+		From:          from.URI.User,
+		FromName:      from.DisplayName,
+		FromHost:      from.URI.Host,
+		To:            to.URI.User,
+		ToHost:        to.URI.Host,
+		ContentType:   "text/plain",
+		Body:          string(req.Body),
+		ReportFailure: true,
+	}
+	for _, hdr := range req.FindHeaders("Call-ID") {
+		m.CallID = hdr.Value
+		seq, _ := req.CSeq()
+		// Retransmissions share the Call-ID and CSeq and are detected this way.
+		m.ID = fmt.Sprintf("%s-%d", hdr.Value, seq)
+	}
+	for _, hdr := range req.FindHeaders("Content-Type") {
+		m.ContentType = hdr.Value
+	}
+	return m
+}
+
+// DeliverMessage queues the message and attempts to deliver it right away.
+// An error is returned when the message couldn't be delivered (yet).
+func (s *Server) DeliverMessage(m *data.Message) error {
+	if !s.enqueueMessage(m) {
+		return nil // already known
+	}
+	return s.attemptDelivery(m)
+}
+
+// enqueueMessage adds a message to the queue unless it is already known.
+func (s *Server) enqueueMessage(m *data.Message) bool {
+	s.Messages.Mu.Lock()
+	defer s.Messages.Mu.Unlock()
+
+	if m.ID == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		m.ID = hex.EncodeToString(b)
+	}
+	for _, q := range append(s.Messages.Pending, s.Messages.History...) {
+		if q.ID == m.ID {
+			return false
+		}
+	}
+
+	m.Status = data.MessagePending
+	m.Created = time.Now()
+	m.NextAttempt = m.Created
+	s.Messages.Pending = append(s.Messages.Pending, m)
+	s.saveMessagesLocked()
+	return true
+}
+
+// attemptDelivery tries to send a queued message and updates its state.
+func (s *Server) attemptDelivery(m *data.Message) error {
+	s.init()
+
+	// Avoid delivering the same message multiple times concurrently.
+	s.sendingMu.Lock()
+	if s.sending[m.ID] {
+		s.sendingMu.Unlock()
+		return errors.New("delivery already in progress")
+	}
+	s.sending[m.ID] = true
+	s.sendingMu.Unlock()
+	defer func() {
+		s.sendingMu.Lock()
+		delete(s.sending, m.ID)
+		s.sendingMu.Unlock()
+	}()
+
+	var err error
+	var permanent bool
+	var resp *data.SIPResponse
+	to := s.findContact(m.To)
+	if to == nil {
+		err = errUnknownRecipient
+	} else if resp, err = s.sendRequest(s.newMessageRequest(m, to), to.URI); err == nil && resp.StatusCode >= 300 {
+		err = fmt.Errorf("response not ok (%d %s)", resp.StatusCode, resp.StatusMessage)
+		// Client errors other than timeouts and unavailability won't go away by retrying.
+		permanent = resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != statusTemporarilyUnavailable
+	}
+
+	s.Messages.Mu.Lock()
+	now := time.Now()
+	m.Attempts++
+	switch {
+	case err == nil:
+		m.Status = data.MessageDelivered
+		m.LastError = ""
+	case permanent:
+		m.Status = data.MessageFailed
+		m.LastError = err.Error()
+	case now.Sub(m.Created) > messageMaxAge:
+		m.Status = data.MessageExpired
+		m.LastError = err.Error()
+	default:
+		m.LastError = err.Error()
+		backoff := messageBackoffMin << min(m.Attempts-1, 10)
+		m.NextAttempt = now.Add(min(backoff, messageBackoffMax))
+	}
+	var cdr *data.CDR
+	if m.Status != data.MessagePending {
+		m.Handled = now
+		s.archiveMessageLocked(m)
+		cdr = deliveryRecord(m, to, resp)
+		if m.ReportFailure && m.Status != data.MessageDelivered {
+			go s.DeliverMessage(failureNotice(m))
+		}
+	}
+	s.saveMessagesLocked()
+
+	if s.Config.Debug {
+		fmt.Printf("SIP/MESSAGE: delivery attempt %d of message %s from %s to %s: %s (%v)\n", m.Attempts, m.ID, m.From, m.To, m.Status, err)
+	}
+	s.Messages.Mu.Unlock()
+
+	// The record is written without blocking the message queue.
+	if cdr != nil {
+		s.recordCDR(cdr)
+	}
+	return err
+}
+
+// failureNotice creates a message telling the sender that a message couldn't
+// be delivered. It appears to come from the recipient so phones show it
+// along with the conversation.
+func failureNotice(m *data.Message) *data.Message {
+	to := &data.Entry{PhoneNumber: m.To}
+	return &data.Message{
+		ID:          m.ID + "-failed",
+		From:        m.To,
+		FromHost:    to.PhoneFQDN(),
+		To:          m.From,
+		ContentType: "text/plain",
+		Body:        fmt.Sprintf("Message not delivered (%s: %s): %s", m.Status, m.LastError, m.Body),
+	}
+}
+
+// archiveMessageLocked moves a handled message from the pending ones to the history.
+func (s *Server) archiveMessageLocked(m *data.Message) {
+	var pending []*data.Message
+	for _, p := range s.Messages.Pending {
+		if p != m {
+			pending = append(pending, p)
+		}
+	}
+	s.Messages.Pending = pending
+	s.Messages.History = append([]*data.Message{m}, s.Messages.History...)
+	if len(s.Messages.History) > messageHistorySize {
+		s.Messages.History = s.Messages.History[:messageHistorySize]
+	}
+}
+
+// newMessageRequest creates the SIP request for a queued message.
+func (s *Server) newMessageRequest(m *data.Message, to *data.SIPAddress) *data.SIPRequest {
+	from := &data.SIPAddress{
+		DisplayName: m.FromName,
+		URI: &data.SIPURI{
+			User: m.From,
+			Host: m.FromHost,
+		},
+	}
+	hdrs := []*data.SIPHeader{
+		{
+			Name:  "Content-Type",
+			Value: m.ContentType,
+		},
+	}
+	return data.NewSIPRequest("MESSAGE", from, to, 1, hdrs, []byte(m.Body))
+}
+
+// flushMessages attempts to deliver all pending messages for which the filter returns true.
+func (s *Server) flushMessages(filter func(m *data.Message) bool) {
+	s.Messages.Mu.RLock()
+	var due []*data.Message
+	for _, m := range s.Messages.Pending {
+		if filter(m) {
+			due = append(due, m)
+		}
+	}
+	s.Messages.Mu.RUnlock()
+
+	for _, m := range due {
+		s.attemptDelivery(m)
+	}
+}
+
+// FlushMessagesTo attempts to deliver all pending messages to a recipient (e.g. when it registers).
+func (s *Server) FlushMessagesTo(to string) {
+	s.flushMessages(func(m *data.Message) bool {
+		return m.To == to
+	})
+}
+
+// FlushRoutableMessages attempts to deliver pending messages to all recipients
+// which currently have a route (e.g. after the routing data was refreshed).
+func (s *Server) FlushRoutableMessages() {
+	routable := make(map[string]bool)
+	s.Records.Mu.RLock()
+	for _, e := range s.Records.Entries {
+		if e.Route != nil {
+			routable[e.PhoneNumber] = true
+		}
+	}
+	s.Records.Mu.RUnlock()
+
+	s.flushMessages(func(m *data.Message) bool {
+		return routable[m.To]
+	})
+}
+
+// RunMessageQueue periodically retries delivering pending messages which are due.
+func (s *Server) RunMessageQueue() {
+	for range time.Tick(messageQueueInterval) {
+		now := time.Now()
+		s.flushMessages(func(m *data.Message) bool {
+			return !m.NextAttempt.After(now)
+		})
+	}
+}
+
+// LoadMessages restores the queue and history from disk.
+func (s *Server) LoadMessages(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	s.Messages.Mu.Lock()
+	defer s.Messages.Mu.Unlock()
+	return json.Unmarshal(b, s.Messages)
+}
+
+// saveMessagesLocked persists the queue and history if a path is configured.
+// Needs to be called while holding the lock.
+func (s *Server) saveMessagesLocked() {
+	path := s.Config.GetMessagesPath()
+	if path == "" {
+		return
+	}
+	b, err := json.MarshalIndent(s.Messages, "", "  ")
+	if err != nil {
+		fmt.Printf("unable to convert SIP messages: %s\n", err)
+		return
+	}
+	if err := writeFileAtomic(path, b); err != nil {
+		fmt.Printf("unable to persist SIP messages to %q: %s\n", path, err)
+	}
+}
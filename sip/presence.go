@@ -0,0 +1,316 @@
+package sip
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arednch/phonebook/data"
+)
+
+const (
+	// Subscription expiry when clients don't ask for a specific one.
+	subscribeExpiration = 10 * time.Minute
+	// Bounds for subscription expiry in seconds.
+	minSubscribeExpires = 60
+	maxSubscribeExpires = 60 * 60
+
+	// Interval in which state changes (e.g. routes) and expired subscriptions are checked.
+	presenceInterval = 15 * time.Second
+
+	statusBadEvent = 489
+)
+
+var (
+	// Supported event packages.
+	// https://datatracker.ietf.org/doc/html/rfc3856
+	// https://datatracker.ietf.org/doc/html/rfc4235
+	eventPackages = []string{
+		"presence",
+		"dialog",
+	}
+)
+
+// subscription is a dialog created by a SUBSCRIBE in which we notify the
+// subscriber about the state of a phone.
+type subscription struct {
+	Event   string
+	User    string           // phone number whose state is subscribed to
+	Contact *data.SIPURI     // where NOTIFYs are sent to
+	CallID  string           // Call-ID of the dialog
+	Local   *data.SIPAddress // our side of the dialog (incl. tag)
+	Remote  *data.SIPAddress // subscriber side of the dialog (incl. tag)
+
+	mu      sync.Mutex
+	expires time.Time
+	cseq    int
+	version int    // version of the dialog-info document
+	state   string // last state notified
+}
+
+func subscriptionKey(callID, tag, event string) string {
+	return strings.Join([]string{callID, tag, event}, " ")
+}
+
+// eventPackage returns the event package of the request without parameters.
+func eventPackage(req *data.SIPRequest) string {
+	for _, hdr := range req.FindHeaders("Event") {
+		pkg, _, _ := strings.Cut(hdr.Value, ";")
+		return strings.ToLower(strings.TrimSpace(pkg))
+	}
+	return ""
+}
+
+// handleSubscribe creates, refreshes or ends subscriptions to the state of a phone.
+// https://datatracker.ietf.org/doc/html/rfc6665#section-4.2
+func (s *Server) handleSubscribe(req *data.SIPRequest) (*data.SIPResponse, error) {
+	event := eventPackage(req)
+	if !slices.Contains(eventPackages, event) {
+		resp := data.NewSIPResponseFromRequest(req, statusBadEvent, "Bad Event")
+		resp.AddHeader("Allow-Events", strings.Join(eventPackages, ", "))
+		return resp, nil
+	}
+
+	expires := int(subscribeExpiration.Seconds())
+	for _, hdr := range req.FindHeaders("Expires") {
+		if e, err := strconv.Atoi(strings.TrimSpace(hdr.Value)); err == nil && e >= 0 {
+			expires = e
+		}
+		break
+	}
+	if expires > 0 && expires < minSubscribeExpires {
+		resp := data.NewSIPResponseFromRequest(req, statusIntervalTooBrief, "Interval Too Brief")
+		resp.AddHeader("Min-Expires", strconv.Itoa(minSubscribeExpires))
+		return resp, nil
+	}
+	expires = min(expires, maxSubscribeExpires)
+
+	from, to, contact := req.From(), req.To(), req.Contact()
+	callIDs := req.HeaderValues("Call-ID")
+	if from == nil || from.Params["tag"] == "" || to == nil || contact == nil || contact.URI == nil || len(callIDs) == 0 {
+		return data.NewSIPResponseFromRequest(req, http.StatusBadRequest, "Bad Request"), nil
+	}
+	key := subscriptionKey(callIDs[0], from.Params["tag"], event)
+
+	s.subMu.Lock()
+	sub, ok := s.subs[key]
+	switch {
+	case ok:
+		// Refresh (or end) of an existing subscription.
+	case to.Params["tag"] != "":
+		s.subMu.Unlock()
+		return data.NewSIPResponseFromRequest(req, statusCallDoesNotExist, "Call/Transaction Does Not Exist"), nil
+	default:
+		user := req.RequestURI().User
+		if user == "" {
+			user = to.URI.User
+		}
+		user = s.normalizeNumber(user)
+		if s.findContact(user) == nil {
+			s.subMu.Unlock()
+			return data.NewSIPResponseFromRequest(req, http.StatusNotFound, "Not Found"), nil
+		}
+		local := to.Clone()
+		if local.Params == nil {
+			local.Params = make(map[string]string)
+		}
+		local.Params["tag"] = data.GenerateFromTag()
+		sub = &subscription{
+			Event:   event,
+			User:    user,
+			CallID:  callIDs[0],
+			Local:   local,
+			Remote:  from.Clone(),
+			Contact: contact.URI,
+		}
+		s.subs[key] = sub
+	}
+	if expires == 0 {
+		delete(s.subs, key)
+	}
+	s.subMu.Unlock()
+
+	sub.mu.Lock()
+	sub.expires = time.Now().Add(time.Duration(expires) * time.Second)
+	sub.Contact = contact.URI // target refresh
+	sub.mu.Unlock()
+	if s.Config.Debug {
+		fmt.Printf("SIP/SUBSCRIBE: %s subscribed to %s of %s (expires in %ds)\n", from, event, sub.User, expires)
+	}
+
+	resp := data.NewSIPResponseFromRequest(req, http.StatusOK, "OK")
+	resp.RemoveHeaders("To")
+	resp.AddHeader("To", sub.Local.String())
+	resp.AddHeader("Expires", strconv.Itoa(expires))
+	if host := req.RequestURI().Host; host != "" {
+		resp.AddHeader("Contact", fmt.Sprintf("<sip:%s:%d>", host, s.Config.SIPPort))
+	}
+
+	// Every subscription (and refresh) is answered with the current state.
+	// https://datatracker.ietf.org/doc/html/rfc6665#section-4.2.1.2
+	reason := ""
+	if expires == 0 {
+		reason = "timeout"
+	}
+	go s.notify(sub, reason, true)
+	return resp, nil
+}
+
+// presenceState returns whether the phone is available along with the contact to reach it.
+func (s *Server) presenceState(user string) (string, string) {
+	if reg, ok := s.RegisterCache.Get(user); ok {
+		return data.PresenceOpen, reg.Address.URI.String()
+	}
+	s.Records.Mu.RLock()
+	defer s.Records.Mu.RUnlock()
+	for _, e := range s.Records.Entries {
+		if e.PhoneNumber == user && e.IsActive() {
+			return data.PresenceOpen, "sip:" + e.DirectCallAddress()
+		}
+	}
+	return data.PresenceClosed, ""
+}
+
+// eventState returns the current state of the subscribed phone as a document
+// of the subscription's event package along with its content type. The state
+// summarizes the document to detect changes.
+func (s *Server) eventState(sub *subscription) (any, string, string) {
+	entity := fmt.Sprintf("sip:%s@%s", sub.User, data.AREDNDomain)
+	if sub.Event == "dialog" {
+		dialogs := s.dialogState(sub.User)
+		var states []string
+		for _, d := range dialogs {
+			states = append(states, d.ID+"="+d.State)
+		}
+		doc := &data.DialogInfo{
+			State:   "full",
+			Entity:  entity,
+			Dialogs: dialogs,
+		}
+		return doc, "application/dialog-info+xml", strings.Join(states, ",")
+	}
+
+	state, contact := s.presenceState(sub.User)
+	doc := &data.PIDFPresence{
+		Entity: entity,
+		Tuples: []*data.PIDFTuple{
+			{
+				ID:      sub.User,
+				Basic:   state,
+				Contact: contact,
+			},
+		},
+	}
+	return doc, "application/pidf+xml", state
+}
+
+// notify sends the current state to the subscriber. The subscription is
+// terminated when a reason is given. Unless forced, the state is only sent
+// when it changed since the last notification.
+func (s *Server) notify(sub *subscription, reason string, force bool) {
+	doc, contentType, state := s.eventState(sub)
+
+	sub.mu.Lock()
+	if !force && reason == "" && state == sub.state {
+		sub.mu.Unlock()
+		return
+	}
+	sub.state = state
+	sub.cseq++
+	seq := sub.cseq
+	if di, ok := doc.(*data.DialogInfo); ok {
+		di.Version = sub.version // starts at 0
+		sub.version++
+	}
+	remaining := int(time.Until(sub.expires).Round(time.Second).Seconds())
+	target := sub.Contact
+	sub.mu.Unlock()
+
+	body, err := xml.Marshal(doc)
+	if err != nil {
+		fmt.Printf("SIP/NOTIFY: unable to convert %s state: %s\n", sub.Event, err)
+		return
+	}
+
+	subState := fmt.Sprintf("active;expires=%d", max(remaining, 0))
+	if reason != "" {
+		subState = "terminated;reason=" + reason
+	}
+	hdrs := []*data.SIPHeader{
+		{Name: "Event", Value: sub.Event},
+		{Name: "Subscription-State", Value: subState},
+		{Name: "Content-Type", Value: contentType},
+	}
+	to := sub.Remote.Clone()
+	to.URI = target
+	req := data.NewSIPRequest("NOTIFY", sub.Local, to, seq, hdrs, append([]byte(xml.Header), body...))
+	// NOTIFYs are sent within the dialog of the subscription.
+	req.RemoveHeaders("To")
+	req.AddHeader("To", sub.Remote.String())
+	req.RemoveHeaders("Call-ID")
+	req.AddHeader("Call-ID", sub.CallID)
+
+	resp, err := s.sendRequest(req, target)
+	if err != nil || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == statusCallDoesNotExist {
+		// The subscriber is gone, no need to keep notifying it.
+		if s.Config.Debug {
+			fmt.Printf("SIP/NOTIFY: removing subscription of %s to %s: %v\n", sub.Remote, sub.User, err)
+		}
+		s.removeSubscription(sub)
+	}
+}
+
+func (s *Server) removeSubscription(sub *subscription) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	for k, v := range s.subs {
+		if v == sub {
+			delete(s.subs, k)
+		}
+	}
+}
+
+// subscriptions returns all current subscriptions, optionally only the ones for a phone number.
+func (s *Server) subscriptions(user string) []*subscription {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	var subs []*subscription
+	for _, sub := range s.subs {
+		if user == "" || sub.User == user {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// notifyPresence notifies subscribers of a phone when its state changed (e.g. it registered).
+func (s *Server) notifyPresence(user string) {
+	for _, sub := range s.subscriptions(user) {
+		s.notify(sub, "", false)
+	}
+}
+
+// RunPresence periodically ends expired subscriptions and notifies subscribers
+// about state changes not caused by registrations (e.g. routes and expired registrations).
+func (s *Server) RunPresence() {
+	s.init()
+	for range time.Tick(presenceInterval) {
+		now := time.Now()
+		for _, sub := range s.subscriptions("") {
+			sub.mu.Lock()
+			expired := now.After(sub.expires)
+			sub.mu.Unlock()
+			if expired {
+				s.removeSubscription(sub)
+				go s.notify(sub, "timeout", true)
+				continue
+			}
+			go s.notify(sub, "", false)
+		}
+	}
+}
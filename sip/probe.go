@@ -0,0 +1,114 @@
+package sip
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arednch/phonebook/data"
+)
+
+const (
+	// Number of phones probed in parallel.
+	probeWorkers = 8
+	// User we send probes as.
+	probeUser = "phonebook"
+)
+
+// RunProber periodically sends OPTIONS to all phones with a route and records
+// whether (and how fast) they answer on their phonebook entry.
+func (s *Server) RunProber(interval time.Duration) {
+	for {
+		s.probeAll()
+		time.Sleep(interval)
+	}
+}
+
+func (s *Server) probeAll() {
+	var numbers []string
+	s.Records.Mu.RLock()
+	for _, e := range s.Records.Entries {
+		if e.Route != nil {
+			numbers = append(numbers, e.PhoneNumber)
+		}
+	}
+	s.Records.Mu.RUnlock()
+
+	results := make(map[string]*data.Reachability)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for range min(probeWorkers, len(numbers)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for number := range queue {
+				r := s.probe(number)
+				mu.Lock()
+				results[number] = r
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, number := range numbers {
+		queue <- number
+	}
+	close(queue)
+	wg.Wait()
+
+	s.Records.Mu.Lock()
+	defer s.Records.Mu.Unlock()
+	var responding int
+	for _, e := range s.Records.Entries {
+		if r, ok := results[e.PhoneNumber]; ok && e.Route != nil {
+			e.Reachability = r
+			if r.Responding {
+				responding++
+			}
+		}
+	}
+	// Phones (not) responding anymore change their position (active first).
+	sort.Sort(data.ByName(s.Records.Entries))
+	if s.Config.Debug {
+		fmt.Printf("SIP/Probe: %d of %d phones with a route are responding\n", responding, len(results))
+	}
+}
+
+// probe sends an OPTIONS request to the phone. Any response (even an error
+// or authentication challenge) means the phone is reachable.
+func (s *Server) probe(number string) *data.Reachability {
+	r := &data.Reachability{
+		Checked: time.Now(),
+	}
+	to := s.findContact(number)
+	if to == nil {
+		return r
+	}
+	from := &data.SIPAddress{
+		URI: &data.SIPURI{
+			User: probeUser,
+			Host: data.AREDNLocalNode,
+		},
+	}
+	req := data.NewSIPRequest("OPTIONS", from, to, 1, nil, nil)
+	start := time.Now()
+	resp, err := s.sendRequest(req, to.URI)
+	if err != nil || resp.StatusCode == http.StatusRequestTimeout {
+		if s.Config.Debug {
+			fmt.Printf("SIP/Probe: %s not responding (%v)\n", number, err)
+		}
+		return r
+	}
+	r.Responding = true
+	r.Latency = time.Since(start)
+	for _, name := range []string{"User-Agent", "Server"} {
+		for _, hdr := range resp.FindHeaders(name) {
+			if r.UserAgent == "" {
+				r.UserAgent = hdr.Value
+			}
+		}
+	}
+	return r
+}
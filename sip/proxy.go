@@ -0,0 +1,472 @@
+package sip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arednch/phonebook/data"
+)
+
+const (
+	// Time to keep track of a forwarded transaction. This corresponds to Timer C
+	// and is refreshed with every provisional response to an INVITE.
+	// https://datatracker.ietf.org/doc/html/rfc3261#section-16.6
+	proxyTransactionTimeout = 3 * time.Minute
+
+	statusCallDoesNotExist = 481
+	statusTooManyHops      = 483
+)
+
+var (
+	// Methods forwarded to their destination when running in proxy mode.
+	proxied = []string{
+		"INVITE",
+		"ACK",
+		"BYE",
+		"CANCEL",
+	}
+)
+
+func isProxied(method string) bool {
+	return slices.Contains(proxied, method)
+}
+
+// proxyTransaction keeps track of a request forwarded in proxy mode so that
+// responses and CANCELs can be related to it.
+type proxyTransaction struct {
+	Server      *serverTransaction // transaction of the original request
+	Out         sender             // connection the request was forwarded on
+	Destination net.Addr           // where the request was forwarded to
+	Request     *data.SIPRequest   // request as forwarded (incl. our Via)
+
+	responses chan *data.SIPResponse // responses received, see retransmitRequest
+
+	mu    sync.Mutex
+	final *data.SIPResponse // final response once received
+}
+
+func (t *proxyTransaction) Final() *data.SIPResponse {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.final
+}
+
+func (t *proxyTransaction) setFinal(resp *data.SIPResponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.final = resp
+}
+
+func originKey(branch, method string) string {
+	return branch + " " + method
+}
+
+// proxyRequest forwards a request to its destination, adding our own Via
+// (and Record-Route for INVITEs) so responses and the rest of the dialog
+// run through this server.
+func (s *Server) proxyRequest(stx *serverTransaction, req *data.SIPRequest) {
+	if s.Config.Debug {
+		fmt.Printf("SIP/Proxy: received %s from %s to %s\n", req.Method, req.From(), req.To())
+	}
+
+	via := req.TopVia()
+	if via == nil {
+		if s.Config.Debug {
+			fmt.Printf("  - Ignoring %s without Via\n", req.Method)
+		}
+		return
+	}
+	// ACKs are never answered.
+	reject := func(code int, reason string) {
+		if req.Method == "ACK" {
+			return
+		}
+		resp := data.NewSIPResponseFromRequest(req, code, reason)
+		s.recordTransaction(req, resp, "")
+		s.respond(stx, resp)
+	}
+
+	// ACKs for non-2xx responses and retransmissions were already handled by
+	// the transaction layer.
+	switch req.Method {
+	case "CANCEL":
+		s.proxyCancel(stx, req, via)
+		return
+	case "ACK":
+		// ACKs without a To tag belong to final responses we generated ourselves.
+		if to := req.To(); to == nil || to.Params["tag"] == "" {
+			return
+		}
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc3261#section-16.3
+	fwd := req.Clone()
+	fwd.RemoveHeaders("Proxy-Authorization") // credentials were meant for us
+	maxForwards := 70
+	for _, hdr := range fwd.FindHeaders("Max-Forwards") {
+		if mf, err := strconv.Atoi(strings.TrimSpace(hdr.Value)); err == nil {
+			maxForwards = mf
+		}
+	}
+	if maxForwards <= 0 {
+		reject(statusTooManyHops, "Too Many Hops")
+		return
+	}
+	fwd.RemoveHeaders("Max-Forwards")
+	fwd.AddHeader("Max-Forwards", strconv.Itoa(maxForwards-1))
+
+	next, ok := s.nextHop(fwd)
+	if !ok {
+		if s.Config.Debug {
+			fmt.Printf("  - Couldn't find destination for %s to %s\n", req.Method, req.URI)
+		}
+		reject(http.StatusNotFound, "Not Found")
+		return
+	}
+
+	port := next.Port
+	if port == 0 {
+		port = expectedPhoneSIPPort
+	}
+	dst, err := net.ResolveUDPAddr("udp", net.JoinHostPort(next.Host, strconv.Itoa(port)))
+	if err != nil {
+		if s.Config.Debug {
+			fmt.Printf("  - Unable to resolve %s: %s\n", next.Host, err)
+		}
+		reject(http.StatusNotFound, "Not Found")
+		return
+	}
+	out, err := s.outbound(dst, next.Params["transport"])
+	if err != nil {
+		if s.Config.Debug {
+			fmt.Printf("  - Unable to connect to %s: %s\n", dst, err)
+		}
+		reject(http.StatusServiceUnavailable, "Service Unavailable")
+		return
+	}
+	local, err := localAddrFor(dst)
+	if err != nil {
+		if s.Config.Debug {
+			fmt.Printf("  - Unable to determine local address towards %s: %s\n", dst, err)
+		}
+		reject(http.StatusServiceUnavailable, "Service Unavailable")
+		return
+	}
+	host := net.JoinHostPort(local.String(), strconv.Itoa(s.Config.SIPPort))
+
+	if req.Method == "INVITE" {
+		fwd.PushHeaderValue("Record-Route", fmt.Sprintf("<sip:%s;lr>", host))
+	}
+	branch := data.GenerateBranch()
+	own := &data.SIPVia{
+		Transport: out.Transport(),
+		Host:      local.String(),
+		Port:      s.Config.SIPPort,
+		Params:    map[string]string{"branch": branch, "rport": ""},
+	}
+	fwd.PushHeaderValue("Via", own.String())
+
+	if req.Method != "ACK" {
+		tx := &proxyTransaction{
+			Server:      stx,
+			Out:         out,
+			Destination: dst,
+			Request:     fwd,
+			responses:   make(chan *data.SIPResponse, 1),
+		}
+		s.proxyTxs.Set(branch, tx, proxyTransactionTimeout)
+		if via.Branch() != "" {
+			s.proxyTxOrigin.Set(originKey(via.Branch(), req.Method), tx, proxyTransactionTimeout)
+		}
+		// Retransmissions of the original request are absorbed by its server
+		// transaction, the forwarded one is retransmitted by us.
+		go s.retransmitRequest(tx)
+	}
+
+	if s.Config.Debug {
+		fmt.Printf("  - Forwarding %s to %s\n", req.Method, dst)
+	}
+	s.writeRequest(out, dst, fwd)
+
+	switch to := req.To(); {
+	case req.Method == "INVITE" && (to == nil || to.Params["tag"] == ""):
+		s.trackCall(req, fwd)
+	case req.Method == "BYE":
+		if callIDs := req.HeaderValues("Call-ID"); len(callIDs) > 0 {
+			s.endCall(callIDs[0])
+		}
+	}
+}
+
+// nextHop determines where a request should be forwarded to. It updates the
+// Request-URI for initial requests and removes our own Route (loose routing).
+func (s *Server) nextHop(req *data.SIPRequest) (*data.SIPURI, bool) {
+	// https://datatracker.ietf.org/doc/html/rfc3261#section-16.4
+	if routes := req.HeaderValues("Route"); len(routes) > 0 {
+		top := &data.SIPAddress{}
+		if err := top.Parse(routes[0]); err == nil && s.isOwnURI(top.URI) {
+			req.PopHeaderValue("Route")
+			routes = routes[1:]
+		}
+		if len(routes) > 0 {
+			next := &data.SIPAddress{}
+			if err := next.Parse(routes[0]); err != nil {
+				return nil, false
+			}
+			return next.URI, true
+		}
+		return req.RequestURI(), true
+	}
+
+	// Requests within a dialog (To tag set) are sent to the remote target.
+	ruri := req.RequestURI()
+	if to := req.To(); to != nil && to.Params["tag"] != "" {
+		return ruri, true
+	}
+
+	// Initial requests need to be directed at us and are looked up in the
+	// phonebook and registered clients.
+	if !s.isLocalIdentity(ruri.Host) {
+		return nil, false
+	}
+	user := s.normalizeNumber(ruri.User)
+	if rule, _ := s.forwardingRule(user); rule != nil {
+		if contacts := s.forwardTarget(rule); len(contacts) > 0 {
+			req.URI = contacts[0].URI.String()
+			return contacts[0].URI, true
+		}
+		return nil, false
+	}
+	// Without forking, calls to hunt groups go to the member with the highest priority.
+	if g, ok := s.Groups[user]; ok {
+		if contacts := s.groupContacts(g); len(contacts) > 0 {
+			req.URI = contacts[0].URI.String()
+			return contacts[0].URI, true
+		}
+		return nil, false
+	}
+	dst := s.findDestination(user)
+	if dst == nil {
+		return nil, false
+	}
+	req.URI = dst.URI.String()
+	return dst.URI, true
+}
+
+// isOwnURI checks if the URI (e.g. from a Route header) points at this server.
+func (s *Server) isOwnURI(uri *data.SIPURI) bool {
+	port := uri.Port
+	if port == 0 {
+		port = expectedPhoneSIPPort
+	}
+	return port == s.Config.SIPPort && s.isLocalIdentity(uri.Host)
+}
+
+// proxyCancel answers a CANCEL and forwards it along the matching INVITE.
+// https://datatracker.ietf.org/doc/html/rfc3261#section-16.10
+func (s *Server) proxyCancel(stx *serverTransaction, req *data.SIPRequest, via *data.SIPVia) {
+	tx, ok := s.proxyTxOrigin.Get(originKey(via.Branch(), "INVITE"))
+	if !ok {
+		s.respond(stx, data.NewSIPResponseFromRequest(req, statusCallDoesNotExist, "Call/Transaction Does Not Exist"))
+		return
+	}
+	s.respond(stx, data.NewSIPResponseFromRequest(req, http.StatusOK, "OK"))
+	if tx.Final() != nil {
+		return // nothing left to cancel
+	}
+	s.writeRequest(tx.Out, tx.Destination, newHopRequest("CANCEL", tx.Request, nil))
+}
+
+// proxyResponse forwards a response back to where the request originated from.
+func (s *Server) proxyResponse(resp *data.SIPResponse) {
+	via := resp.TopVia()
+	if via == nil {
+		return
+	}
+	tx, ok := s.proxyTxs.Get(via.Branch())
+	if !ok {
+		if s.Config.Debug {
+			fmt.Printf("SIP/Proxy: ignoring response without matching transaction: %d %s\n", resp.StatusCode, resp.StatusMessage)
+		}
+		return
+	}
+	_, method := resp.CSeq()
+	if method == "CANCEL" {
+		return // CANCEL was already answered by us
+	}
+
+	// Retransmitted responses are dropped if the previous one wasn't picked up yet.
+	select {
+	case tx.responses <- resp:
+	default:
+	}
+	if resp.StatusCode >= 200 {
+		if tx.Final() == nil {
+			s.recordTransaction(tx.Request, resp, tx.Request.RequestURI().String())
+		}
+		tx.setFinal(resp)
+	} else {
+		// Keep the transaction alive while the phone is ringing.
+		s.proxyTxs.Set(via.Branch(), tx, proxyTransactionTimeout)
+		s.proxyTxOrigin.Set(originKey(tx.originBranch(), method), tx, proxyTransactionTimeout)
+	}
+	if method == "INVITE" {
+		s.updateCall(resp)
+	}
+	if method == "INVITE" && resp.StatusCode >= 300 {
+		// https://datatracker.ietf.org/doc/html/rfc3261#section-17.1.1.3
+		s.writeRequest(tx.Out, tx.Destination, newHopRequest("ACK", tx.Request, resp.FindHeaders("To")))
+	}
+	if resp.StatusCode == http.StatusContinue {
+		return // hop-by-hop, ours is sent by the transaction layer
+	}
+
+	fwd := &data.SIPResponse{
+		SIPMessage: data.SIPMessage{
+			SIPVersion: resp.SIPVersion,
+			Body:       resp.Body,
+		},
+		StatusCode:    resp.StatusCode,
+		StatusMessage: resp.StatusMessage,
+	}
+	for _, h := range resp.Headers {
+		hdr := h.Clone()
+		fwd.Headers = append(fwd.Headers, &hdr)
+	}
+	fwd.PopHeaderValue("Via")
+	if method == "INVITE" {
+		s.forwardBusy(tx.Request, fwd)
+	}
+	if s.Config.Debug {
+		fmt.Printf("SIP/Proxy: forwarding response %d %s to %s\n", resp.StatusCode, resp.StatusMessage, tx.Server.addr)
+	}
+	s.respond(tx.Server, fwd)
+}
+
+// retransmitRequest retransmits a forwarded request over UDP until a response
+// arrives (Timer A/E) and answers the original request with a 408 response when
+// the destination doesn't respond in time (Timer B/F). Once a provisional
+// response to an INVITE was received, proxyTransactionTimeout (Timer C) applies.
+// https://datatracker.ietf.org/doc/html/rfc3261#section-16.8
+func (s *Server) retransmitRequest(tx *proxyTransaction) {
+	invite := tx.Request.Method == "INVITE"
+	interval := timerT1
+	retransmit := time.NewTimer(interval)
+	defer retransmit.Stop()
+	if tx.Out.Transport() != "UDP" {
+		retransmit.Stop()
+	}
+	wait := timerF
+	if invite {
+		wait = timerB
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		select {
+		case resp := <-tx.responses:
+			if invite || resp.StatusCode >= 200 {
+				return
+			}
+			// Provisional responses stop retransmissions from speeding up.
+			interval = timerT2
+		case <-retransmit.C:
+			if tx.Final() != nil {
+				return
+			}
+			s.writeRequest(tx.Out, tx.Destination, tx.Request)
+			interval *= 2
+			if !invite {
+				interval = min(interval, timerT2)
+			}
+			retransmit.Reset(interval)
+		case <-timeout.C:
+			if tx.Final() != nil {
+				return
+			}
+			if s.Config.Debug {
+				fmt.Printf("SIP/Proxy: no response to %s from %s\n", tx.Request.Method, tx.Destination)
+			}
+			resp := data.NewSIPResponseFromRequest(tx.Request, http.StatusRequestTimeout, "Request Timeout")
+			tx.setFinal(resp)
+			s.recordTransaction(tx.Request, resp, tx.Request.RequestURI().String())
+			if invite {
+				s.updateCall(resp)
+			}
+			s.respond(tx.Server, data.NewSIPResponseFromRequest(tx.Server.req, http.StatusRequestTimeout, "Request Timeout"))
+			return
+		}
+	}
+}
+
+// originBranch returns the branch of the Via the original request was received with.
+func (t *proxyTransaction) originBranch() string {
+	vals := t.Request.HeaderValues("Via")
+	if len(vals) < 2 {
+		return ""
+	}
+	via := &data.SIPVia{}
+	if err := via.Parse(vals[1]); err != nil {
+		return ""
+	}
+	return via.Branch()
+}
+
+// newHopRequest creates a CANCEL or ACK for a forwarded INVITE which are sent
+// hop-by-hop and need to carry the same top Via as the INVITE.
+func newHopRequest(method string, inv *data.SIPRequest, to []*data.SIPHeader) *data.SIPRequest {
+	req := &data.SIPRequest{
+		SIPMessage: data.SIPMessage{
+			SIPVersion: inv.SIPVersion,
+		},
+		Method: method,
+		URI:    inv.URI,
+	}
+	if vias := inv.HeaderValues("Via"); len(vias) > 0 {
+		req.AddHeader("Via", vias[0])
+	}
+	if to == nil {
+		to = inv.FindHeaders("To")
+	}
+	for _, name := range []string{"From", "Call-ID", "Route"} {
+		for _, h := range inv.FindHeaders(name) {
+			hdr := h.Clone()
+			req.Headers = append(req.Headers, &hdr)
+		}
+	}
+	for _, h := range to {
+		hdr := h.Clone()
+		req.Headers = append(req.Headers, &hdr)
+	}
+	seq, _ := inv.CSeq()
+	req.AddHeader("CSeq", fmt.Sprintf("%d %s", seq, method))
+	req.AddHeader("Max-Forwards", data.DefaultMaxForwards)
+	return req
+}
+
+func (s *Server) writeRequest(conn sender, addr net.Addr, req *data.SIPRequest) {
+	out := req.Serialize(true)
+	if s.Config.Debug {
+		fmt.Printf("SIP/Proxy/Request (%d bytes):\n%s\n", len(out), string(out))
+	}
+	if _, err := conn.WriteTo(out, addr); s.Config.Debug && err != nil {
+		fmt.Printf("SIP/Proxy/Request: unable to write: %s", err)
+	}
+}
+
+// localAddrFor returns the local IP used to reach the destination. No packets
+// are sent as UDP is connectionless.
+func localAddrFor(dst *net.UDPAddr) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, dst)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
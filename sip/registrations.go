@@ -0,0 +1,72 @@
+package sip
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/arednch/phonebook/data"
+)
+
+// SaveRegistrations writes the currently registered clients to a file so they
+// can be restored after a restart. The file is only written when the
+// registrations changed since the last call to avoid unnecessary disk writes.
+func (s *Server) SaveRegistrations(path string) error {
+	// Sorting keeps the output stable so unchanged registrations can be detected.
+	entries := s.RegisterCache.Snapshot()
+	slices.SortFunc(entries, func(a, b data.CacheEntry[string, *data.SIPClient]) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+	if bytes.Equal(b, s.lastSnapshot) {
+		return nil
+	}
+
+	if err := writeFileAtomic(path, b); err != nil {
+		return err
+	}
+	s.lastSnapshot = b
+	return nil
+}
+
+// LoadRegistrations restores registered clients from a file written by
+// SaveRegistrations. Expired registrations are dropped.
+func (s *Server) LoadRegistrations(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var entries []data.CacheEntry[string, *data.SIPClient]
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return 0, err
+	}
+	return s.RegisterCache.Restore(entries), nil
+}
+
+// writeFileAtomic writes to a temporary file first so a crash doesn't leave a
+// partial file behind.
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
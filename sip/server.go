@@ -3,11 +3,16 @@ package sip
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/arednch/phonebook/configuration"
@@ -15,12 +20,22 @@ import (
 )
 
 const (
+	// Registration expiry when clients don't ask for a specific one.
 	registerExpiration = 10 * time.Minute
 
+	statusIntervalTooBrief       = 423
+	statusTemporarilyUnavailable = 480
+
 	// UDP Port where phones are expected to listen on.
 	expectedPhoneSIPPort = 5060
 
-	maxPacketSize = 1500
+	// Maximum size of a UDP datagram. Larger messages need to be sent via TCP.
+	maxPacketSize = 65535
+
+	// Bounds of the delay before reading or accepting again after an error
+	// (e.g. running out of file descriptors).
+	minErrorBackoff = 5 * time.Millisecond
+	maxErrorBackoff = time.Second
 )
 
 var (
@@ -28,9 +43,18 @@ var (
 		"INVITE",
 		"ACK",
 		"MESSAGE",
+		"OPTIONS",
+		"SUBSCRIBE",
 	}
 )
 
+func (s *Server) allowed() []string {
+	if s.Config.IsSIPProxy() {
+		return slices.Concat(supported, proxied)
+	}
+	return supported
+}
+
 type Server struct {
 	Config *configuration.Config
 
@@ -39,33 +63,165 @@ type Server struct {
 
 	// Local hostnames and IPs to react to.
 	LocalIdentities map[string]bool
+
+	// Credentials per extension used for digest authentication.
+	Credentials map[string]*data.SIPCredential
+
+	// Call forwarding rules.
+	Forwarding *data.Forwarding
+
+	// Hunt groups by their number.
+	Groups map[string]*data.HuntGroup
+
+	// Queue of messages to deliver.
+	Messages *data.Messages
+
+	// Messages dropped by the flood protection.
+	Stats *data.SIPStats
+
+	// Phones registered with other phonebook servers (federation).
+	Federated *data.TTLCache[string, *data.FederatedRegistration]
+
+	initOnce sync.Once
+
+	// Received messages waiting for a worker, rate limit state per source and ACLs.
+	packets chan *packet
+	sources *data.TTLCache[netip.Addr, *floodSource]
+	allow   []netip.Prefix
+	deny    []netip.Prefix
+
+	// Messages currently being delivered.
+	sendingMu sync.Mutex
+	sending   map[string]bool
+
+	// Last registrations written to disk.
+	snapshotMu   sync.Mutex
+	lastSnapshot []byte
+	udp          *udpConn // set by Listen before any worker starts
+
+	// Issued nonces along with the last nonce count seen.
+	nonceMu sync.Mutex
+	nonces  *data.TTLCache[string, uint32]
+
+	// Open TCP connections, keyed by remote address and registered contacts,
+	// along with the number of accepted ones (in total and per source).
+	tcpMu       sync.Mutex
+	tcpConns    map[string]*tcpConn
+	tcpAccepted int
+	tcpSources  map[netip.Addr]int
+
+	// Peers which couldn't be polled recently.
+	unreachablePeers *data.TTLCache[string, bool]
+
+	// Compiled rewrites of the dial plan.
+	rewrites []*regexp.Regexp
+
+	// Presence subscriptions, keyed by Call-ID, From tag and event package.
+	subMu sync.Mutex
+	subs  map[string]*subscription
+
+	// Transactions of received requests, see transactionKey.
+	serverTxMu sync.Mutex
+	serverTxs  *data.TTLCache[string, *serverTransaction]
+
+	// Requests sent by us, keyed by the branch of our Via.
+	clientTxs *data.TTLCache[string, *clientTransaction]
+
+	// Transactions forwarded in proxy mode, keyed by the branch of our Via
+	// and by the branch and method of the original request respectively.
+	proxyTxs      *data.TTLCache[string, *proxyTransaction]
+	proxyTxOrigin *data.TTLCache[string, *proxyTransaction]
+	// Calls passing through in proxy mode, keyed by Call-ID.
+	calls *data.TTLCache[string, *call]
 }
 
-func (s *Server) ListenAndServe(ctx context.Context, proto, addr string) error {
-	conn, err := net.ListenPacket(proto, addr)
-	if err != nil {
-		return fmt.Errorf("SIP: unable to listen: %s", err)
+func (s *Server) init() {
+	s.initOnce.Do(func() {
+		s.tcpConns = make(map[string]*tcpConn)
+		s.tcpSources = make(map[netip.Addr]int)
+		s.nonces = data.NewTTL[string, uint32]()
+		s.sending = make(map[string]bool)
+		s.clientTxs = data.NewTTL[string, *clientTransaction]()
+		s.subs = make(map[string]*subscription)
+		s.serverTxs = data.NewTTL[string, *serverTransaction]()
+		s.unreachablePeers = data.NewTTL[string, bool]()
+		s.compileDialPlan()
+		s.initFlood()
+		if s.Config.IsSIPProxy() {
+			s.proxyTxs = data.NewTTL[string, *proxyTransaction]()
+			s.proxyTxOrigin = data.NewTTL[string, *proxyTransaction]()
+			s.calls = data.NewTTL[string, *call]()
+		}
+	})
+}
+
+// Listen listens for SIP traffic on either "udp" or "tcp" and serves it in
+// the background until the context is done. It can be called once per transport to serve both on the
+// same address, and needs to be called before the background workers
+// (e.g. RunProber) are started so they find the UDP socket.
+func (s *Server) Listen(ctx context.Context, proto, addr string) error {
+	s.init()
+
+	switch strings.ToLower(proto) {
+	case "udp":
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return fmt.Errorf("SIP: unable to listen: %s", err)
+		}
+		s.udp = &udpConn{conn}
+		context.AfterFunc(ctx, func() { conn.Close() })
+		go s.serveUDP(conn)
+	case "tcp":
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("SIP: unable to listen: %s", err)
+		}
+		context.AfterFunc(ctx, func() { ln.Close() })
+		go s.acceptTCP(ln)
+	default:
+		return fmt.Errorf("SIP: unsupported protocol: %s", proto)
 	}
+	return nil
+}
+
+func (s *Server) serveUDP(conn net.PacketConn) {
 	defer conn.Close()
 
 	var buf = make([]byte, maxPacketSize)
 	var data []byte
+	var delay time.Duration
 	for {
 		n, addr, err := conn.ReadFrom(buf)
-		if err != nil && s.Config.Debug {
-			fmt.Printf("SIP: error reading (%d bytes) from conn: %s", n, err)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = errorBackoff(delay)
+			if s.Config.Debug {
+				fmt.Printf("SIP: error reading (%d bytes) from conn (retrying in %s): %s\n", n, delay, err)
+			}
+			time.Sleep(delay)
 			continue
 		}
+		delay = 0
 		if n == 0 {
 			continue
 		}
 		data = make([]byte, n)
 		copy(data, buf[:n])
-		go s.handlePacket(conn, addr, data)
+		s.dispatch(s.udp, addr, data)
+	}
+}
+
+// errorBackoff returns the delay after another error, doubling the previous one.
+func errorBackoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return minErrorBackoff
 	}
+	return min(2*delay, maxErrorBackoff)
 }
 
-func (s *Server) handlePacket(conn net.PacketConn, addr net.Addr, buf []byte) {
+func (s *Server) handlePacket(conn sender, addr net.Addr, buf []byte) {
 	if len(buf) <= 4 {
 		if len(bytes.Trim(buf, "\r\n")) == 0 {
 			if s.Config.Debug {
@@ -81,50 +237,81 @@ func (s *Server) handlePacket(conn net.PacketConn, addr net.Addr, buf []byte) {
 	if strings.TrimSpace(string(buf)) == "" {
 		return
 	}
+
+	// Responses are only expected for requests we sent or forwarded in proxy mode.
+	if bytes.HasPrefix(buf, []byte("SIP/")) {
+		resp := &data.SIPResponse{}
+		if err := resp.Parse(buf); err != nil {
+			return
+		}
+		if !s.clientResponse(resp) && s.Config.IsSIPProxy() {
+			s.proxyResponse(resp)
+		}
+		return
+	}
+
 	req := &data.SIPRequest{}
 	if err := req.Parse(buf); err != nil {
 		return
 	}
 
-	resp, err := s.handleRequest(req)
-	if err != nil || resp == nil {
+	recordSource(req, addr)
+
+	// Retransmissions are answered by the transaction layer.
+	tx, ok := s.serverTransaction(conn, addr, req)
+	if !ok {
 		return
 	}
 
-	out := resp.Serialize(true)
-	if s.Config.Debug {
-		fmt.Printf("SIP/Response (%d bytes):\n%s\n", (len(out)), string(out))
+	if resp := s.authenticate(req); resp != nil {
+		s.respond(tx, resp)
+		return
 	}
-	if _, err := conn.WriteTo(out, addr); s.Config.Debug && err != nil {
-		fmt.Printf("SIP/Response: unable to write: %s", err)
+
+	if s.Config.IsSIPProxy() && isProxied(req.Method) {
+		s.proxyRequest(tx, req)
+		return
 	}
-}
 
-func (s *Server) SendSIPMessage(req *data.SIPRequest) (*data.SIPResponse, error) {
-	raddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", req.To().URI.Host, expectedPhoneSIPPort))
-	if err != nil {
-		return nil, fmt.Errorf("error resolving the destination address: %s", err)
+	resp, err := s.handleRequest(req)
+	if err != nil || resp == nil {
+		return
+	}
+	// Keep using the connection a client registered on to reach it.
+	if c, ok := conn.(*tcpConn); ok && req.Method == "REGISTER" && resp.StatusCode == http.StatusOK {
+		if contact := req.Contact(); contact != nil && contact.URI != nil {
+			s.trackTCPConn(contact.URI, c)
+		}
 	}
+	s.recordTransaction(req, resp, redirectTarget(resp))
+	s.respond(tx, resp)
+}
 
-	conn, err := net.DialUDP("udp", nil, raddr)
+// recordSource adds where the request was received from to its top Via.
+// Responses are always sent back to the source address and port (as with rport)
+// so they also reach clients behind NAT which don't ask for it.
+func recordSource(req *data.SIPRequest, addr net.Addr) {
+	via := req.TopVia()
+	if via == nil {
+		return
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
 	if err != nil {
-		return nil, fmt.Errorf("error connecting: %s", err)
+		return
 	}
-	defer conn.Close()
-
-	if _, err := req.Write(conn, s.Config.Debug); err != nil {
-		return nil, fmt.Errorf("error sending message: %s", err)
+	if via.SetReceived(ap.Addr().Unmap().String(), int(ap.Port())) {
+		req.SetTopVia(via)
 	}
+}
 
-	received := make([]byte, 1024)
-	if _, err = conn.Read(received); err != nil {
-		return nil, fmt.Errorf("unable to receive response: %s", err)
+func (s *Server) writeResponse(conn sender, addr net.Addr, resp *data.SIPResponse) {
+	out := resp.Serialize(true)
+	if s.Config.Debug {
+		fmt.Printf("SIP/Response (%d bytes):\n%s\n", (len(out)), string(out))
 	}
-	resp := &data.SIPResponse{}
-	if err := resp.Parse(received); err != nil {
-		return nil, fmt.Errorf("unable to parse body: %s", err)
+	if _, err := conn.WriteTo(out, addr); s.Config.Debug && err != nil {
+		fmt.Printf("SIP/Response: unable to write: %s", err)
 	}
-	return resp, nil
 }
 
 func (s *Server) handleRequest(req *data.SIPRequest) (*data.SIPResponse, error) {
@@ -137,25 +324,146 @@ func (s *Server) handleRequest(req *data.SIPRequest) (*data.SIPResponse, error)
 		return s.handleAck(req)
 	case "MESSAGE":
 		return s.handleMessage(req)
+	case "OPTIONS":
+		return s.handleOptions(req)
+	case "SUBSCRIBE":
+		return s.handleSubscribe(req)
 	case "":
 		return nil, nil // we are not reacting to empty requests
 	default:
-		return data.NewSIPResponseFromRequest(req, http.StatusMethodNotAllowed, "Method Not Allowed"), nil
+		resp := data.NewSIPResponseFromRequest(req, http.StatusMethodNotAllowed, "Method Not Allowed")
+		resp.AddHeader("Allow", strings.Join(s.allowed(), ", "))
+		return resp, nil
 	}
 }
 
+// handleRegister implements the registrar behavior for the locally registered clients.
+// https://datatracker.ietf.org/doc/html/rfc3261#section-10.3
 func (s *Server) handleRegister(req *data.SIPRequest) (*data.SIPResponse, error) {
-	if client := data.NewSIPClientFromRegister(req); client != nil {
-		s.RegisterCache.Set(client.Key(), client, registerExpiration)
+	expires := int(registerExpiration.Seconds())
+	explicit := false
+	for _, hdr := range req.FindHeaders("Expires") {
+		if e, err := strconv.Atoi(strings.TrimSpace(hdr.Value)); err == nil && e >= 0 {
+			expires = e
+			explicit = true
+		}
+		break
+	}
+
+	// Bindings belong to the address of record in the To header, which is
+	// also what the request was authenticated for.
+	to := req.To()
+	if to == nil || to.URI == nil || to.URI.User == "" {
+		return data.NewSIPResponseFromRequest(req, http.StatusBadRequest, "Bad Request"), nil
+	}
+	aor := to.URI.User
+
+	contacts := req.HeaderValues("Contact")
+
+	// A wildcard removes all bindings of the address of record.
+	if len(contacts) == 1 && contacts[0] == "*" {
+		if !explicit || expires != 0 {
+			return data.NewSIPResponseFromRequest(req, http.StatusBadRequest, "Bad Request"), nil
+		}
+		s.RegisterCache.Remove(aor)
+		if s.Config.Debug {
+			fmt.Printf("SIP/REGISTER: removed all bindings for %s\n", aor)
+		}
+		go s.notifyPresence(aor)
+		return s.registerResponse(req, nil), nil
+	}
+
+	// All contacts are checked before any binding is changed.
+	type binding struct {
+		client  *data.SIPClient
+		expires int
+	}
+	var bindings []binding
+	for _, c := range contacts {
+		if c == "*" {
+			return data.NewSIPResponseFromRequest(req, http.StatusBadRequest, "Bad Request"), nil
+		}
+		addr := &data.SIPAddress{}
+		if err := addr.Parse(c); err != nil || addr.URI == nil {
+			return data.NewSIPResponseFromRequest(req, http.StatusBadRequest, "Bad Request"), nil
+		}
+		// Clients may only register contacts for their own address of record.
+		switch addr.URI.User {
+		case "":
+			addr.URI.User = aor
+		case aor:
+		default:
+			if s.Config.Debug {
+				fmt.Printf("SIP/REGISTER: refusing contact %s for %s\n", addr, aor)
+			}
+			return data.NewSIPResponseFromRequest(req, http.StatusForbidden, "Forbidden"), nil
+		}
+
+		exp := expires
+		if v, ok := addr.Params["expires"]; ok {
+			if e, err := strconv.Atoi(v); err == nil && e >= 0 {
+				exp = e
+			}
+		}
+		// Refuse registrations which would expire too quickly.
+		if exp > 0 && exp < s.Config.GetSIPMinExpires() {
+			resp := data.NewSIPResponseFromRequest(req, statusIntervalTooBrief, "Interval Too Brief")
+			resp.AddHeader("Min-Expires", strconv.Itoa(s.Config.GetSIPMinExpires()))
+			return resp, nil
+		}
+		bindings = append(bindings, binding{
+			client:  data.NewSIPClient(req, addr),
+			expires: min(exp, s.Config.GetSIPMaxExpires()),
+		})
+	}
+
+	var clients []*data.SIPClient
+	for _, b := range bindings {
+		if b.expires == 0 {
+			s.RegisterCache.Remove(aor)
+			if s.Config.Debug {
+				fmt.Printf("SIP/REGISTER: received de-registration from %s\n", aor)
+			}
+			go s.notifyPresence(aor)
+			continue
+		}
+		s.RegisterCache.Set(aor, b.client, time.Duration(b.expires)*time.Second)
+		clients = append(clients, b.client)
+		go s.FlushMessagesTo(aor)
+		go s.notifyPresence(aor)
 		if s.Config.Debug {
-			fmt.Printf("SIP/REGISTER: received REGISTER message from %s\n", client.Key())
+			fmt.Printf("SIP/REGISTER: received REGISTER message from %s (expires in %ds)\n", aor, b.expires)
 		}
 	}
 
+	// Without contacts, this is only a query for the current bindings.
+	if len(contacts) == 0 {
+		if reg, ok := s.RegisterCache.Get(aor); ok {
+			clients = append(clients, reg)
+		}
+	}
+
+	return s.registerResponse(req, clients), nil
+}
+
+// registerResponse lists the current bindings of the clients along with their remaining expiry.
+func (s *Server) registerResponse(req *data.SIPRequest, clients []*data.SIPClient) *data.SIPResponse {
 	resp := data.NewSIPResponseFromRequest(req, http.StatusOK, "OK")
-	resp.AddHeader("Allow", strings.Join(supported, ", "))
-	resp.AddHeader("Expires", strconv.Itoa(int(registerExpiration.Seconds())))
-	return resp, nil
+	resp.AddHeader("Allow", strings.Join(s.allowed(), ", "))
+	for _, c := range clients {
+		_, expiry, ok := s.RegisterCache.GetWithExpiry(c.Key())
+		if !ok {
+			continue
+		}
+		exp := int(time.Until(expiry).Round(time.Second).Seconds())
+		contact := c.Address.Clone()
+		contact.Params["expires"] = strconv.Itoa(exp)
+		resp.AddHeader("Contact", contact.String())
+		if len(clients) == 1 {
+			resp.AddHeader("Expires", strconv.Itoa(exp))
+		}
+	}
+	return resp
 }
 
 func (s *Server) handleAck(_ *data.SIPRequest) (*data.SIPResponse, error) {
@@ -167,23 +475,72 @@ func (s *Server) handleInvite(req *data.SIPRequest) (*data.SIPResponse, error) {
 		fmt.Printf("SIP/INVITE: received INVITE message from %s to %s\n", req.From(), req.To())
 	}
 
+	// Calls are routed by the Request-URI which, unlike the To header, is
+	// updated by clients following a redirect (e.g. to the home node of a
+	// phone registered with another phonebook server).
+	uri := req.RequestURI()
+	if uri == nil || uri.User == "" {
+		return data.NewSIPResponseFromRequest(req, http.StatusBadRequest, "Bad Request"), nil
+	}
+
 	// Check if this is a call directed at a local identity (hostname or IP). If not, ignore it.
 	// This also helps reducing retry storms for some clients (e.g. Linphone).
-	if s.LocalIdentities != nil {
-		if local, ok := s.LocalIdentities[strings.ToLower(req.To().URI.Host)]; !ok || !local {
-			if s.Config.Debug {
-				fmt.Printf("  - Ignoring call to non-local server: %s\n", req.To())
-			}
-			return data.NewSIPResponseFromRequest(req, http.StatusNotFound, "Not Found"), nil
+	if !s.isLocalIdentity(uri.Host) {
+		if s.Config.Debug {
+			fmt.Printf("  - Ignoring call to non-local server: %s\n", uri)
 		}
+		return data.NewSIPResponseFromRequest(req, http.StatusNotFound, "Not Found"), nil
 	}
 
-	var redirect *data.SIPAddress
-	to := req.To()
-	// Look up the phone number and try to find the right host in our records and redirect the call there.
+	user := s.normalizeNumber(uri.User)
+	if rule, reason := s.forwardingRule(user); rule != nil {
+		return s.forwardResponse(req, rule, reason), nil
+	}
+	if g, ok := s.Groups[user]; ok {
+		return s.groupResponse(req, g), nil
+	}
+	redirect := s.findDestination(user)
+	if redirect == nil {
+		if s.Config.Debug {
+			fmt.Printf("  - Couldn't find redirect destination for %s\n", uri)
+		}
+		// As a last resort, we're giving up and tell the client that we can't route that call.
+		return data.NewSIPResponseFromRequest(req, http.StatusNotFound, "Not Found"), nil
+	}
+
+	resp := data.NewSIPResponseFromRequest(req, http.StatusFound, "Moved Temporarily")
+	resp.AddHeader("Contact", redirect.String())
+	redirect.Params["reason"] = "unconditional"
+	resp.AddHeader("Diversion", redirect.String())
+	return resp, nil
+}
+
+// findDestination looks up where calls to the given phone number should go to.
+// Phonebook entries with a route take precedence over locally registered clients,
+// followed by phones registered with other phonebook servers (their home node).
+// Phonebook entries without a route are used as a last resort.
+func (s *Server) findDestination(user string) *data.SIPAddress {
+	addr, routed := s.findEntry(user)
+	if routed {
+		return addr
+	}
+	if reg := s.findRegistered(user); reg != nil {
+		return reg
+	}
+	if home := s.findFederated(user); home != nil {
+		return home
+	}
+	return addr
+}
+
+// findEntry looks up the phone number in the phonebook and returns whether there's a route to it.
+func (s *Server) findEntry(user string) (*data.SIPAddress, bool) {
+	// Look up the phone number and try to find the right host in our records.
 	s.Records.Mu.RLock()
+	defer s.Records.Mu.RUnlock()
 	for _, entry := range s.Records.Entries {
-		if entry.PhoneNumber != to.URI.User {
+		// Numbers in the phonebook may include the country prefix.
+		if entry.PhoneNumber != user && s.Config.GetLocalNumber(entry.PhoneNumber) != user {
 			continue
 		}
 
@@ -192,47 +549,66 @@ func (s *Server) handleInvite(req *data.SIPRequest) (*data.SIPResponse, error) {
 			host = entry.Route.IP
 		}
 
-		// We found an entry in the phonebook to redirect to.
-		redirect = &data.SIPAddress{
+		// We found an entry in the phonebook.
+		return &data.SIPAddress{
 			DisplayName: entry.Callsign,
 			URI: &data.SIPURI{
 				User: entry.PhoneNumber,
 				Host: host,
 			},
 			Params: make(map[string]string),
-		}
-		break
+		}, entry.Route != nil
 	}
-	s.Records.Mu.RUnlock()
+	return nil, false
+}
 
-	// If we can't find it in the phonebook, we try locally registered clients.
-	if redirect == nil {
-		reg, ok := s.RegisterCache.Get(to.URI.User)
-		if ok {
-			redirect = reg.Address.Clone()
-			redirect.URI.Params = make(map[string]string)
-			redirect.Params = make(map[string]string)
-		}
+// findRegistered looks up locally registered clients.
+func (s *Server) findRegistered(user string) *data.SIPAddress {
+	if reg, ok := s.RegisterCache.Get(user); ok {
+		addr := reg.Address.Clone()
+		addr.URI.Params = make(map[string]string)
+		addr.Params = make(map[string]string)
+		return addr
 	}
+	return nil
+}
 
-	if redirect == nil {
-		if s.Config.Debug {
-			fmt.Printf("  - Couldn't find redirect destination for %s\n", req.To())
-		}
-		// As a last resort, we're giving up and tell the client that we can't route that call.
-		return data.NewSIPResponseFromRequest(req, http.StatusNotFound, "Not Found"), nil
+// isLocalIdentity checks whether the host is one of our local identities (hostname or IP).
+// When no identities are known, every host is treated as local.
+func (s *Server) isLocalIdentity(host string) bool {
+	if s.LocalIdentities == nil {
+		return true
 	}
-
-	resp := data.NewSIPResponseFromRequest(req, http.StatusFound, "Moved Temporarily")
-	resp.AddHeader("Contact", redirect.String())
-	redirect.Params["reason"] = "unconditional"
-	resp.AddHeader("Diversion", redirect.String())
-	return resp, nil
+	local, ok := s.LocalIdentities[strings.ToLower(host)]
+	return ok && local
 }
 
+// handleMessage queues the message for delivery so it isn't lost when the
+// recipient is currently unreachable.
 func (s *Server) handleMessage(req *data.SIPRequest) (*data.SIPResponse, error) {
 	if s.Config.Debug {
 		fmt.Printf("SIP/MESSAGE: received MESSAGE message from %s to %s\n", req.From(), req.To())
 	}
-	return s.SendSIPMessage(req)
+	m := newMessageFromRequest(req)
+	if m == nil {
+		return data.NewSIPResponseFromRequest(req, http.StatusBadRequest, "Bad Request"), nil
+	}
+	if s.findContact(m.To) == nil {
+		return data.NewSIPResponseFromRequest(req, http.StatusNotFound, "Not Found"), nil
+	}
+	if s.enqueueMessage(m) {
+		go s.attemptDelivery(m)
+	}
+	return data.NewSIPResponseFromRequest(req, http.StatusAccepted, "Accepted"), nil
+}
+
+// handleOptions answers capability queries (also used by phones as keep alive).
+// https://datatracker.ietf.org/doc/html/rfc3261#section-11.2
+func (s *Server) handleOptions(req *data.SIPRequest) (*data.SIPResponse, error) {
+	resp := data.NewSIPResponseFromRequest(req, http.StatusOK, "OK")
+	resp.AddHeader("Allow", strings.Join(s.allowed(), ", "))
+	resp.AddHeader("Accept", "application/sdp, text/plain")
+	resp.AddHeader("Accept-Language", "en")
+	resp.AddHeader("Allow-Events", strings.Join(eventPackages, ", "))
+	return resp, nil
 }
@@ -0,0 +1,236 @@
+package sip
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arednch/phonebook/data"
+)
+
+const (
+	// Server transaction timers.
+	// https://datatracker.ietf.org/doc/html/rfc3261#section-17.2
+	timerT4 = 5 * time.Second
+	timerH  = 64 * timerT1 // wait for the ACK of a non-2xx final response to an INVITE
+	timerI  = timerT4      // absorb retransmitted ACKs
+	timerJ  = 64 * timerT1 // absorb retransmitted non-INVITE requests
+	timerL  = 64 * timerT1 // absorb retransmitted INVITEs after a 2xx response (RFC 6026)
+
+	// INVITEs which aren't answered within this time get a provisional response.
+	// https://datatracker.ietf.org/doc/html/rfc3261#section-17.2.1
+	tryingDelay = 200 * time.Millisecond
+
+	// Time to wait for a final response (e.g. a phone ringing in proxy mode).
+	serverTransactionTimeout = proxyTransactionTimeout
+)
+
+// States of server transactions.
+const (
+	txProceeding = iota // no final response sent yet
+	txCompleted         // non-2xx final response sent (INVITE: waiting for the ACK)
+	txConfirmed         // INVITE: ACK received
+	txAccepted          // INVITE: 2xx response sent
+)
+
+// serverTransaction is a request received by us along with the responses sent
+// for it. It absorbs retransmissions of the request by sending the last
+// response again and retransmits final responses to INVITEs over UDP.
+type serverTransaction struct {
+	key  string
+	conn sender   // connection the request came in on
+	addr net.Addr // where the request came from
+	req  *data.SIPRequest
+
+	mu    sync.Mutex
+	state int
+	last  *data.SIPResponse // last response sent
+	acked chan struct{}     // closed when the ACK is received
+}
+
+func (t *serverTransaction) reliable() bool {
+	return t.conn.Transport() != "UDP"
+}
+
+// transactionKey identifies the transaction a request belongs to. ACKs match
+// the INVITE they acknowledge.
+// https://datatracker.ietf.org/doc/html/rfc3261#section-17.2.3
+func transactionKey(req *data.SIPRequest) string {
+	method := req.Method
+	if method == "ACK" {
+		method = "INVITE"
+	}
+	if via := req.TopVia(); via != nil && strings.HasPrefix(via.Branch(), data.BranchMagicCookie) {
+		return strings.Join([]string{via.Branch(), via.Host, strconv.Itoa(via.Port), method}, " ")
+	}
+
+	// Clients not compliant with RFC 3261 don't use unique branches.
+	var callID, tag string
+	if ids := req.HeaderValues("Call-ID"); len(ids) > 0 {
+		callID = ids[0]
+	}
+	if from := req.From(); from != nil {
+		tag = from.Params["tag"]
+	}
+	seq, _ := req.CSeq()
+	return strings.Join([]string{callID, tag, strconv.Itoa(seq), method}, " ")
+}
+
+// serverTransaction returns the transaction of a received request. Retransmissions
+// (and ACKs of non-2xx responses) are absorbed, in which case false is returned.
+// ACKs of 2xx responses are passed on without a transaction.
+func (s *Server) serverTransaction(conn sender, addr net.Addr, req *data.SIPRequest) (*serverTransaction, bool) {
+	key := transactionKey(req)
+	if req.Method == "ACK" {
+		if tx, ok := s.serverTxs.Get(key); ok && s.ackTransaction(tx) {
+			return nil, false
+		}
+		return nil, true
+	}
+
+	s.serverTxMu.Lock()
+	tx, ok := s.serverTxs.Get(key)
+	if !ok {
+		tx = &serverTransaction{
+			key:   key,
+			conn:  conn,
+			addr:  addr,
+			req:   req,
+			acked: make(chan struct{}),
+		}
+		s.serverTxs.Set(key, tx, serverTransactionTimeout)
+	}
+	s.serverTxMu.Unlock()
+
+	if ok {
+		s.retransmission(tx)
+		return nil, false
+	}
+	if req.Method == "INVITE" {
+		time.AfterFunc(tryingDelay, func() { s.trying(tx) })
+	}
+	return tx, true
+}
+
+// respond sends a response within the transaction. Once a final response was
+// sent, further responses are dropped (except retransmitted 2xx responses to INVITEs).
+func (s *Server) respond(tx *serverTransaction, resp *data.SIPResponse) {
+	if tx == nil {
+		return // ACKs are never answered
+	}
+
+	tx.mu.Lock()
+	if tx.state == txCompleted || tx.state == txConfirmed || (tx.state == txAccepted && resp.StatusCode/100 != 2) {
+		tx.mu.Unlock()
+		return
+	}
+	tx.last = resp
+	ttl := serverTransactionTimeout
+	var retransmit bool
+	if resp.StatusCode >= 200 {
+		switch {
+		case tx.req.Method != "INVITE":
+			tx.state = txCompleted
+			ttl = timerJ
+			if tx.reliable() {
+				ttl = 0
+			}
+		case resp.StatusCode < 300:
+			tx.state = txAccepted
+			ttl = timerL
+		default:
+			tx.state = txCompleted
+			ttl = timerH
+			retransmit = !tx.reliable()
+		}
+	}
+	tx.mu.Unlock()
+
+	s.writeResponse(tx.conn, tx.addr, resp)
+	if ttl == 0 {
+		s.serverTxs.Remove(tx.key)
+	} else {
+		s.serverTxs.Set(tx.key, tx, ttl)
+	}
+	if retransmit {
+		go s.retransmitFinal(tx)
+	}
+}
+
+// retransmitFinal retransmits the final response to an INVITE until it is
+// acknowledged (Timer G) or no ACK is received in time (Timer H).
+func (s *Server) retransmitFinal(tx *serverTransaction) {
+	interval := timerT1
+	retransmit := time.NewTimer(interval)
+	defer retransmit.Stop()
+	timeout := time.NewTimer(timerH)
+	defer timeout.Stop()
+	for {
+		select {
+		case <-tx.acked:
+			return
+		case <-timeout.C:
+			return
+		case <-retransmit.C:
+			tx.mu.Lock()
+			resp := tx.last
+			tx.mu.Unlock()
+			s.writeResponse(tx.conn, tx.addr, resp)
+			interval = min(2*interval, timerT2)
+			retransmit.Reset(interval)
+		}
+	}
+}
+
+// ackTransaction confirms an INVITE transaction. Returns false if the ACK
+// doesn't belong to a non-2xx final response (i.e. is not absorbed).
+func (s *Server) ackTransaction(tx *serverTransaction) bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	switch tx.state {
+	case txCompleted:
+		tx.state = txConfirmed
+		close(tx.acked)
+		if tx.reliable() {
+			s.serverTxs.Remove(tx.key)
+		} else {
+			s.serverTxs.Set(tx.key, tx, timerI)
+		}
+		return true
+	case txConfirmed:
+		return true // retransmitted ACK
+	default:
+		return false
+	}
+}
+
+// retransmission handles a retransmitted request by sending the last response again.
+func (s *Server) retransmission(tx *serverTransaction) {
+	tx.mu.Lock()
+	last, state := tx.last, tx.state
+	tx.mu.Unlock()
+
+	switch state {
+	case txProceeding:
+		if last != nil {
+			s.writeResponse(tx.conn, tx.addr, last)
+		}
+	case txCompleted:
+		s.writeResponse(tx.conn, tx.addr, last)
+	case txConfirmed, txAccepted:
+		// Already acknowledged or retransmitting 2xx responses is up to whoever sent them.
+	}
+}
+
+// trying sends a provisional response unless the INVITE has been answered already.
+func (s *Server) trying(tx *serverTransaction) {
+	tx.mu.Lock()
+	answered := tx.last != nil
+	tx.mu.Unlock()
+	if !answered {
+		s.respond(tx, data.NewSIPResponseFromRequest(tx.req, http.StatusContinue, "Trying"))
+	}
+}
@@ -0,0 +1,234 @@
+package sip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/arednch/phonebook/configuration"
+	"github.com/arednch/phonebook/data"
+)
+
+// recordingSender records the status codes of the responses written to it.
+type recordingSender struct {
+	transport string
+
+	mu    sync.Mutex
+	codes []int
+}
+
+func (r *recordingSender) WriteTo(b []byte, _ net.Addr) (int, error) {
+	resp := &data.SIPResponse{}
+	if err := resp.Parse(b); err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.codes = append(r.codes, resp.StatusCode)
+	return len(b), nil
+}
+
+func (r *recordingSender) Transport() string {
+	return r.transport
+}
+
+func (r *recordingSender) sent() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int(nil), r.codes...)
+}
+
+// newTestRequest creates a request with the given top Via branch.
+func newTestRequest(t *testing.T, method, branch string) *data.SIPRequest {
+	t.Helper()
+	cseq := method
+	if method == "ACK" {
+		cseq = "INVITE"
+	}
+	raw := strings.Join([]string{
+		fmt.Sprintf("%s sip:100@local.mesh SIP/2.0", method),
+		fmt.Sprintf("Via: SIP/2.0/UDP 10.0.0.2:5060;branch=%s", branch),
+		"From: <sip:200@local.mesh>;tag=abc",
+		"To: <sip:100@local.mesh>",
+		"Call-ID: call-1",
+		fmt.Sprintf("CSeq: 1 %s", cseq),
+		"Content-Length: 0",
+		"", "",
+	}, "\r\n")
+	req := &data.SIPRequest{}
+	if err := req.Parse([]byte(raw)); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestTransactionKey(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		method string
+		branch string
+		want   string
+	}{
+		{name: "INVITE", method: "INVITE", branch: "z9hG4bK1", want: "z9hG4bK1 10.0.0.2 5060 INVITE"},
+		{name: "ACK matches INVITE", method: "ACK", branch: "z9hG4bK1", want: "z9hG4bK1 10.0.0.2 5060 INVITE"},
+		{name: "CANCEL", method: "CANCEL", branch: "z9hG4bK1", want: "z9hG4bK1 10.0.0.2 5060 CANCEL"},
+		{name: "RFC 2543 branch", method: "BYE", branch: "1", want: "call-1 abc 1 BYE"},
+		{name: "RFC 2543 ACK", method: "ACK", branch: "1", want: "call-1 abc 1 INVITE"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := transactionKey(newTestRequest(t, tc.method, tc.branch)); got != tc.want {
+				t.Errorf("transactionKey() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestServerTransaction(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		method    string
+		transport string
+		responses []int // status codes of the responses sent in order
+		wantState int
+		// Whether a retransmission of the request is passed on as a new
+		// transaction instead of being absorbed.
+		wantNew  bool
+		wantSent []int // responses written incl. those for the retransmission
+	}{
+		{
+			name:      "no response yet",
+			method:    "BYE",
+			transport: "UDP",
+			wantState: txProceeding,
+		},
+		{
+			name:      "provisional response",
+			method:    "INVITE",
+			transport: "UDP",
+			responses: []int{180},
+			wantState: txProceeding,
+			wantSent:  []int{180, 180},
+		},
+		{
+			name:      "non-INVITE final response",
+			method:    "BYE",
+			transport: "UDP",
+			responses: []int{200},
+			wantState: txCompleted,
+			wantSent:  []int{200, 200},
+		},
+		{
+			name:      "non-INVITE final response over TCP",
+			method:    "BYE",
+			transport: "TCP",
+			responses: []int{200},
+			wantState: txCompleted,
+			wantNew:   true,
+			wantSent:  []int{200},
+		},
+		{
+			name:      "responses after final response",
+			method:    "BYE",
+			transport: "UDP",
+			responses: []int{100, 200, 500},
+			wantState: txCompleted,
+			wantSent:  []int{100, 200, 200},
+		},
+		{
+			name:      "INVITE non-2xx final response",
+			method:    "INVITE",
+			transport: "TCP",
+			responses: []int{180, 486, 200},
+			wantState: txCompleted,
+			wantSent:  []int{180, 486, 486},
+		},
+		{
+			name:      "INVITE 2xx final response",
+			method:    "INVITE",
+			transport: "TCP",
+			responses: []int{180, 200, 486, 200},
+			wantState: txAccepted,
+			wantSent:  []int{180, 200, 200},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{Config: &configuration.Config{}, serverTxs: data.NewTTL[string, *serverTransaction]()}
+			conn := &recordingSender{transport: tc.transport}
+			req := newTestRequest(t, tc.method, "z9hG4bK1")
+
+			tx, ok := s.serverTransaction(conn, &net.UDPAddr{}, req)
+			if !ok {
+				t.Fatal("serverTransaction() absorbed the initial request")
+			}
+			for _, code := range tc.responses {
+				s.respond(tx, data.NewSIPResponseFromRequest(req, code, "Test"))
+			}
+			if _, ok := s.serverTransaction(conn, &net.UDPAddr{}, newTestRequest(t, tc.method, "z9hG4bK1")); ok != tc.wantNew {
+				t.Errorf("serverTransaction() for retransmission = %t, want %t", ok, tc.wantNew)
+			}
+
+			tx.mu.Lock()
+			state := tx.state
+			tx.mu.Unlock()
+			if state != tc.wantState {
+				t.Errorf("state = %d, want %d", state, tc.wantState)
+			}
+			if diff := cmp.Diff(tc.wantSent, conn.sent()); diff != "" {
+				t.Errorf("sent responses mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAckTransaction(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		transport string
+		final     int
+		wantState int
+		// Whether the first and a retransmitted ACK are passed on (not absorbed).
+		wantPassed []bool
+	}{
+		{name: "non-2xx over UDP", transport: "UDP", final: 486, wantState: txConfirmed, wantPassed: []bool{false, false}},
+		{name: "non-2xx over TCP", transport: "TCP", final: 486, wantState: txConfirmed, wantPassed: []bool{false, true}},
+		{name: "2xx", transport: "UDP", final: 200, wantState: txAccepted, wantPassed: []bool{true, true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{Config: &configuration.Config{}, serverTxs: data.NewTTL[string, *serverTransaction]()}
+			conn := &recordingSender{transport: tc.transport}
+			req := newTestRequest(t, "INVITE", "z9hG4bK1")
+			tx, _ := s.serverTransaction(conn, &net.UDPAddr{}, req)
+			s.respond(tx, data.NewSIPResponseFromRequest(req, tc.final, "Test"))
+
+			var passed []bool
+			for range tc.wantPassed {
+				ackTx, ok := s.serverTransaction(conn, &net.UDPAddr{}, newTestRequest(t, "ACK", "z9hG4bK1"))
+				if ackTx != nil {
+					t.Error("serverTransaction() returned a transaction for an ACK")
+				}
+				passed = append(passed, ok)
+			}
+			if diff := cmp.Diff(tc.wantPassed, passed); diff != "" {
+				t.Errorf("passed on ACKs mismatch (-want +got):\n%s", diff)
+			}
+
+			tx.mu.Lock()
+			state := tx.state
+			tx.mu.Unlock()
+			if state != tc.wantState {
+				t.Errorf("state = %d, want %d", state, tc.wantState)
+			}
+			if tc.final >= 300 {
+				select {
+				case <-tx.acked:
+				default:
+					t.Error("acked wasn't closed")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package sip
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arednch/phonebook/data"
+)
+
+const (
+	// Time on top of the maximal registration expiry after which idle TCP
+	// connections are closed. Registered clients are expected to refresh their
+	// registration (and use the connection) before.
+	tcpIdleGrace   = time.Minute
+	tcpDialTimeout = 5 * time.Second
+
+	// Upper bounds of accepted TCP connections in total and per source IP.
+	maxTCPConns          = 256
+	maxTCPConnsPerSource = 16
+
+	// Upper bound for a single message received on a stream.
+	maxStreamMessageSize = 64 * 1024
+)
+
+// sender sends raw SIP messages to a peer.
+type sender interface {
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	Transport() string
+}
+
+// udpConn sends messages from the listening UDP socket.
+type udpConn struct {
+	net.PacketConn
+}
+
+func (c *udpConn) Transport() string {
+	return "UDP"
+}
+
+// tcpConn is a persistent TCP connection to a client. Messages are always
+// written to the connection, independent of the address passed.
+type tcpConn struct {
+	conn net.Conn
+	mu   sync.Mutex // serializes writes of complete messages
+}
+
+func (c *tcpConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.Write(b)
+}
+
+func (c *tcpConn) Transport() string {
+	return "TCP"
+}
+
+func (s *Server) acceptTCP(ln net.Listener) {
+	defer ln.Close()
+
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = errorBackoff(delay)
+			if s.Config.Debug {
+				fmt.Printf("SIP: error accepting TCP connection (retrying in %s): %s\n", delay, err)
+			}
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		ip := sourceIP(conn.RemoteAddr())
+		if s.blocked(ip) {
+			conn.Close()
+			continue
+		}
+		if !s.acquireTCPSlot(ip) {
+			s.countDrop(&s.Stats.Overloaded)
+			if s.Config.Debug {
+				fmt.Printf("SIP: refusing TCP connection from %s: too many connections\n", conn.RemoteAddr())
+			}
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.releaseTCPSlot(ip)
+			s.serveTCP(s.addTCPConn(conn))
+		}()
+	}
+}
+
+// acquireTCPSlot reserves one of the accepted TCP connections for the source
+// unless it (or the server in total) has too many connections already.
+func (s *Server) acquireTCPSlot(ip netip.Addr) bool {
+	s.tcpMu.Lock()
+	defer s.tcpMu.Unlock()
+	if s.tcpAccepted >= maxTCPConns || s.tcpSources[ip] >= maxTCPConnsPerSource {
+		return false
+	}
+	s.tcpAccepted++
+	s.tcpSources[ip]++
+	return true
+}
+
+func (s *Server) releaseTCPSlot(ip netip.Addr) {
+	s.tcpMu.Lock()
+	defer s.tcpMu.Unlock()
+	s.tcpAccepted--
+	if s.tcpSources[ip]--; s.tcpSources[ip] <= 0 {
+		delete(s.tcpSources, ip)
+	}
+}
+
+func (s *Server) addTCPConn(conn net.Conn) *tcpConn {
+	c := &tcpConn{conn: conn}
+	s.tcpMu.Lock()
+	defer s.tcpMu.Unlock()
+	s.tcpConns[conn.RemoteAddr().String()] = c
+	return c
+}
+
+// trackTCPConn makes the connection available to reach the given URI (e.g. the
+// contact of a client registering over TCP).
+func (s *Server) trackTCPConn(uri *data.SIPURI, c *tcpConn) {
+	port := uri.Port
+	if port == 0 {
+		port = expectedPhoneSIPPort
+	}
+	s.tcpMu.Lock()
+	defer s.tcpMu.Unlock()
+	s.tcpConns[net.JoinHostPort(uri.Host, strconv.Itoa(port))] = c
+}
+
+func (s *Server) removeTCPConn(c *tcpConn) {
+	s.tcpMu.Lock()
+	defer s.tcpMu.Unlock()
+	for k, v := range s.tcpConns {
+		if v == c {
+			delete(s.tcpConns, k)
+		}
+	}
+	c.conn.Close()
+}
+
+// serveTCP reads messages from the connection until it is closed or idle for too long.
+func (s *Server) serveTCP(c *tcpConn) {
+	defer s.removeTCPConn(c)
+
+	addr := c.conn.RemoteAddr()
+	r := bufio.NewReader(c.conn)
+	var blank bool
+	for {
+		idle := time.Duration(s.Config.GetSIPMaxExpires())*time.Second + tcpIdleGrace
+		c.conn.SetReadDeadline(time.Now().Add(idle))
+		msg, err := readStreamMessage(r)
+		if err != nil {
+			if s.Config.Debug && !errors.Is(err, io.EOF) {
+				fmt.Printf("SIP: closing TCP connection to %s: %s\n", addr, err)
+			}
+			return
+		}
+
+		// Answer double CRLF keep alives with a single CRLF.
+		// https://datatracker.ietf.org/doc/html/rfc5626#section-4.4.1
+		if len(bytes.TrimSpace(msg)) == 0 {
+			if blank {
+				c.WriteTo([]byte(data.SIPNewline), addr)
+			}
+			blank = !blank
+			continue
+		}
+		blank = false
+		s.dispatch(c, addr, msg)
+	}
+}
+
+// readStreamMessage reads a single message (or a blank keep alive line) from a
+// stream. The message boundary is determined by the Content-Length header.
+// https://datatracker.ietf.org/doc/html/rfc3261#section-18.3
+func readStreamMessage(r *bufio.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	var length int
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if buf.Len() == 0 && strings.TrimSpace(line) == "" {
+			return []byte(line), nil
+		}
+		buf.WriteString(line)
+		if buf.Len() > maxStreamMessageSize {
+			return nil, errors.New("message headers too large")
+		}
+
+		l := strings.TrimSpace(line)
+		if l == "" {
+			break // end of headers
+		}
+		name, value, ok := strings.Cut(l, ":")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "content-length", "l":
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil || length < 0 {
+				return nil, fmt.Errorf("invalid Content-Length: %s", value)
+			}
+		}
+	}
+
+	if length > maxStreamMessageSize {
+		return nil, fmt.Errorf("message body too large (%d bytes)", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// outbound returns how to reach the destination: an existing TCP connection
+// if there is one, the UDP socket or otherwise a new TCP connection.
+func (s *Server) outbound(dst net.Addr, transport string) (sender, error) {
+	s.tcpMu.Lock()
+	c, ok := s.tcpConns[dst.String()]
+	s.tcpMu.Unlock()
+	if ok {
+		return c, nil
+	}
+	if s.udp != nil && !strings.EqualFold(transport, "tcp") {
+		return s.udp, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", dst.String(), tcpDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c = s.addTCPConn(conn)
+	go s.serveTCP(c)
+	return c, nil
+}